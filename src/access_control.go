@@ -3,22 +3,367 @@ package src
 import (
 	"fmt"
 	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"openai-telegram-bot/src/protos"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// access states of users managed at runtime, they take priority over `Config.Users`
+const AccessStateRequested = 1
+const AccessStateAllowed = 2
+const AccessStateDenied = 3
+const AccessStateRejected = 4
+
+// requests are kept for a while, so a user cannot flood admins with them
+const accessRequestTTL = time.Hour * 24 * 7
+
+const callbackActionRequestAccess = "q"
+const callbackActionApproveAccess = "y"
+const callbackActionRejectAccess = "z"
+
+// CheckUserAccess checks if the sender of the update can use the bot. Every decision is logged with the rule
+// that has made it.
 func CheckUserAccess(appContext *AppContext, update *tgbotapi.Update) bool {
+	allowed, rule := getAccessDecision(appContext, update.SentFrom(), update.FromChat())
+
+	event := log.Debug()
+	if !allowed {
+		event = log.Info()
+	}
+
+	if sender := update.SentFrom(); sender != nil {
+		event = event.Int64("user", sender.ID)
+	}
+
+	if chat := update.FromChat(); chat != nil {
+		event = event.Int64("chat", chat.ID)
+	}
+
+	event.Bool("allowed", allowed).Str("rule", rule).Msg("Access checked")
+
+	return allowed
+}
+
+// getAccessDecision returns if the user can use the bot in the chat and the rule that has decided it. Admins always
+// have access, then users and rules denying access take priority over ones allowing it.
+func getAccessDecision(appContext *AppContext, sender *tgbotapi.User, chat *tgbotapi.Chat) (bool, string) {
+	if sender == nil {
+		return false, "no sender"
+	}
+
+	if appContext.Config.IsAdmin(sender.ID) {
+		return true, "admin"
+	}
+
+	access, err := appContext.Database.GetUserAccess(sender.ID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get user access")
+	}
+
+	if access.GetState() == AccessStateDenied {
+		return false, "denied user"
+	}
+
+	if rule := matchAccessRules(appContext, true, sender, chat); rule != "" {
+		return false, rule
+	}
+
+	if access.GetState() == AccessStateAllowed {
+		return true, "allowed user"
+	}
+
+	if rule := matchAccessRules(appContext, false, sender, chat); rule != "" {
+		return true, rule
+	}
+
 	allowedUsers := appContext.Config.Users
-	if len(allowedUsers) == 0 {
-		return true
+	// rules allowing access would mean nothing if everyone had it, so they restrict access as well
+	if len(allowedUsers) == 0 && !appContext.Config.RestrictAccess && !hasAllowRules(appContext.Config) {
+		return true, "no restrictions"
 	}
 
-	userId := update.Message.From.ID
-	userName := update.Message.From.UserName
+	userId := sender.ID
+	userName := sender.UserName
 
 	for _, allowedUser := range allowedUsers {
 		if (userName != "" && allowedUser == userName) || allowedUser == fmt.Sprintf("%d", userId) {
-			return true
+			return true, "users list"
+		}
+	}
+
+	return false, "no matching rule"
+}
+
+func formatAccessUser(access *protos.UserAccess) string {
+	if access.UserName != "" {
+		return fmt.Sprintf("@%s (%d)", access.UserName, access.UserId)
+	}
+
+	return fmt.Sprintf("%d", access.UserId)
+}
+
+// setUserAccess changes access of the user by an admin. Users who have requested access are notified.
+func setUserAccess(appContext *AppContext, userId int64, userName string, state int64, adminId int64) (*protos.UserAccess, error) {
+	if appContext.Config.IsAdmin(userId) {
+		return nil, fmt.Errorf("access of admins cannot be changed")
+	}
+
+	previous, err := appContext.Database.GetUserAccess(userId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user access: %s", err)
+	}
+
+	if userName == "" {
+		userName = previous.GetUserName()
+	}
+
+	access := &protos.UserAccess{
+		UserId:    userId,
+		UserName:  userName,
+		State:     state,
+		ChangedBy: adminId,
+		ChangedAt: time.Now().Unix(),
+	}
+
+	var ttl time.Duration
+	if state == AccessStateRejected {
+		ttl = accessRequestTTL
+	}
+
+	err = appContext.Database.SetUserAccess(access, ttl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save user access: %s", err)
+	}
+
+	if previous.GetState() == AccessStateRequested {
+		notification := "❌ Your access request has been rejected"
+		if state == AccessStateAllowed {
+			notification = "✅ Your access request has been approved, you can use the bot now"
+		}
+
+		_, err = sendWithRetry(appContext, userId, tgbotapi.NewMessage(userId, notification))
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to notify user about access")
 		}
 	}
 
-	return false
+	return access, nil
+}
+
+// getTargetUser returns the user an admin command is about: the author of the replied message, a user id
+// or a user name of somebody who has requested access before
+func getTargetUser(appContext *AppContext, arg string, msg *tgbotapi.Message) (int64, string, error) {
+	arg = strings.TrimPrefix(strings.TrimSpace(arg), "@")
+
+	if arg == "" {
+		if msg.ReplyToMessage != nil && msg.ReplyToMessage.From != nil && !msg.ReplyToMessage.From.IsBot {
+			return msg.ReplyToMessage.From.ID, msg.ReplyToMessage.From.UserName, nil
+		}
+
+		return 0, "", fmt.Errorf("please provide a user id or a user name, or reply to a message of the user")
+	}
+
+	if userId, err := strconv.ParseInt(arg, 10, 64); err == nil {
+		return userId, "", nil
+	}
+
+	accesses, err := appContext.Database.GetAllUserAccess()
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to get users: %s", err)
+	}
+
+	for _, access := range accesses {
+		if strings.EqualFold(access.UserName, arg) {
+			return access.UserId, access.UserName, nil
+		}
+	}
+
+	return 0, "", fmt.Errorf("unknown user, please use a user id or reply to a message of the user")
+}
+
+// handleAccessCommand handles /allow and /deny commands of admins
+func handleAccessCommand(appContext *AppContext, state int64, msg *tgbotapi.Message) {
+	if !appContext.Config.IsAdmin(msg.From.ID) {
+		sendError(appContext, "Only admins can manage users", msg.Chat.ID)
+		return
+	}
+
+	userId, userName, err := getTargetUser(appContext, msg.CommandArguments(), msg)
+	if err != nil {
+		sendError(appContext, err.Error(), msg.Chat.ID)
+		return
+	}
+
+	access, err := setUserAccess(appContext, userId, userName, state, msg.From.ID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to change user access")
+		sendError(appContext, fmt.Sprintf("Failed to change user access: %s", err), msg.Chat.ID)
+		return
+	}
+
+	log.Info().Int64("admin", msg.From.ID).Int64("user", userId).Int64("state", state).Msg("User access changed")
+
+	if state == AccessStateAllowed {
+		sendNotice(appContext, fmt.Sprintf("✅ Access granted to %s", formatAccessUser(access)), msg)
+	} else {
+		sendNotice(appContext, fmt.Sprintf("⛔ Access denied to %s", formatAccessUser(access)), msg)
+	}
+}
+
+// sendUsers lists admins, users from config and users managed at runtime
+func sendUsers(appContext *AppContext, msg *tgbotapi.Message) {
+	if !appContext.Config.IsAdmin(msg.From.ID) {
+		sendError(appContext, "Only admins can manage users", msg.Chat.ID)
+		return
+	}
+
+	accesses, err := appContext.Database.GetAllUserAccess()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get users")
+		sendError(appContext, "Failed to get users", msg.Chat.ID)
+		return
+	}
+
+	sort.Slice(accesses, func(i, j int) bool {
+		return accesses[i].UserId < accesses[j].UserId
+	})
+
+	listed := map[int64][]string{}
+	for _, access := range accesses {
+		listed[access.State] = append(listed[access.State], formatAccessUser(access))
+	}
+
+	var admins []string
+	for _, adminId := range appContext.Config.Admins {
+		admins = append(admins, fmt.Sprintf("%d", adminId))
+	}
+
+	lines := []string{
+		"👥 Admins: " + formatUserList(admins),
+		"Users from config: " + formatUserList(appContext.Config.Users),
+		"Allowed: " + formatUserList(listed[AccessStateAllowed]),
+		"Denied: " + formatUserList(listed[AccessStateDenied]),
+		"Pending requests: " + formatUserList(listed[AccessStateRequested]),
+	}
+
+	sendNotice(appContext, strings.Join(lines, "\n"), msg)
+}
+
+func formatUserList(users []string) string {
+	if len(users) == 0 {
+		return "none"
+	}
+
+	return strings.Join(users, ", ")
+}
+
+// newRequestAccessKeyboard returns a button to ask admins for access. The button is bound to the user, so only
+// they can press it in group chats.
+func newRequestAccessKeyboard(appContext *AppContext, userId int64) tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🔑 Request access",
+			NewCallbackData(appContext, callbackActionRequestAccess, fmt.Sprintf("user:%d", userId), "")),
+	))
+}
+
+func handleRequestAccessCallback(appContext *AppContext, query *tgbotapi.CallbackQuery, dialogId string, arg string) (string, error) {
+	access, err := appContext.Database.GetUserAccess(query.From.ID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get user access: %s", err)
+	}
+
+	switch access.GetState() {
+	case AccessStateRequested:
+		return "❕Your access request has already been sent to admins", nil
+	case AccessStateRejected, AccessStateDenied:
+		return "❕Your access request has been rejected", nil
+	case AccessStateAllowed:
+		return "❕You already have access", nil
+	}
+
+	access = &protos.UserAccess{
+		UserId:    query.From.ID,
+		UserName:  query.From.UserName,
+		State:     AccessStateRequested,
+		ChangedAt: time.Now().Unix(),
+	}
+
+	err = appContext.Database.SetUserAccess(access, accessRequestTTL)
+	if err != nil {
+		return "", fmt.Errorf("failed to save access request: %s", err)
+	}
+
+	log.Info().Int64("user", query.From.ID).Msg("User requested access")
+
+	text := fmt.Sprintf("🔑 Access request from %s %s", strings.TrimSpace(query.From.FirstName+" "+query.From.LastName),
+		formatAccessUser(access))
+	arg = fmt.Sprintf("%d", query.From.ID)
+
+	notified := 0
+	for _, adminId := range appContext.Config.Admins {
+		notification := tgbotapi.NewMessage(adminId, text)
+		notification.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Approve", NewCallbackData(appContext, callbackActionApproveAccess, "", arg)),
+			tgbotapi.NewInlineKeyboardButtonData("❌ Reject", NewCallbackData(appContext, callbackActionRejectAccess, "", arg)),
+		))
+
+		_, err = sendWithRetry(appContext, adminId, notification)
+		if err != nil {
+			log.Error().Err(err).Int64("admin", adminId).Msg("Failed to send access request to admin")
+			continue
+		}
+
+		notified++
+	}
+
+	if notified == 0 {
+		return "", fmt.Errorf("failed to reach admins")
+	}
+
+	return "❕Access requested, you will be notified when an admin answers", nil
+}
+
+func handleApproveAccessCallback(appContext *AppContext, query *tgbotapi.CallbackQuery, dialogId string, arg string) (string, error) {
+	return answerAccessRequest(appContext, query, arg, AccessStateAllowed)
+}
+
+func handleRejectAccessCallback(appContext *AppContext, query *tgbotapi.CallbackQuery, dialogId string, arg string) (string, error) {
+	return answerAccessRequest(appContext, query, arg, AccessStateRejected)
+}
+
+func answerAccessRequest(appContext *AppContext, query *tgbotapi.CallbackQuery, arg string, state int64) (string, error) {
+	if !appContext.Config.IsAdmin(query.From.ID) {
+		return "", fmt.Errorf("only admins can answer access requests")
+	}
+
+	userId, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid user id: %s", arg)
+	}
+
+	request, err := appContext.Database.GetUserAccess(userId)
+	if err != nil {
+		return "", fmt.Errorf("failed to get user access: %s", err)
+	}
+
+	// another admin may have answered already
+	if request.GetState() != AccessStateRequested {
+		return "❕The request has already been answered", nil
+	}
+
+	access, err := setUserAccess(appContext, userId, "", state, query.From.ID)
+	if err != nil {
+		return "", err
+	}
+
+	log.Info().Int64("admin", query.From.ID).Int64("user", userId).Int64("state", state).Msg("Access request answered")
+
+	if state == AccessStateAllowed {
+		return fmt.Sprintf("✅ Access granted to %s", formatAccessUser(access)), nil
+	}
+
+	return fmt.Sprintf("❌ Access request of %s rejected", formatAccessUser(access)), nil
 }
@@ -0,0 +1,150 @@
+package src
+
+import (
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"strings"
+	"testing"
+)
+
+const testAdminId = 7
+
+func (h *testHarness) asAdmin() {
+	h.user = &tgbotapi.User{ID: testAdminId, UserName: "admin"}
+	h.chat = &tgbotapi.Chat{ID: testAdminId, Type: "private"}
+}
+
+func (h *testHarness) asUser() {
+	h.user = &tgbotapi.User{ID: testUserId, UserName: "test_user", FirstName: "Test"}
+	h.chat = &tgbotapi.Chat{ID: testChatId, Type: "private"}
+}
+
+func TestAccessRequestApproved(t *testing.T) {
+	h := newTestHarness(t, withAccessControl)
+
+	h.sendText("Hi")
+
+	if h.openai.chatRequestCount() != 0 {
+		t.Fatalf("expected an unauthorized user not to be answered")
+	}
+
+	notWanted := h.telegram.lastCallTo("sendMessage")
+	requestData, ok := notWanted.callbackButtons(t)["🔑 Request access"]
+	if !ok {
+		t.Fatalf("expected a request access button")
+	}
+
+	h.pressButton(requestData, h.sentMessage(notWanted))
+
+	request := h.telegram.lastCallTo("sendMessage")
+	if request.Params.Get("chat_id") != "7" || !strings.Contains(request.Params.Get("text"), "@test_user (42)") {
+		t.Fatalf("expected the admin to be asked, got %v", request.Params)
+	}
+
+	h.pressButton(requestData, h.sentMessage(notWanted))
+
+	if got := h.telegram.lastCallTo("editMessageText").Params.Get("text"); got != "❕Your access request has already been sent to admins" {
+		t.Errorf("expected a repeated request not to be sent, got %q", got)
+	}
+
+	h.asAdmin()
+	h.pressButton(request.callbackButtons(t)["✅ Approve"], h.sentMessage(request))
+
+	if got := h.telegram.lastCallTo("editMessageText").Params.Get("text"); got != "✅ Access granted to @test_user (42)" {
+		t.Errorf("expected the request to be approved, got %q", got)
+	}
+
+	if got := h.telegram.lastCallTo("sendMessage"); got.Params.Get("chat_id") != "42" || !strings.Contains(got.Params.Get("text"), "approved") {
+		t.Errorf("expected the user to be notified, got %v", got.Params)
+	}
+
+	h.asUser()
+	h.sendText("Hi")
+
+	if h.openai.chatRequestCount() != 1 {
+		t.Errorf("expected an approved user to be answered")
+	}
+}
+
+func TestAccessRequestRejected(t *testing.T) {
+	h := newTestHarness(t, withAccessControl)
+
+	h.sendText("Hi")
+
+	notWanted := h.telegram.lastCallTo("sendMessage")
+	h.pressButton(notWanted.callbackButtons(t)["🔑 Request access"], h.sentMessage(notWanted))
+
+	request := h.telegram.lastCallTo("sendMessage")
+
+	h.pressButton(request.callbackButtons(t)["✅ Approve"], h.sentMessage(request))
+
+	if access, _ := h.appContext.Database.GetUserAccess(testUserId); access.GetState() != AccessStateRequested {
+		t.Errorf("expected users not to approve themselves, got %v", access)
+	}
+
+	h.asAdmin()
+	h.pressButton(request.callbackButtons(t)["❌ Reject"], h.sentMessage(request))
+
+	h.asUser()
+	h.sendText("Hi")
+
+	if h.openai.chatRequestCount() != 0 {
+		t.Errorf("expected a rejected user not to be answered")
+	}
+
+	h.pressButton(notWanted.callbackButtons(t)["🔑 Request access"], h.sentMessage(notWanted))
+
+	if got := h.telegram.lastCallTo("editMessageText").Params.Get("text"); got != "❕Your access request has been rejected" {
+		t.Errorf("expected a rejected request not to be sent again, got %q", got)
+	}
+}
+
+func TestAccessCommands(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.Admins = []int64{testAdminId}
+		config.Users = []string{"test_user"}
+	})
+
+	h.sendText("/users")
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); got != "‼ Only admins can manage users" {
+		t.Errorf("expected users not to manage users, got %q", got)
+	}
+
+	h.asAdmin()
+	h.sendText("/deny 42")
+	h.sendText("/allow 43")
+	h.sendText("/deny 7")
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); !strings.Contains(got, "admins cannot be changed") {
+		t.Errorf("expected admins not to be denied, got %q", got)
+	}
+
+	h.sendText("/users")
+
+	got := h.telegram.lastCallTo("sendMessage").Params.Get("text")
+	for _, expected := range []string{"Admins: 7", "Users from config: test_user", "Allowed: 43", "Denied: 42"} {
+		if !strings.Contains(got, expected) {
+			t.Errorf("expected users to contain %q, got %q", expected, got)
+		}
+	}
+
+	h.asUser()
+	h.sendText("Hi")
+
+	if h.openai.chatRequestCount() != 0 {
+		t.Errorf("expected a denied user from config not to be answered")
+	}
+}
+
+func TestAdminsDoNotRestrictAccess(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.Admins = []int64{testAdminId}
+		config.AccessRules = []AccessRule{{Type: AccessRuleChatType, ChatTypes: []string{"channel"}, Deny: true}}
+	})
+
+	h.sendText("Hi")
+
+	if h.openai.chatRequestCount() != 1 {
+		t.Errorf("expected everyone to be answered with an empty users list, got %d requests", h.openai.chatRequestCount())
+	}
+}
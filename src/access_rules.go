@@ -0,0 +1,120 @@
+package src
+
+import (
+	"fmt"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+// chat membership is cached, so members of big chats don't cost a request on every message
+const chatMemberCacheTTL = 10 * time.Minute
+
+var (
+	chatMemberCache = struct {
+		sync.RWMutex
+		m map[string]chatMemberCacheEntry
+	}{m: make(map[string]chatMemberCacheEntry)}
+)
+
+type chatMemberCacheEntry struct {
+	isMember  bool
+	expiresAt time.Time
+}
+
+// matchAccessRule checks if the rule applies to the user writing in the chat
+func matchAccessRule(appContext *AppContext, rule AccessRule, user *tgbotapi.User, chat *tgbotapi.Chat) bool {
+	switch rule.Type {
+	case AccessRuleChat:
+		if chat == nil {
+			return false
+		}
+
+		for _, chatId := range rule.ChatIds {
+			if chatId == chat.ID {
+				return true
+			}
+		}
+
+	case AccessRuleChatType:
+		if chat == nil {
+			return false
+		}
+
+		for _, chatType := range rule.ChatTypes {
+			if chatType == chat.Type {
+				return true
+			}
+		}
+
+	case AccessRuleMember:
+		for _, chatId := range rule.ChatIds {
+			if isChatMember(appContext, chatId, user.ID) {
+				return true
+			}
+		}
+
+	default:
+		log.Error().Str("type", rule.Type).Msg("Unknown access rule type")
+	}
+
+	return false
+}
+
+// matchAccessRules returns a description of the first matching rule that allows or denies access, or an empty string
+func matchAccessRules(appContext *AppContext, deny bool, user *tgbotapi.User, chat *tgbotapi.Chat) string {
+	for i, rule := range appContext.Config.AccessRules {
+		if rule.Deny == deny && matchAccessRule(appContext, rule, user, chat) {
+			action := "allow"
+			if deny {
+				action = "deny"
+			}
+
+			return fmt.Sprintf("%s rule #%d (%s)", action, i+1, rule.Type)
+		}
+	}
+
+	return ""
+}
+
+func hasAllowRules(config *Config) bool {
+	for _, rule := range config.AccessRules {
+		if !rule.Deny {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isChatMember checks if the user is a member of the chat with the cached result of `getChatMember`.
+// Failed checks are not cached, the bot has to be in the chat to check its members.
+func isChatMember(appContext *AppContext, chatId int64, userId int64) bool {
+	key := fmt.Sprintf("%d:%d", chatId, userId)
+
+	chatMemberCache.RLock()
+	entry, ok := chatMemberCache.m[key]
+	chatMemberCache.RUnlock()
+
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.isMember
+	}
+
+	member, err := appContext.TelegramBot.GetChatMember(tgbotapi.GetChatMemberConfig{
+		ChatConfigWithUser: tgbotapi.ChatConfigWithUser{ChatID: chatId, UserID: userId},
+	})
+	if err != nil {
+		log.Error().Err(err).Int64("chat", chatId).Int64("user", userId).Msg("Failed to get chat member")
+		return false
+	}
+
+	isMember := member.IsCreator() || member.IsAdministrator() || member.Status == "member" ||
+		(member.Status == "restricted" && member.IsMember)
+
+	chatMemberCache.Lock()
+	chatMemberCache.m[key] = chatMemberCacheEntry{isMember: isMember, expiresAt: time.Now().Add(chatMemberCacheTTL)}
+	chatMemberCache.Unlock()
+
+	return isMember
+}
@@ -0,0 +1,80 @@
+package src
+
+import (
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"testing"
+)
+
+func TestAccessRuleMember(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.AccessRules = []AccessRule{{Type: AccessRuleMember, ChatIds: []int64{-500}}}
+	})
+
+	h.sendText("Hi")
+
+	if h.openai.chatRequestCount() != 0 {
+		t.Errorf("expected a user outside the team chat not to be answered")
+	}
+
+	h.telegram.setMember(-500, 43, "member")
+	h.user = &tgbotapi.User{ID: 43, UserName: "member"}
+	h.chat = &tgbotapi.Chat{ID: 43, Type: "private"}
+
+	h.sendText("Hi")
+	h.sendText("Hi again")
+
+	if h.openai.chatRequestCount() != 2 {
+		t.Errorf("expected a member of the team chat to be answered, got %d requests", h.openai.chatRequestCount())
+	}
+
+	if got := len(h.telegram.callsTo("getChatMember")); got != 2 {
+		t.Errorf("expected membership to be cached, got %d requests", got)
+	}
+}
+
+func TestAccessRulesDenyPriority(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		withGroupTriggers(config)
+		config.Users = []string{"test_user"}
+		config.AccessRules = []AccessRule{
+			{Type: AccessRuleChat, ChatIds: []int64{-300}},
+			{Type: AccessRuleChat, ChatIds: []int64{-100}, Deny: true},
+		}
+	})
+	h.inGroup()
+
+	h.sendText("bot, hi")
+
+	if h.openai.chatRequestCount() != 0 {
+		t.Errorf("expected a user from the list not to be answered in a denied chat")
+	}
+
+	h.chat = &tgbotapi.Chat{ID: -300, Type: "group", Title: "Allowed"}
+	h.user = &tgbotapi.User{ID: 44, UserName: "guest"}
+
+	h.sendText("bot, hi")
+
+	if h.openai.chatRequestCount() != 1 {
+		t.Errorf("expected anyone to be answered in an allowed chat")
+	}
+
+	h.chat = &tgbotapi.Chat{ID: 44, Type: "private"}
+
+	h.sendText("Hi")
+
+	if h.openai.chatRequestCount() != 1 {
+		t.Errorf("expected a guest not to be answered outside the allowed chat")
+	}
+}
+
+func TestAccessRuleChatType(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.AccessRules = []AccessRule{{Type: AccessRuleChatType, ChatTypes: []string{"private"}, Deny: true}}
+	})
+
+	h.sendText("Hi")
+
+	if h.openai.chatRequestCount() != 0 {
+		t.Errorf("expected private chats to be denied")
+	}
+}
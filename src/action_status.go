@@ -26,8 +26,12 @@ func StartTypingStatus(appContext *AppContext, chatId int64) chan interface{} {
 	ch := make(chan interface{})
 
 	go StatusUpdate(ch, func() {
-		actionConfig := tgbotapi.NewChatAction(chatId, "typing")
-		_, err := appContext.TelegramBot.Send(actionConfig)
+		// the status is shown while the reply is not, so it is skipped rather than holding messages to the chat
+		if getTelegramSendDelay(appContext.Config, chatId) > 0 {
+			return
+		}
+
+		err := requestWithRetry(appContext, chatId, tgbotapi.NewChatAction(chatId, "typing"))
 		if err != nil {
 			log.Error().Err(err).Msg("Failed to send typing action")
 		}
@@ -0,0 +1,197 @@
+package src
+
+import (
+	"fmt"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"github.com/sashabaranov/go-openai"
+	"google.golang.org/protobuf/proto"
+	"openai-telegram-bot/src/protos"
+	"strings"
+)
+
+const callbackActionRegenerate = "r"
+const callbackActionContinue = "n"
+
+const continuePrompt = "Continue your last answer exactly from where it stopped, without repeating it."
+
+func newAnswerKeyboard(appContext *AppContext, dialogId string) tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔄 Regenerate", NewCallbackData(appContext, callbackActionRegenerate, dialogId, "")),
+			tgbotapi.NewInlineKeyboardButtonData("⏩ Continue", NewCallbackData(appContext, callbackActionContinue, dialogId, "")),
+		),
+	)
+}
+
+// setLastAnswer remembers the message with the last answer in the dialog and removes buttons from the previous one,
+// because only the last answer can be regenerated or continued
+func setLastAnswer(appContext *AppContext, dialogId string, chatId int64, messageId int) {
+	prevMessageId, err := appContext.Database.SetDialogLastAnswer(dialogId, messageId)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to save last answer")
+		return
+	}
+
+	if prevMessageId != 0 && prevMessageId != messageId {
+		removeInlineKeyboard(appContext, chatId, prevMessageId)
+	}
+}
+
+func removeInlineKeyboard(appContext *AppContext, chatId int64, messageId int) {
+	edit := tgbotapi.NewEditMessageReplyMarkup(chatId, messageId, tgbotapi.InlineKeyboardMarkup{
+		InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{},
+	})
+
+	err := requestWithRetry(appContext, chatId, edit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to remove inline keyboard")
+	}
+}
+
+// getLastAnswer returns stored dialog messages if the message is still the last answer in the dialog
+func getLastAnswer(appContext *AppContext, dialogId string, query *tgbotapi.CallbackQuery) ([]*protos.DialogMessage, error) {
+	lastAnswerId, err := appContext.Database.GetDialogLastAnswer(dialogId)
+	if err != nil {
+		return nil, err
+	}
+
+	if lastAnswerId != query.Message.MessageID {
+		removeInlineKeyboard(appContext, query.Message.Chat.ID, query.Message.MessageID)
+		return nil, fmt.Errorf("only the last answer can be changed")
+	}
+
+	dialogMessages, err := appContext.Database.GetDialog(dialogId)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(dialogMessages) == 0 || dialogMessages[len(dialogMessages)-1].Role != openai.ChatMessageRoleAssistant {
+		return nil, fmt.Errorf("dialog has no answer to change")
+	}
+
+	return dialogMessages, nil
+}
+
+// getAnswerReplyTo returns the message a new answer should reply to: the original user message if it is known
+func getAnswerReplyTo(query *tgbotapi.CallbackQuery) *tgbotapi.Message {
+	if query.Message.ReplyToMessage != nil {
+		return query.Message.ReplyToMessage
+	}
+
+	return query.Message
+}
+
+func handleRegenerateCallback(appContext *AppContext, query *tgbotapi.CallbackQuery, dialogId string, arg string) (string, error) {
+	dialogMessages, err := getLastAnswer(appContext, dialogId, query)
+	if err != nil {
+		return "", err
+	}
+
+	// the previous answer is kept until the new one is received, so it is not lost if the request fails or is stopped
+	lastAnswer := dialogMessages[len(dialogMessages)-1]
+	answer := requestDialogAnswer(appContext, NewUsageOwner(query.From, query.Message.Chat), dialogId, dialogMessages[:len(dialogMessages)-1], getAnswerReplyTo(query))
+	if answer == nil {
+		return "", nil
+	}
+
+	// the context policy may have replaced the stored history, the previous answer is gone with it then
+	dialogMessages, err = appContext.Database.GetDialog(dialogId)
+	if err != nil {
+		return "", fmt.Errorf("failed to get dialog messages: %s", err)
+	}
+
+	count := 0
+	if len(dialogMessages) > 0 && proto.Equal(dialogMessages[len(dialogMessages)-1], lastAnswer) {
+		count = 1
+	}
+
+	err = appContext.Database.ReplaceDialogTail(dialogId, count, answer)
+	if err != nil {
+		return "", fmt.Errorf("failed to save regenerated answer: %s", err)
+	}
+
+	return "", nil
+}
+
+func handleContinueCallback(appContext *AppContext, query *tgbotapi.CallbackQuery, dialogId string, arg string) (string, error) {
+	dialogMessages, err := getLastAnswer(appContext, dialogId, query)
+	if err != nil {
+		return "", err
+	}
+
+	params := GetChatParams(appContext, dialogId)
+	params.Owner = NewUsageOwner(query.From, query.Message.Chat)
+
+	// the stored dialog is fitted, so the policy can change it, and the short prompt fits into the reserve for a reply
+	dialogMessages, ok := fitDialogContext(appContext, dialogId, params, dialogMessages, query.Message)
+	if !ok {
+		return "", nil
+	}
+
+	lastAnswer := strings.TrimSuffix(dialogMessages[len(dialogMessages)-1].Content, partialReplyMarker)
+	dialogMessages[len(dialogMessages)-1].Content = lastAnswer
+
+	// the prompt is only used for this request, the continuation is appended to the last answer
+	dialogMessages = append(dialogMessages, &protos.DialogMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: continuePrompt,
+	})
+
+	continuation, sentMsgIds := sendModelReply(appContext, dialogId, params, withSystemPrompt(params, dialogMessages), query.Message)
+	if continuation == "" {
+		return "", nil
+	}
+
+	err = appContext.Database.ReplaceDialogTail(dialogId, 1, &protos.DialogMessage{
+		Role:               openai.ChatMessageRoleAssistant,
+		Content:            lastAnswer + continuation,
+		TelegramMessageIds: append(dialogMessages[len(dialogMessages)-2].TelegramMessageIds, toMessageIds(sentMsgIds)...),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to save continued answer: %s", err)
+	}
+
+	return "", nil
+}
+
+// editLastMessage replaces the last user message in the dialog (and the answer to it) and asks the model again
+func editLastMessage(appContext *AppContext, dialogId string, text string, msg *tgbotapi.Message) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		sendError(appContext, "Please provide a new text for your last message: /edit <text>", msg.Chat.ID)
+		return
+	}
+
+	dialogMessages, err := appContext.Database.GetDialog(dialogId)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get dialog messages")
+		return
+	}
+
+	lastUserIndex := -1
+	for i := len(dialogMessages) - 1; i >= 0; i-- {
+		if dialogMessages[i].Role == openai.ChatMessageRoleUser {
+			lastUserIndex = i
+			break
+		}
+	}
+
+	if lastUserIndex < 0 {
+		sendError(appContext, "There is no message to edit in this dialog", msg.Chat.ID)
+		return
+	}
+
+	err = appContext.Database.ReplaceDialogTail(dialogId, len(dialogMessages)-lastUserIndex, &protos.DialogMessage{
+		Role:               openai.ChatMessageRoleUser,
+		Content:            text,
+		TelegramMessageIds: []int64{int64(msg.MessageID)},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to replace last message")
+		sendError(appContext, "Failed to edit last message", msg.Chat.ID)
+		return
+	}
+
+	answerDialog(appContext, NewUsageOwner(msg.From, msg.Chat), dialogId, msg)
+}
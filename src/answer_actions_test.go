@@ -0,0 +1,130 @@
+package src
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestRegenerateAnswer(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	h.openai.addReply("First answer")
+	h.sendText("Hi")
+
+	answer := h.telegram.lastCallTo("sendMessage")
+
+	h.openai.addReply("Second answer")
+	h.pressButton(answer.callbackButtons(t)["🔄 Regenerate"], h.sentMessage(answer))
+
+	if got := h.openai.lastChatRequest().Messages; len(got) != 1 || got[0].Content != "Hi" {
+		t.Errorf("expected the answer to be requested again without the old one, got %v", got)
+	}
+
+	expected := []string{"user: Hi", "assistant: Second answer"}
+	if got := h.dialog(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected dialog %q, got %q", expected, got)
+	}
+
+	// only the last answer has buttons
+	removed := h.telegram.lastCallTo("editMessageReplyMarkup")
+	if removed.MessageID != answer.MessageID {
+		t.Errorf("expected buttons to be removed from the old answer")
+	}
+}
+
+func TestFailedRegenerationKeepsAnswer(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	h.openai.addReply("First answer")
+	h.sendText("Hi")
+
+	answer := h.telegram.lastCallTo("sendMessage")
+
+	h.openai.addError(http.StatusBadRequest, "invalid_request_error")
+	h.pressButton(answer.callbackButtons(t)["🔄 Regenerate"], h.sentMessage(answer))
+
+	expected := []string{"user: Hi", "assistant: First answer"}
+	if got := h.dialog(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected dialog %q, got %q", expected, got)
+	}
+}
+
+func TestContinueAnswer(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	h.openai.addReply("The beginning")
+	h.sendText("Hi")
+
+	answer := h.telegram.lastCallTo("sendMessage")
+
+	h.openai.addReply(" and the end")
+	h.pressButton(answer.callbackButtons(t)["⏩ Continue"], h.sentMessage(answer))
+
+	messages := h.openai.lastChatRequest().Messages
+	if len(messages) != 3 || messages[1].Content != "The beginning" || messages[2].Content != continuePrompt {
+		t.Errorf("expected the dialog to be sent with the prompt to continue, got %v", messages)
+	}
+
+	// the prompt is not stored, the continuation is appended to the answer
+	expected := []string{"user: Hi", "assistant: The beginning and the end"}
+	if got := h.dialog(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected dialog %q, got %q", expected, got)
+	}
+}
+
+func TestOnlyLastAnswerCanBeChanged(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	h.sendText("Hi")
+	first := h.telegram.lastCallTo("sendMessage")
+
+	h.sendText("Hi again")
+	h.pressButton(first.callbackButtons(t)["🔄 Regenerate"], h.sentMessage(first))
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); got != "‼ Failed to handle button: only the last answer can be changed" {
+		t.Errorf("expected an error message, got %q", got)
+	}
+
+	if got := h.openai.chatRequestCount(); got != 2 {
+		t.Errorf("expected no new requests, got %d", got)
+	}
+}
+
+func TestEditLastMessage(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	h.sendText("Hi")
+	h.sendText("What is the capital of Frnace?")
+
+	h.openai.addReply("Paris")
+	h.sendText("/edit What is the capital of France?")
+
+	if got := h.openai.lastChatRequest().Messages; len(got) != 3 || got[2].Content != "What is the capital of France?" {
+		t.Errorf("expected the edited message to be sent instead of the old one, got %v", got)
+	}
+
+	expected := []string{
+		"user: Hi",
+		"assistant: " + fakeReplyText,
+		"user: What is the capital of France?",
+		"assistant: Paris",
+	}
+	if got := h.dialog(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected dialog %q, got %q", expected, got)
+	}
+}
+
+func TestEditWithoutMessage(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	h.sendText("/edit Hello")
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); got != "‼ There is no message to edit in this dialog" {
+		t.Errorf("expected an error message, got %q", got)
+	}
+
+	if got := h.openai.chatRequestCount(); got != 0 {
+		t.Errorf("expected no requests, got %d", got)
+	}
+}
@@ -1,17 +1,23 @@
 package src
 
 import (
+	"context"
 	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/rs/zerolog"
-	"github.com/sashabaranov/go-openai"
+	"net/http"
 	"os"
 )
 
 type AppContext struct {
-	Config      *Config
-	TelegramBot *tgbotapi.BotAPI
-	OpenAI      *openai.Client
-	Database    *Database
+	Config        *Config
+	TelegramBot   *tgbotapi.BotAPI
+	Chat          ChatBackend
+	Images        ImageBackend
+	Transcription TranscriptionBackend
+	Database      *Database
+
+	// Context is cancelled when the bot shuts down and running requests have to be aborted
+	Context context.Context
 }
 
 func NewAppContext() (*AppContext, error) {
@@ -25,24 +31,44 @@ func NewAppContext() (*AppContext, error) {
 		return nil, err
 	}
 
-	tg, err := tgbotapi.NewBotAPI(config.TelegramToken)
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+
+	return NewAppContextWithConfig(config, "db")
+}
+
+func NewAppContextWithConfig(config *Config, dbPath string) (*AppContext, error) {
+	apiEndpoint := config.TelegramApiEndpoint
+	if apiEndpoint == "" {
+		apiEndpoint = tgbotapi.APIEndpoint
+	}
+
+	client := &http.Client{Transport: &telegramTimeoutTransport{
+		timeout: getTelegramTimeout(config),
+		base:    http.DefaultTransport,
+	}}
+
+	tg, err := tgbotapi.NewBotAPIWithClient(config.TelegramToken, apiEndpoint, client)
 	if err != nil {
 		return nil, err
 	}
 
-	openaiClient := openai.NewClient(config.OpenAIApiKey)
-
-	db, err := NewDatabase("db")
+	openaiBackend, err := NewOpenAIBackend(config)
 	if err != nil {
 		return nil, err
 	}
 
-	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	db, err := NewDatabase(dbPath)
+	if err != nil {
+		return nil, err
+	}
 
 	return &AppContext{
-		Config:      config,
-		TelegramBot: tg,
-		OpenAI:      openaiClient,
-		Database:    db,
+		Config:        config,
+		TelegramBot:   tg,
+		Chat:          openaiBackend,
+		Images:        openaiBackend,
+		Transcription: openaiBackend,
+		Database:      db,
+		Context:       context.Background(),
 	}, nil
 }
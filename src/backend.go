@@ -0,0 +1,26 @@
+package src
+
+import (
+	"context"
+	"github.com/sashabaranov/go-openai"
+)
+
+// Backends use OpenAI request and response types, as most self-hosted servers implement OpenAI-compatible API
+
+type ChatBackend interface {
+	CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error)
+	CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (ChatStream, error)
+}
+
+type ChatStream interface {
+	Recv() (openai.ChatCompletionStreamResponse, error)
+	Close()
+}
+
+type ImageBackend interface {
+	CreateImage(ctx context.Context, req openai.ImageRequest) (openai.ImageResponse, error)
+}
+
+type TranscriptionBackend interface {
+	CreateTranscription(ctx context.Context, req openai.AudioRequest) (openai.AudioResponse, error)
+}
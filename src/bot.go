@@ -1,6 +1,8 @@
 package src
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/rs/zerolog/log"
@@ -17,9 +19,33 @@ func setBotCommands(appContext *AppContext) {
 	}, tgbotapi.BotCommand{
 		Command:     "new",
 		Description: "Start a new dialog",
+	}, tgbotapi.BotCommand{
+		Command:     "dialogs",
+		Description: "Switch to, rename or delete saved dialogs",
+	}, tgbotapi.BotCommand{
+		Command:     "export",
+		Description: "Export this dialog as md, json or jsonl file",
+	}, tgbotapi.BotCommand{
+		Command:     "import",
+		Description: "Import a dialog from an exported file",
 	}, tgbotapi.BotCommand{
 		Command:     "imagine",
 		Description: "Generate image from text",
+	}, tgbotapi.BotCommand{
+		Command:     "model",
+		Description: "Show or change the model used in this dialog",
+	}, tgbotapi.BotCommand{
+		Command:     "persona",
+		Description: "Choose a persona for this dialog",
+	}, tgbotapi.BotCommand{
+		Command:     "edit",
+		Description: "Replace your last message and ask again",
+	}, tgbotapi.BotCommand{
+		Command:     "stop",
+		Description: "Stop the reply being written",
+	}, tgbotapi.BotCommand{
+		Command:     "usage",
+		Description: "Show used tokens, images and voice minutes",
 	})
 
 	_, err := appContext.TelegramBot.Request(setCommands)
@@ -29,58 +55,103 @@ func setBotCommands(appContext *AppContext) {
 }
 
 func handleUpdate(appContext *AppContext, update tgbotapi.Update) {
+	updatesReceived.inc(getUpdateType(update))
+
+	if update.CallbackQuery != nil && update.CallbackQuery.Message != nil {
+		handleCallbackQuery(appContext, update)
+		return
+	}
+
 	if update.Message == nil {
 		return
 	}
 
+	if isGroupChat(update.Message) && !isAddressedToBot(appContext, update.Message) {
+		if CheckUserAccess(appContext, &update) {
+			storeGroupMessage(appContext, GetDialogId(appContext, &update), update.Message)
+		}
+
+		return
+	}
+
 	if !CheckUserAccess(appContext, &update) {
 		log.Error().Str("user", GetFormattedSenderName(update.Message)).Msg("Unauthorized user tried to access bot")
 		sendNotWantedHere(appContext, update.Message.Chat.ID, update.Message.From.ID, update.Message.MessageID)
 		return
 	}
 
-	dialogId := GetDialogId(appContext, &update)
+	dialogId := forkDialogOnReply(appContext, GetDialogId(appContext, &update), update.Message)
 
-	isAnswering := GetDialogEphemeralStatus(dialogId)
-	if isAnswering {
-		log.Debug().Str("user", GetFormattedSenderName(update.Message)).Msg("Ignored message because model is already answering")
+	// the queue is busy with the reply to stop
+	if update.Message.Command() == "stop" {
+		commandsHandled.inc("stop")
+		handleStopCommand(appContext, dialogId, update.Message)
 		return
 	}
 
-	SetDialogEphemeralStatus(dialogId, true)
-	defer SetDialogEphemeralStatus(dialogId, false)
-
-	if handleCommand(appContext, dialogId, update.Message) {
+	// limits are checked before any OpenAI request
+	request := getMessageRequest(appContext, update.Message)
+	request.Queued = isMergeableMessage(update.Message)
+	if text := checkLimits(appContext, request, update.Message.From, update.Message.Chat); text != "" {
+		sendNotice(appContext, text, update.Message)
 		return
 	}
 
-	err := resolveDialogContextLimits(appContext, dialogId, update.Message.Text, update.Message.Chat.ID)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to resolve dialog context limits")
+	enqueueMessage(appContext, GetDialogKey(appContext, &update), dialogId, update.Message)
+}
+
+// processMessages handles messages of the dialog taken from its queue. Several messages are only passed together
+// if they were sent while the bot was busy, and they are answered as one user turn.
+func processMessages(appContext *AppContext, dialogKey string, dialogId string, msgs []*tgbotapi.Message) {
+	if len(msgs) == 1 && handleCommand(appContext, dialogId, msgs[0]) {
 		return
 	}
 
-	msgText, err := getTextFromMsg(appContext, update.Message)
-	if err != nil {
-		sendError(appContext, fmt.Sprintf("Failed to get text from message: %s", err), update.Message.Chat.ID)
-		return
+	if renameDialogFromMsg(appContext, dialogKey, msgs[0]) {
+		msgs = msgs[1:]
+	}
+
+	var texts []string
+	var answered []*tgbotapi.Message
+	for _, msg := range msgs {
+		msgText, err := getTextFromMsg(appContext, msg)
+		if err != nil {
+			sendError(appContext, fmt.Sprintf("Failed to get text from message: %s", err), msg.Chat.ID)
+			continue
+		}
+
+		if isVoiceMsg(msg) && !appContext.Config.AnswerVoice {
+			continue
+		}
+
+		if isGroupChat(msg) {
+			msgText = formatGroupMessage(appContext, msg, stripGroupTrigger(appContext, msgText))
+		}
+
+		texts = append(texts, msgText)
+		answered = append(answered, msg)
 	}
 
-	if isVoiceMsg(update.Message) && !appContext.Config.AnswerVoice {
+	if len(answered) == 0 {
 		return
 	}
 
-	answerMessage(appContext, dialogId, msgText, update.Message)
+	answerMessage(appContext, dialogId, strings.Join(texts, "\n\n"), answered)
 }
 
 func handleCommand(appContext *AppContext, dialogId string, msg *tgbotapi.Message) bool {
 	command := msg.Command()
+
+	// files to import are sent with the command in the caption
+	if command == "" && msg.Document != nil && strings.HasPrefix(msg.Caption, "/import") {
+		command = "import"
+	}
 	if command == "start" || command == "help" {
 		sendHello(appContext, msg.Chat.ID)
 	} else if command == "new" {
-		err := appContext.Database.ClearDialog(dialogId)
+		err := startNewDialog(appContext, NewUsageOwner(msg.From, msg.Chat), dialogId)
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to delete dialog")
+			log.Error().Err(err).Msg("Failed to start new dialog")
 			return true
 		}
 
@@ -88,19 +159,85 @@ func handleCommand(appContext *AppContext, dialogId string, msg *tgbotapi.Messag
 		if appContext.Config.SendReplies {
 			reply.ReplyToMessageID = msg.MessageID
 		}
-		_, err = appContext.TelegramBot.Send(reply)
+		_, err = sendWithRetry(appContext, msg.Chat.ID, reply)
 		if err != nil {
 			log.Error().Err(err).Msg("Failed to send new dialog notification")
 		}
+	} else if command == "dialogs" {
+		sendDialogsKeyboard(appContext, dialogId, msg)
+	} else if command == "export" {
+		exportDialog(appContext, dialogId, msg.CommandArguments(), msg)
+	} else if command == "import" {
+		importDialog(appContext, dialogId, msg)
+	} else if command == "allow" {
+		handleAccessCommand(appContext, AccessStateAllowed, msg)
+	} else if command == "deny" {
+		handleAccessCommand(appContext, AccessStateDenied, msg)
+	} else if command == "users" {
+		sendUsers(appContext, msg)
+	} else if command == "usage" {
+		sendUsage(appContext, msg)
 	} else if command == "imagine" {
 		generateImage(appContext, msg.CommandArguments(), msg)
+	} else if command == "model" {
+		selectDialogModel(appContext, dialogId, msg.CommandArguments(), msg)
+	} else if command == "persona" {
+		selectDialogPersona(appContext, dialogId, msg.CommandArguments(), msg)
+	} else if command == "edit" {
+		editLastMessage(appContext, dialogId, msg.CommandArguments(), msg)
 	} else if command != "" {
 		sendError(appContext, fmt.Sprintf("Unknown command: %s", command), msg.Chat.ID)
+		// names of unknown commands are up to users, so they are not used as labels
+		command = "unknown"
+	}
+
+	if command != "" {
+		commandsHandled.inc(command)
 	}
 
 	return command != ""
 }
 
+func getUpdateType(update tgbotapi.Update) string {
+	if update.Message != nil {
+		return "message"
+	} else if update.CallbackQuery != nil {
+		return "callback_query"
+	}
+
+	return "other"
+}
+
+func selectDialogModel(appContext *AppContext, dialogId string, model string, msg *tgbotapi.Message) {
+	model = strings.TrimSpace(model)
+
+	if model == "" {
+		text := fmt.Sprintf("❕Current model: %s", GetChatParams(appContext, dialogId).Model)
+		if len(appContext.Config.Models) > 0 {
+			text += fmt.Sprintf("\nAvailable models: %s", strings.Join(appContext.Config.Models, ", "))
+		}
+
+		sendNotice(appContext, text, msg)
+		return
+	}
+
+	if model == "default" {
+		model = ""
+	} else if !appContext.Config.IsModelAllowed(model) {
+		sendError(appContext, fmt.Sprintf("Model is not allowed: %s", model), msg.Chat.ID)
+		return
+	}
+
+	err := appContext.Database.SetDialogModel(dialogId, model)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to set dialog model")
+		sendError(appContext, "Failed to change model", msg.Chat.ID)
+		return
+	}
+
+	sendNotice(appContext, fmt.Sprintf("❕Model changed to %s", GetChatParams(appContext, dialogId).Model), msg)
+}
+
 func generateImage(appContext *AppContext, prompt string, msg *tgbotapi.Message) {
 	if !appContext.Config.GenerateImages {
 		sendError(appContext, "Image generation is disabled", msg.Chat.ID)
@@ -115,7 +252,7 @@ func generateImage(appContext *AppContext, prompt string, msg *tgbotapi.Message)
 	endTyping := StartTypingStatus(appContext, msg.Chat.ID)
 	defer func() { endTyping <- true }()
 
-	replyUrl, err := Imagine(appContext, prompt)
+	replyUrl, err := Imagine(appContext, NewUsageOwner(msg.From, msg.Chat), prompt)
 	if err != nil {
 		sendError(appContext, fmt.Sprintf("Failed to generate image: %s", err), msg.Chat.ID)
 		return
@@ -126,115 +263,149 @@ func generateImage(appContext *AppContext, prompt string, msg *tgbotapi.Message)
 		replyMsg.ReplyToMessageID = msg.MessageID
 	}
 
-	_, err = appContext.TelegramBot.Send(replyMsg)
+	_, err = sendWithRetry(appContext, msg.Chat.ID, replyMsg)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to send reply")
 	}
 }
 
-func answerMessage(appContext *AppContext, dialogId string, msgText string, msg *tgbotapi.Message) {
-	err := appContext.Database.AddDialogMessage(dialogId, protos.DialogMessage{
-		Role:    openai.ChatMessageRoleUser,
-		Content: msgText,
+// answerMessage saves the messages as one user turn and replies to the last of them
+func answerMessage(appContext *AppContext, dialogId string, msgText string, msgs []*tgbotapi.Message) {
+	msgIds := make([]int, len(msgs))
+	for i, msg := range msgs {
+		msgIds[i] = msg.MessageID
+	}
+
+	msg := msgs[len(msgs)-1]
+
+	err := appContext.Database.AddDialogMessage(dialogId, &protos.DialogMessage{
+		Role:               openai.ChatMessageRoleUser,
+		Content:            msgText,
+		TelegramMessageIds: toMessageIds(msgIds),
 	})
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to save dialog message")
 		return
 	}
 
+	// replies to earlier merged messages continue the dialog too
+	trackDialogMessages(appContext, dialogId, msg.Chat.ID, msgIds[:len(msgIds)-1]...)
+
+	// the message is held until the user chooses how to continue the dialog, and is answered with the question
+	if isContextLimitPending(appContext, dialogId) {
+		trackDialogMessages(appContext, dialogId, msg.Chat.ID, msg.MessageID)
+		sendNotice(appContext, contextLimitPendingNotice, msg)
+		return
+	}
+
+	answerDialog(appContext, NewUsageOwner(msg.From, msg.Chat), dialogId, msg)
+}
+
+// answerDialog requests a reply to the stored dialog, sends it and saves it as an assistant message
+func answerDialog(appContext *AppContext, owner UsageOwner, dialogId string, replyTo *tgbotapi.Message) {
 	dialogMessages, err := appContext.Database.GetDialog(dialogId)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to get dialog messages")
 		return
 	}
 
-	endTyping := StartTypingStatus(appContext, msg.Chat.ID)
-	defer func() { endTyping <- true }()
-
-	replyText := ""
-	if appContext.Config.StreamResponse {
-		replyText, err = streamingReplyToText(appContext, dialogMessages, msg.Chat.ID, msg.MessageID)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to get reply")
-		}
-	} else {
-		replyText, err = replyToText(appContext, dialogMessages, msg.Chat.ID, msg.MessageID)
-		if err != nil {
-			if GetLogicErrorCode(err) == LogicErrorContextLengthExceeded {
-				err := appContext.Database.SetDialogState(dialogId, DialogStateContextLimit)
-				if err != nil {
-					log.Error().Err(err).Msg("Failed to set dialog state")
-				}
-			}
-
-			log.Error().Err(err).Msg("Failed to get reply")
-		}
+	answer := requestDialogAnswer(appContext, owner, dialogId, dialogMessages, replyTo)
+	if answer == nil {
+		return
 	}
 
-	err = appContext.Database.AddDialogMessage(dialogId, protos.DialogMessage{
-		Role:    openai.ChatMessageRoleAssistant,
-		Content: replyText,
-	})
+	err = appContext.Database.AddDialogMessage(dialogId, answer)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to save dialog message")
 	}
 }
 
-func resolveDialogContextLimits(appContext *AppContext, dialogId string, userReply string, chatId int64) error {
-	dialogState, err := appContext.Database.GetDialogState(dialogId)
-	if err != nil {
-		return fmt.Errorf("failed to get dialog state: %s", err)
+// requestDialogAnswer fits the messages into the model context, requests a reply and sends it. Returns the answer to
+// save, or nil if there is none.
+func requestDialogAnswer(appContext *AppContext, owner UsageOwner, dialogId string, dialogMessages []*protos.DialogMessage, replyTo *tgbotapi.Message) *protos.DialogMessage {
+	params := GetChatParams(appContext, dialogId)
+	params.Owner = owner
+
+	dialogMessages, ok := fitDialogContext(appContext, dialogId, params, dialogMessages, replyTo)
+	if !ok {
+		return nil
 	}
 
-	if dialogState == DialogStateContextLimit {
-		if userReply == "Start anew" {
-			// delete this dialog
-			err := appContext.Database.ClearDialog(dialogId)
-			if err != nil {
-				return fmt.Errorf("failed to delete dialog: %s", err)
-			}
-		} else if userReply == "Forget beginning" {
-			err := appContext.Database.DecimateDialog(dialogId)
-			if err != nil {
-				return fmt.Errorf("failed to decimate dialog: %s", err)
-			}
-		} else if userReply == "Summarize history" {
-			dialogMessages, err := appContext.Database.GetDialog(dialogId)
-			if err != nil {
-				return fmt.Errorf("failed to get dialog messages: %s", err)
-			}
+	replyText, sentMsgIds := sendModelReply(appContext, dialogId, params, withSystemPrompt(params, dialogMessages), replyTo)
+	if replyText == "" {
+		return nil
+	}
 
-			summary, err := summarizeDialog(appContext, dialogMessages)
-			if err != nil {
-				return fmt.Errorf("failed to summarize dialog: %s", err)
-			}
+	return &protos.DialogMessage{
+		Role:               openai.ChatMessageRoleAssistant,
+		Content:            replyText,
+		TelegramMessageIds: toMessageIds(sentMsgIds),
+	}
+}
 
-			err = appContext.Database.ReplaceDialog(dialogId, &protos.DialogMessage{
-				Role:    openai.ChatMessageRoleUser,
-				Content: summary,
-			})
-			if err != nil {
-				return err
-			}
+// sendModelReply requests a reply to the messages and sends it to the chat. Returns the text that should be saved
+// to the dialog, which is empty if the model failed to answer, and messages the reply was sent in.
+func sendModelReply(appContext *AppContext, dialogId string, params ChatParams, dialogMessages []*protos.DialogMessage, replyTo *tgbotapi.Message) (string, []int) {
+	endTyping := StartTypingStatus(appContext, replyTo.Chat.ID)
+	defer func() { endTyping <- true }()
 
-			return nil
-		} else {
-			sendError(appContext, fmt.Sprintf("Unknown dialog state reply: %s", userReply), chatId)
-			return fmt.Errorf("unknown dialog state reply: %s", userReply)
+	replyContext, endReply := startStoppableReply(appContext, dialogId)
+	defer endReply()
+
+	status := newRetryStatus(appContext, replyTo)
+	defer status.hide()
+
+	replyContext.Context = withRetryNotice(replyContext.Context, status.show)
+
+	keyboard := newAnswerKeyboard(appContext, dialogId)
+
+	var replyText string
+	var sentMsgIds []int
+	var err error
+	if appContext.Config.StreamResponse {
+		stopKeyboard := newStopKeyboard(appContext, dialogId)
+		replyText, sentMsgIds, err = streamingReplyToText(replyContext, params, dialogMessages, replyTo.Chat.ID, replyTo.MessageID, &keyboard, &stopKeyboard)
+	} else {
+		replyText, sentMsgIds, err = replyToText(replyContext, params, dialogMessages, replyTo.Chat.ID, replyTo.MessageID, &keyboard)
+	}
+
+	if len(sentMsgIds) > 0 {
+		setLastAnswer(appContext, dialogId, replyTo.Chat.ID, sentMsgIds[len(sentMsgIds)-1])
+		trackDialogMessages(appContext, dialogId, replyTo.Chat.ID, append(sentMsgIds, replyTo.MessageID)...)
+	}
+
+	if err == nil {
+		return replyText, sentMsgIds
+	}
+
+	if isReplyStopped(replyContext.Context) {
+		log.Info().Str("dialog", dialogId).Msg("Reply stopped by user")
+
+		if replyText == "" {
+			sendNotice(appContext, "❕The reply has been stopped", replyTo)
 		}
+	} else {
+		log.Error().Err(err).Msg("Failed to get reply")
 
-		// delete dialog state
-		err = appContext.Database.SetDialogState(dialogId, DialogStateNone)
-		if err != nil {
-			return fmt.Errorf("failed to delete dialog state: %s", err)
+		if GetLogicErrorCode(err) == LogicErrorContextLengthExceeded {
+			askContextLimitResolution(appContext, dialogId, replyTo, len(dialogMessages))
+		} else if errors.Is(err, context.Canceled) {
+			sendError(appContext, "The reply has been interrupted, the bot is restarting", replyTo.Chat.ID)
+		} else {
+			sendError(appContext, fmt.Sprintf("Failed to get reply: %s", err), replyTo.Chat.ID)
 		}
 	}
 
-	return nil
+	if replyText == "" {
+		return "", sentMsgIds
+	}
+
+	// keep the partial reply, so the model knows what the user has already seen
+	return replyText + partialReplyMarker, sentMsgIds
 }
 
-func summarizeDialog(appContext *AppContext, dialogMessages []protos.DialogMessage) (string, error) {
-	firstSummary, err := GetCompleteReply(appContext, []protos.DialogMessage{
+func summarizeDialog(appContext *AppContext, params ChatParams, dialogMessages []*protos.DialogMessage) (string, error) {
+	firstSummary, err := GetCompleteReply(appContext, params, []*protos.DialogMessage{
 		{
 			Role:    openai.ChatMessageRoleUser,
 			Content: "Summarize this: \n\n" + mergeDialog(dialogMessages[:len(dialogMessages)/2]),
@@ -244,7 +415,7 @@ func summarizeDialog(appContext *AppContext, dialogMessages []protos.DialogMessa
 		return "", err
 	}
 
-	summary, err := GetCompleteReply(appContext, []protos.DialogMessage{
+	summary, err := GetCompleteReply(appContext, params, []*protos.DialogMessage{
 		{
 			Role: openai.ChatMessageRoleUser,
 			Content: fmt.Sprintf(
@@ -266,7 +437,7 @@ func summarizeDialog(appContext *AppContext, dialogMessages []protos.DialogMessa
 	return summary, err
 }
 
-func mergeDialog(dialogMessages []protos.DialogMessage) string {
+func mergeDialog(dialogMessages []*protos.DialogMessage) string {
 	builder := strings.Builder{}
 
 	for _, msg := range dialogMessages {
@@ -290,14 +461,14 @@ func getTextFromMsg(appContext *AppContext, msg *tgbotapi.Message) (string, erro
 			return "", fmt.Errorf("voice decoding is disabled")
 		}
 
-		msgText, err := DecodeVoice(appContext, msg.Voice)
+		msgText, err := DecodeVoice(appContext, NewUsageOwner(msg.From, msg.Chat), msg.Voice)
 		if err != nil {
 			return "", err
 		}
 
 		decodedMsg := tgbotapi.NewMessage(msg.Chat.ID, "Decoded: "+msgText)
 
-		_, err = appContext.TelegramBot.Send(decodedMsg)
+		_, err = sendWithRetry(appContext, msg.Chat.ID, decodedMsg)
 		if err != nil {
 			log.Error().Err(err).Msg("Failed to send decoded message")
 		}
@@ -310,124 +481,197 @@ func getTextFromMsg(appContext *AppContext, msg *tgbotapi.Message) (string, erro
 	}
 }
 
-func replyToText(appContext *AppContext, dialogMessages []protos.DialogMessage, chatID int64, messageID int) (string, error) {
-	reply, err := GetCompleteReply(appContext, dialogMessages)
+func replyToText(appContext *AppContext, params ChatParams, dialogMessages []*protos.DialogMessage, chatID int64, messageID int, keyboard *tgbotapi.InlineKeyboardMarkup) (string, []int, error) {
+	reply, err := GetCompleteReply(appContext, params, dialogMessages)
 	if err != nil {
-		if logicErr, ok := err.(LogicError); ok && logicErr.Code == LogicErrorContextLengthExceeded {
-			handleContextLengthExceeded(appContext, chatID, len(dialogMessages))
-			return "", err
-		}
-
-		return "", err
+		return "", nil, err
 	}
 
-	msg := tgbotapi.NewMessage(chatID, reply)
-	msg.ParseMode = "Markdown"
-	msg.DisableWebPagePreview = true
-
-	if appContext.Config.SendReplies {
-		msg.ReplyToMessageID = messageID
-	}
+	sentMsgs := &sentReply{}
+	sentMsgs.sync(appContext, chatID, messageID, reply, keyboard)
 
-	_, err = appContext.TelegramBot.Send(msg)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to send reply")
-	}
-
-	return msg.Text, nil
+	return reply, sentMsgs.msgIds, nil
 }
 
-var dialogCloseKeyboard = tgbotapi.NewReplyKeyboard(
-	tgbotapi.NewKeyboardButtonRow(
-		tgbotapi.NewKeyboardButton("Start anew"),
-		tgbotapi.NewKeyboardButton("Forget beginning"),
-		tgbotapi.NewKeyboardButton("Summarize history"),
-	),
-)
+const partialReplyMarker = "\n\n[reply interrupted]"
 
-func handleContextLengthExceeded(appContext *AppContext, chatId int64, messageCount int) {
-	msg := tgbotapi.NewMessage(chatId, fmt.Sprintf("‼ Dialog context is too long (%d messages total). Please choose how to continue:", messageCount))
-	msg.ParseMode = "Markdown"
-	msg.DisableWebPagePreview = true
-	msg.ReplyMarkup = dialogCloseKeyboard
+// streamed replies are edited at most this often, or less often if Telegram limits don't allow it
+const streamEditInterval = time.Second
 
-	_, err := appContext.TelegramBot.Send(msg)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to send reply")
-	}
-}
+// streamingReplyToText sends the reply as it is streamed, with the stop keyboard until it is finished. The text
+// streamed before an error or stop is returned along with the error.
+func streamingReplyToText(appContext *AppContext, params ChatParams, dialogMessages []*protos.DialogMessage, chatId int64, replyTo int, keyboard *tgbotapi.InlineKeyboardMarkup, stopKeyboard *tgbotapi.InlineKeyboardMarkup) (string, []int, error) {
+	activeStreams.inc()
+	defer activeStreams.dec()
 
-func streamingReplyToText(appContext *AppContext, dialogMessages []protos.DialogMessage, chatId int64, replyTo int) (string, error) {
-	replyCh := make(chan string)
+	replyCh := make(chan ReplyDelta)
 
-	sentMsgId := 0
+	sentMsgs := &sentReply{}
 	completeText := strings.Builder{}
-	updateTimer := time.NewTimer(time.Second)
+	updateTimer := time.NewTimer(streamEditInterval)
 	updatedSinceLastTimer := false
+	var streamErr error
 
-	go func() {
-		StreamReply(appContext, dialogMessages, replyCh)
-	}()
+	go StreamReply(appContext, params, dialogMessages, replyCh)
 
 loop:
 	for {
 		select {
 		case delta, ok := <-replyCh:
 			if !ok {
-				if sentMsgId == 0 {
-					sendInitialMsg(appContext, chatId, completeText.String(), replyTo)
-				} else {
-					updateMsg(appContext, chatId, sentMsgId, completeText.String())
-				}
-
 				break loop
 			}
 
-			if delta == "" {
+			if delta.Err != nil {
+				streamErr = delta.Err
+				continue
+			}
+
+			if delta.Content == "" {
 				continue
 			}
 
-			completeText.WriteString(delta)
+			completeText.WriteString(delta.Content)
 			updatedSinceLastTimer = true
 
 		case <-updateTimer.C:
-			if !updatedSinceLastTimer {
+			// edits wait for a free slot instead of queueing up, so replies in busy chats or while the bot is busy
+			// are edited less often
+			if delay := getTelegramSendDelay(appContext.Config, chatId); updatedSinceLastTimer && delay > 0 {
+				updateTimer.Reset(delay)
 				continue
 			}
 
-			if sentMsgId == 0 {
-				sentMsgId = sendInitialMsg(appContext, chatId, completeText.String(), replyTo)
-			} else {
-				updateMsg(appContext, chatId, sentMsgId, completeText.String())
+			if updatedSinceLastTimer {
+				sentMsgs.sync(appContext, chatId, replyTo, completeText.String(), stopKeyboard)
+				updatedSinceLastTimer = false
 			}
 
-			updatedSinceLastTimer = false
-			updateTimer.Reset(time.Second)
+			updateTimer.Reset(streamEditInterval)
 		}
 	}
 
-	return completeText.String(), nil
+	updateTimer.Stop()
+
+	finalText := completeText.String()
+	if streamErr != nil && finalText != "" {
+		finalText += partialReplyMarker
+	}
+
+	if finalText != "" {
+		sentMsgs.sync(appContext, chatId, replyTo, finalText, keyboard)
+	}
+
+	return completeText.String(), sentMsgs.msgIds, streamErr
+}
+
+// sentReply tracks messages a reply is split into, so a growing reply can be updated in place
+type sentReply struct {
+	msgIds    []int
+	parts     []string
+	keyboards []*tgbotapi.InlineKeyboardMarkup
+}
+
+// sync makes sent messages show the text, editing changed parts and sending new ones when the text grows past
+// a single message. Keyboard is attached to the last message.
+func (r *sentReply) sync(appContext *AppContext, chatId int64, replyTo int, text string, keyboard *tgbotapi.InlineKeyboardMarkup) {
+	parts := SplitMarkdown(text, telegramMessageLimit)
+
+	for i, part := range parts {
+		var partKeyboard *tgbotapi.InlineKeyboardMarkup
+		if i == len(parts)-1 {
+			partKeyboard = keyboard
+		}
+
+		if i < len(r.msgIds) {
+			// identical edits are skipped, they count towards limits and fail anyway. A message that is no longer
+			// the last one loses its keyboard.
+			if r.parts[i] != part || r.keyboards[i] != partKeyboard {
+				editMsg(appContext, chatId, r.msgIds[i], part, partKeyboard)
+				r.parts[i] = part
+				r.keyboards[i] = partKeyboard
+			}
+
+			continue
+		}
+
+		partReplyTo := 0
+		if i == 0 {
+			partReplyTo = replyTo
+		}
+
+		msgId := sendInitialMsg(appContext, chatId, part, partReplyTo, partKeyboard)
+		if msgId == 0 {
+			return
+		}
+
+		r.msgIds = append(r.msgIds, msgId)
+		r.parts = append(r.parts, part)
+		r.keyboards = append(r.keyboards, partKeyboard)
+	}
 }
 
 func updateMsg(appContext *AppContext, chatId int64, messageId int, text string) {
-	edit := tgbotapi.NewEditMessageText(chatId, messageId, text)
+	editMsg(appContext, chatId, messageId, text, nil)
+}
+
+func deleteMessage(appContext *AppContext, chatId int64, messageId int) {
+	err := requestWithRetry(appContext, chatId, tgbotapi.NewDeleteMessage(chatId, messageId))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to delete message")
+	}
+}
+
+// editMsg replaces the message text with rendered Markdown, falling back to plain text if Telegram cannot parse it
+func editMsg(appContext *AppContext, chatId int64, messageId int, text string, keyboard *tgbotapi.InlineKeyboardMarkup) {
+	edit := tgbotapi.NewEditMessageText(chatId, messageId, RenderMarkdown(text))
+	edit.ParseMode = tgbotapi.ModeHTML
+	edit.DisableWebPagePreview = true
+	edit.ReplyMarkup = keyboard
+
+	_, err := sendWithRetry(appContext, chatId, edit)
+	if isParseError(err) {
+		log.Warn().Err(err).Msg("Failed to parse rendered reply, sending as plain text")
+
+		edit.Text = text
+		edit.ParseMode = ""
+		_, err = sendWithRetry(appContext, chatId, edit)
+	}
+
+	// the message already shows the text, e.g. when the rendered text hasn't changed
+	if isNotModifiedError(err) {
+		log.Debug().Int("message", messageId).Msg("Message is not modified")
+		return
+	}
 
-	_, err := appContext.TelegramBot.Send(edit)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to send reply")
 	}
 }
 
-func sendInitialMsg(appContext *AppContext, chatId int64, text string, replyTo int) int {
-	msg := tgbotapi.NewMessage(chatId, text)
-	msg.ParseMode = "Markdown"
+// sendInitialMsg sends rendered Markdown, falling back to plain text if Telegram cannot parse it
+func sendInitialMsg(appContext *AppContext, chatId int64, text string, replyTo int, keyboard *tgbotapi.InlineKeyboardMarkup) int {
+	msg := tgbotapi.NewMessage(chatId, RenderMarkdown(text))
+	msg.ParseMode = tgbotapi.ModeHTML
 	msg.DisableWebPagePreview = true
 
-	if appContext.Config.SendReplies {
+	if appContext.Config.SendReplies && replyTo != 0 {
 		msg.ReplyToMessageID = replyTo
 	}
 
-	sentMsg, err := appContext.TelegramBot.Send(msg)
+	if keyboard != nil {
+		msg.ReplyMarkup = *keyboard
+	}
+
+	sentMsg, err := sendWithRetry(appContext, chatId, msg)
+	if isParseError(err) {
+		log.Warn().Err(err).Msg("Failed to parse rendered reply, sending as plain text")
+
+		msg.Text = text
+		msg.ParseMode = ""
+		sentMsg, err = sendWithRetry(appContext, chatId, msg)
+	}
+
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to send reply")
 	}
@@ -435,6 +679,14 @@ func sendInitialMsg(appContext *AppContext, chatId int64, text string, replyTo i
 	return sentMsg.MessageID
 }
 
+func isParseError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "can't parse entities")
+}
+
+func isNotModifiedError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "message is not modified")
+}
+
 func sendHello(appContext *AppContext, chatId int64) {
 	helpMsg := appContext.Config.GetMessage("help", "Type anything to start a conversation")
 
@@ -442,7 +694,7 @@ func sendHello(appContext *AppContext, chatId int64) {
 	msg.ParseMode = "Markdown"
 	msg.DisableWebPagePreview = true
 
-	_, err := appContext.TelegramBot.Send(msg)
+	_, err := sendWithRetry(appContext, chatId, msg)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to send hello message")
 	}
@@ -453,14 +705,36 @@ func sendError(appContext *AppContext, message string, chatId int64) {
 	msg.ParseMode = "Markdown"
 	msg.DisableWebPagePreview = true
 
-	_, err := appContext.TelegramBot.Send(msg)
+	_, err := sendWithRetry(appContext, chatId, msg)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to send error message")
 	}
 }
 
+func sendNotice(appContext *AppContext, message string, replyTo *tgbotapi.Message) {
+	msg := tgbotapi.NewMessage(replyTo.Chat.ID, message)
+	msg.DisableWebPagePreview = true
+
+	if appContext.Config.SendReplies {
+		msg.ReplyToMessageID = replyTo.MessageID
+	}
+
+	_, err := sendWithRetry(appContext, replyTo.Chat.ID, msg)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to send notice")
+	}
+}
+
 func sendNotWantedHere(appContext *AppContext, chatId int64, userId int64, replyTo int) {
-	msgText := appContext.Config.GetMessage("not_wanted_here", "")
+	// access can be requested if there are admins to approve it
+	canRequestAccess := len(appContext.Config.Admins) > 0
+
+	defaultText := ""
+	if canRequestAccess {
+		defaultText = "⛔ You don't have access to this bot, but you can ask admins for it"
+	}
+
+	msgText := appContext.Config.GetMessage("not_wanted_here", defaultText)
 	if msgText == "" {
 		return
 	}
@@ -483,7 +757,11 @@ func sendNotWantedHere(appContext *AppContext, chatId int64, userId int64, reply
 		msg.ReplyToMessageID = replyTo
 	}
 
-	_, err = appContext.TelegramBot.Send(msg)
+	if canRequestAccess {
+		msg.ReplyMarkup = newRequestAccessKeyboard(appContext, userId)
+	}
+
+	_, err = sendWithRetry(appContext, chatId, msg)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to send not_wanted_here message")
 	}
@@ -0,0 +1,337 @@
+package src
+
+import (
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnswerMessage(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	h.sendText("Hi")
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); got != fakeReplyText {
+		t.Errorf("expected reply %q, got %q", fakeReplyText, got)
+	}
+
+	expected := []string{"user: Hi", "assistant: " + fakeReplyText}
+	if got := h.dialog(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected dialog %q, got %q", expected, got)
+	}
+}
+
+func TestNewDialog(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	h.sendText("Hi")
+	h.sendText("/new")
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); got != "❕New dialog started!" {
+		t.Errorf("expected new dialog notification, got %q", got)
+	}
+
+	if got := h.dialog(); len(got) != 0 {
+		t.Errorf("expected empty dialog, got %q", got)
+	}
+
+	h.sendText("Hello again")
+
+	if got := h.openai.lastChatRequest().Messages; len(got) != 1 || got[0].Content != "Hello again" {
+		t.Errorf("expected only the new message to be sent to the model, got %v", got)
+	}
+}
+
+func TestImagine(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	h.sendText("/imagine a cat")
+
+	if len(h.openai.imageRequests) != 1 || h.openai.imageRequests[0].Prompt != "a cat" {
+		t.Fatalf("expected an image request for %q, got %v", "a cat", h.openai.imageRequests)
+	}
+
+	if got := h.telegram.lastCallTo("sendPhoto").Params.Get("photo"); got != fakeImageURL {
+		t.Errorf("expected photo %q, got %q", fakeImageURL, got)
+	}
+}
+
+func TestImagineDisabled(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.GenerateImages = false
+	})
+
+	h.sendText("/imagine a cat")
+
+	if len(h.openai.imageRequests) != 0 {
+		t.Errorf("expected no image requests, got %d", len(h.openai.imageRequests))
+	}
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); !strings.Contains(got, "disabled") {
+		t.Errorf("expected an error message, got %q", got)
+	}
+}
+
+func TestEmptyResponses(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	h.openai.addEmptyReply()
+	h.sendText("Hi")
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); !strings.Contains(got, "model returned no reply") {
+		t.Errorf("expected an error message, got %q", got)
+	}
+
+	h.openai.noImages = true
+	h.sendText("/imagine a cat")
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); !strings.Contains(got, "no image returned") {
+		t.Errorf("expected an error message, got %q", got)
+	}
+}
+
+func TestVoiceMessage(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	h.sendVoice("voice1", []byte("fake ogg"))
+
+	if h.openai.transcriptionRequests != 1 {
+		t.Fatalf("expected a transcription request, got %d", h.openai.transcriptionRequests)
+	}
+
+	expected := []string{"user: " + h.openai.transcription, "assistant: " + fakeReplyText}
+	if got := h.dialog(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected dialog %q, got %q", expected, got)
+	}
+}
+
+func TestVoiceMessageNotAnswered(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.AnswerVoice = false
+	})
+
+	h.sendVoice("voice2", []byte("fake ogg"))
+
+	if h.openai.transcriptionRequests != 1 {
+		t.Errorf("expected a transcription request, got %d", h.openai.transcriptionRequests)
+	}
+
+	if h.openai.chatRequestCount() != 0 {
+		t.Errorf("expected no chat requests, got %d", h.openai.chatRequestCount())
+	}
+}
+
+func TestStreamingEdits(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.StreamResponse = true
+	})
+
+	h.openai.streamDelay = 700 * time.Millisecond
+	h.openai.addReply("First", " second", " third")
+
+	h.sendText("Hi")
+
+	sent := h.telegram.callsTo("sendMessage")
+	if len(sent) != 1 {
+		t.Fatalf("expected the reply to be sent once and then edited, got %d messages", len(sent))
+	}
+
+	if got := sent[0].Params.Get("text"); got == "First second third" {
+		t.Errorf("expected the reply to be sent before it is complete")
+	}
+
+	final := h.telegram.lastCallTo("editMessageText")
+	if got := final.Params.Get("text"); got != "First second third" {
+		t.Errorf("expected the final edit to show the complete reply, got %q", got)
+	}
+
+	if final.MessageID != sent[0].MessageID {
+		t.Errorf("expected the sent message to be edited")
+	}
+
+	if buttons := final.callbackButtons(t); len(buttons) == 0 {
+		t.Errorf("expected answer buttons on the final reply")
+	}
+}
+
+func TestStreamingError(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.StreamResponse = true
+		// retries are tested separately
+		config.Retry.MaxAttempts = 1
+	})
+
+	h.openai.addError(http.StatusInternalServerError, "server_error")
+
+	h.sendText("Hi")
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); !strings.HasPrefix(got, "‼ Failed to get reply") {
+		t.Errorf("expected an error message, got %q", got)
+	}
+
+	if got := h.dialog(); !reflect.DeepEqual(got, []string{"user: Hi"}) {
+		t.Errorf("expected only the user message in the dialog, got %q", got)
+	}
+}
+
+func TestStreamingContextLengthExceeded(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.StreamResponse = true
+	})
+
+	h.openai.addError(http.StatusBadRequest, "context_length_exceeded")
+	last := h.sendText("Hi")
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); !strings.Contains(got, "context is too long") {
+		t.Errorf("expected a question about the context limit, got %q", got)
+	}
+
+	state, err := h.appContext.Database.GetDialogState(GetDialogId(h.appContext, &tgbotapi.Update{Message: last}))
+	if err != nil || state != DialogStateContextLimit {
+		t.Errorf("expected the dialog to wait for the context limit resolution, got %d", state)
+	}
+}
+
+func TestContextLimitStartAnew(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	h.sendText("Hi")
+
+	h.openai.addError(http.StatusBadRequest, "context_length_exceeded")
+	h.sendText("Tell me more")
+
+	question := h.telegram.lastCallTo("sendMessage")
+	if !strings.Contains(question.Params.Get("text"), "context is too long") {
+		t.Fatalf("expected a question about the context limit, got %q", question.Params.Get("text"))
+	}
+
+	data, ok := question.callbackButtons(t)["Start anew"]
+	if !ok {
+		t.Fatalf("expected a button to start anew")
+	}
+
+	h.pressButton(data, h.sentMessage(question))
+
+	edit := h.telegram.lastCallTo("editMessageText")
+	if got := edit.Params.Get("text"); got != "❕New dialog started!" {
+		t.Errorf("expected the question to be replaced with a notification, got %q", got)
+	}
+
+	// the question that did not fit is answered in the new dialog
+	if got := h.dialog(); !reflect.DeepEqual(got, []string{"user: Tell me more", "assistant: " + fakeReplyText}) {
+		t.Errorf("expected the pending question to be answered in a new dialog, got %q", got)
+	}
+
+	// the question is resolved, pressing the button again changes nothing
+	h.sendText("Hi")
+	h.pressButton(data, h.sentMessage(question))
+
+	if got := h.dialog(); len(got) != 4 {
+		t.Errorf("expected the new dialog to be kept, got %q", got)
+	}
+}
+
+func TestMessagesAreHeldUntilContextLimitIsResolved(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	h.sendText("Hi")
+
+	h.openai.addError(http.StatusBadRequest, "context_length_exceeded")
+	h.sendText("Tell me more")
+	question := h.telegram.lastCallTo("sendMessage")
+
+	h.sendText("And more")
+	h.sendText("Even more")
+
+	if got := h.openai.chatRequestCount(); got != 2 {
+		t.Errorf("expected held messages not to be sent to the model, got %d requests", got)
+	}
+
+	for _, call := range h.telegram.callsTo("sendMessage")[2:] {
+		if got := call.Params.Get("text"); got != contextLimitPendingNotice {
+			t.Errorf("expected a notice instead of another question, got %q", got)
+		}
+	}
+
+	h.pressButton(question.callbackButtons(t)["Forget beginning"], h.sentMessage(question))
+
+	messages := h.openai.lastChatRequest().Messages
+	if got := len(messages); got != 4 || messages[1].Content != "Tell me more" || messages[3].Content != "Even more" {
+		t.Errorf("expected the held messages to be answered with the question, got %v", messages)
+	}
+
+	if got := h.dialog(); len(got) != 5 || got[4] != "assistant: "+fakeReplyText {
+		t.Errorf("expected the answer to be saved, got %q", got)
+	}
+}
+
+func TestSamplingParameters(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.Model = "gpt-4"
+		config.Temperature = 0.3
+		config.TopP = 0.9
+		config.MaxTokens = 200
+		config.PresencePenalty = 0.5
+		config.FrequencyPenalty = 0.25
+	})
+
+	h.sendText("Hi")
+
+	req := h.openai.lastChatRequest()
+	if req.Model != "gpt-4" || req.Temperature != 0.3 || req.TopP != 0.9 || req.MaxTokens != 200 ||
+		req.PresencePenalty != 0.5 || req.FrequencyPenalty != 0.25 {
+		t.Errorf("expected parameters from config, got %+v", req)
+	}
+}
+
+func TestModelCommand(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.Models = []string{"gpt-3.5-turbo", "gpt-4"}
+	})
+
+	h.sendText("/model")
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); got != "❕Current model: gpt-3.5-turbo\nAvailable models: gpt-3.5-turbo, gpt-4" {
+		t.Errorf("expected the current and available models, got %q", got)
+	}
+
+	h.sendText("/model gpt-4")
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); got != "❕Model changed to gpt-4" {
+		t.Errorf("expected the model to be changed, got %q", got)
+	}
+
+	h.sendText("Hi")
+
+	if got := h.openai.lastChatRequest().Model; got != "gpt-4" {
+		t.Errorf("expected the selected model to be used, got %q", got)
+	}
+
+	h.sendText("/model default")
+	h.sendText("Hi")
+
+	if got := h.openai.lastChatRequest().Model; got != "gpt-3.5-turbo" {
+		t.Errorf("expected the default model to be used again, got %q", got)
+	}
+}
+
+func TestModelCommandRejectsUnknownModel(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.Models = []string{"gpt-3.5-turbo"}
+	})
+
+	h.sendText("/model gpt-4")
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); got != "‼ Model is not allowed: gpt-4" {
+		t.Errorf("expected an error message, got %q", got)
+	}
+
+	h.sendText("Hi")
+
+	if got := h.openai.lastChatRequest().Model; got != "gpt-3.5-turbo" {
+		t.Errorf("expected the model not to be changed, got %q", got)
+	}
+}
@@ -0,0 +1,249 @@
+package src
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"sync"
+)
+
+const callbackActionPersona = "p"
+const callbackActionContextLimit = "c"
+
+// callbackHandler performs an action for a pressed inline button. If it returns a non-empty text, the message with
+// the button is replaced with this text and the keyboard is removed.
+type callbackHandler func(appContext *AppContext, query *tgbotapi.CallbackQuery, dialogId string, arg string) (string, error)
+
+var callbackHandlers = map[string]callbackHandler{
+	callbackActionPersona:       handlePersonaCallback,
+	callbackActionContextLimit:  handleContextLimitCallback,
+	callbackActionRegenerate:    handleRegenerateCallback,
+	callbackActionContinue:      handleContinueCallback,
+	callbackActionSwitchDialog:  handleSwitchDialogCallback,
+	callbackActionRenameDialog:  handleRenameDialogCallback,
+	callbackActionDeleteDialog:  handleDeleteDialogCallback,
+	callbackActionRequestAccess: handleRequestAccessCallback,
+	callbackActionApproveAccess: handleApproveAccessCallback,
+	callbackActionRejectAccess:  handleRejectAccessCallback,
+	callbackActionStop:          handleStopCallback,
+}
+
+// Telegram limits callback data to 64 bytes
+const callbackDataLimit = 64
+
+// the signature is truncated to fit into callback data
+const callbackSignatureLength = 8
+
+// dialog ids of named dialogs, threads and forks are too long for callback data, so buttons refer to dialogs by a
+// handle of this many bytes of the dialog id hash
+const callbackHandleLength = 9
+
+const callbackDataSeparator = "|"
+
+var (
+	callbackHandles = struct {
+		sync.Mutex
+		m map[string]string
+	}{m: make(map[string]string)}
+)
+
+// NewCallbackData builds a payload for an inline button. The payload is bound to the dialog and signed, so it cannot
+// be forged to act on another dialog. It panics if the payload does not fit into callback data, which can only be
+// caused by a too long argument.
+func NewCallbackData(appContext *AppContext, action string, dialogId string, arg string) string {
+	payload := strings.Join([]string{action, getCallbackHandle(appContext, dialogId), arg}, callbackDataSeparator)
+	data := payload + callbackDataSeparator + signCallbackPayload(appContext, payload)
+	if len(data) > callbackDataLimit {
+		panic(fmt.Sprintf("callback data %q is longer than %d bytes", data, callbackDataLimit))
+	}
+
+	return data
+}
+
+// getCallbackHandle returns a short handle of the dialog and stores the dialog it refers to
+func getCallbackHandle(appContext *AppContext, dialogId string) string {
+	if dialogId == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(dialogId))
+	handle := base64.RawURLEncoding.EncodeToString(sum[:callbackHandleLength])
+
+	callbackHandles.Lock()
+	defer callbackHandles.Unlock()
+
+	if _, ok := callbackHandles.m[handle]; ok {
+		return handle
+	}
+
+	if err := appContext.Database.SetCallbackDialog(handle, dialogId); err != nil {
+		log.Error().Err(err).Str("dialog", dialogId).Msg("Failed to store callback dialog")
+		return handle
+	}
+
+	callbackHandles.m[handle] = dialogId
+	return handle
+}
+
+// resolveCallbackHandle returns the dialog a handle refers to. Handles are kept in the database, since buttons outlive
+// restarts.
+func resolveCallbackHandle(appContext *AppContext, handle string) (string, error) {
+	if handle == "" {
+		return "", nil
+	}
+
+	callbackHandles.Lock()
+	defer callbackHandles.Unlock()
+
+	if dialogId, ok := callbackHandles.m[handle]; ok {
+		return dialogId, nil
+	}
+
+	dialogId, err := appContext.Database.GetCallbackDialog(handle)
+	if err != nil {
+		return "", fmt.Errorf("failed to get callback dialog: %s", err)
+	}
+
+	if dialogId == "" {
+		return "", fmt.Errorf("unknown dialog handle %s", handle)
+	}
+
+	callbackHandles.m[handle] = dialogId
+	return dialogId, nil
+}
+
+func parseCallbackData(appContext *AppContext, data string) (action string, dialogId string, arg string, err error) {
+	sepIndex := strings.LastIndex(data, callbackDataSeparator)
+	if sepIndex < 0 {
+		return "", "", "", fmt.Errorf("malformed callback data")
+	}
+
+	payload, signature := data[:sepIndex], data[sepIndex+1:]
+	if !hmac.Equal([]byte(signature), []byte(signCallbackPayload(appContext, payload))) {
+		return "", "", "", fmt.Errorf("invalid callback signature")
+	}
+
+	parts := strings.SplitN(payload, callbackDataSeparator, 3)
+	if len(parts) != 3 {
+		return "", "", "", fmt.Errorf("malformed callback data")
+	}
+
+	dialogId, err = resolveCallbackHandle(appContext, parts[1])
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return parts[0], dialogId, parts[2], nil
+}
+
+func signCallbackPayload(appContext *AppContext, payload string) string {
+	mac := hmac.New(sha256.New, getCallbackSecret(appContext.Config))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:callbackSignatureLength])
+}
+
+func getCallbackSecret(config *Config) []byte {
+	if config.CallbackSecret != "" {
+		return []byte(config.CallbackSecret)
+	}
+
+	// bot token is a secret anyway, so it is safe to derive a key from it
+	key := sha256.Sum256([]byte("callback:" + config.TelegramToken))
+	return key[:]
+}
+
+// canUseDialog checks if a user pressing a button has access to the dialog the button belongs to.
+// Dialogs tracked per user can only be controlled by their owners, chat and thread dialogs are shared by all chat
+// members.
+func canUseDialog(query *tgbotapi.CallbackQuery, dialogId string) bool {
+	dialogId = getDialogKeyOf(dialogId)
+
+	if ownerId, ok := strings.CutPrefix(dialogId, "user:"); ok {
+		return ownerId == fmt.Sprintf("%d", query.From.ID)
+	}
+
+	if chatId, ok := strings.CutPrefix(dialogId, "chat:"); ok {
+		return chatId == fmt.Sprintf("%d", query.Message.Chat.ID)
+	}
+
+	if thread, ok := strings.CutPrefix(dialogId, "thread:"); ok {
+		return strings.HasPrefix(thread, fmt.Sprintf("%d:", query.Message.Chat.ID))
+	}
+
+	return true
+}
+
+func handleCallbackQuery(appContext *AppContext, update tgbotapi.Update) {
+	query := update.CallbackQuery
+	userName := GetFormattedUserName(query.From.UserName, query.From.ID)
+
+	action, dialogId, arg, err := parseCallbackData(appContext, query.Data)
+	if err != nil {
+		log.Error().Err(err).Str("user", userName).Msg("Failed to parse callback data")
+		answerCallbackQuery(appContext, query, "This button is no longer valid")
+		return
+	}
+
+	// access is requested by users who don't have it
+	if action != callbackActionRequestAccess && !CheckUserAccess(appContext, &update) {
+		log.Error().Str("user", userName).Msg("Unauthorized user tried to use inline keyboard")
+		answerCallbackQuery(appContext, query, "")
+		return
+	}
+
+	handler, ok := callbackHandlers[action]
+	if !ok {
+		log.Error().Str("action", action).Msg("Unknown callback action")
+		answerCallbackQuery(appContext, query, "")
+		return
+	}
+
+	if !canUseDialog(query, dialogId) {
+		answerCallbackQuery(appContext, query, "This button is not for you")
+		return
+	}
+
+	if text := checkLimits(appContext, getCallbackRequest(action, arg), query.From, query.Message.Chat); text != "" {
+		answerCallbackQuery(appContext, query, text)
+		return
+	}
+
+	runHandler := func() {
+		text, err := handler(appContext, query, dialogId, arg)
+		if err != nil {
+			log.Error().Err(err).Str("action", action).Msg("Failed to handle callback")
+			sendError(appContext, fmt.Sprintf("Failed to handle button: %s", err), query.Message.Chat.ID)
+			return
+		}
+
+		if text != "" {
+			updateMsg(appContext, query.Message.Chat.ID, query.Message.MessageID, text)
+		}
+	}
+
+	// answer early, so the button does not keep spinning while the action waits or takes time
+	if IsDialogBusy(dialogId) && action != callbackActionStop {
+		answerCallbackQuery(appContext, query, "⏳ Queued, it will be done after the current reply")
+	} else {
+		answerCallbackQuery(appContext, query, "")
+	}
+
+	// the queue is busy with the reply to stop
+	if action == callbackActionStop {
+		runHandler()
+		return
+	}
+
+	enqueueAction(appContext, dialogId, runHandler)
+}
+
+func answerCallbackQuery(appContext *AppContext, query *tgbotapi.CallbackQuery, text string) {
+	err := requestWithRetry(appContext, query.Message.Chat.ID, tgbotapi.NewCallback(query.ID, text))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to answer callback query")
+	}
+}
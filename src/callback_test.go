@@ -0,0 +1,126 @@
+package src
+
+import (
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"strings"
+	"testing"
+)
+
+func TestCallbackDataRoundTrip(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	// the longest dialog ids are forks of named thread dialogs
+	dialogIds := []string{
+		"",
+		"user:42",
+		"thread:-1001234567890:2147483647#1697620000000",
+		"thread:-1001234567890:2147483647#1697620000000/2147483647",
+		"chat:-1001234567890#1697620000000/2147483647",
+	}
+
+	for _, dialogId := range dialogIds {
+		data := NewCallbackData(h.appContext, callbackActionApproveAccess, dialogId, "9223372036854775807")
+		if len(data) > callbackDataLimit {
+			t.Errorf("expected callback data of %q to fit into 64 bytes, got %d", dialogId, len(data))
+		}
+
+		action, parsedDialogId, arg, err := parseCallbackData(h.appContext, data)
+		if err != nil {
+			t.Fatalf("failed to parse callback data of %q: %s", dialogId, err)
+		}
+
+		if action != callbackActionApproveAccess || parsedDialogId != dialogId || arg != "9223372036854775807" {
+			t.Errorf("expected the payload of %q back, got %q %q %q", dialogId, action, parsedDialogId, arg)
+		}
+	}
+}
+
+func TestCallbackHandleIsStored(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	dialogId := "chat:-1001234567890#1697620000000/2147483647"
+	data := NewCallbackData(h.appContext, callbackActionPersona, dialogId, "1")
+
+	// buttons are pressed after restarts
+	callbackHandles.Lock()
+	callbackHandles.m = make(map[string]string)
+	callbackHandles.Unlock()
+
+	if _, parsedDialogId, _, err := parseCallbackData(h.appContext, data); err != nil || parsedDialogId != dialogId {
+		t.Errorf("expected dialog %q to be resolved, got %q, %v", dialogId, parsedDialogId, err)
+	}
+}
+
+func TestTooLongCallbackData(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected too long callback data to be refused")
+		}
+	}()
+
+	NewCallbackData(h.appContext, callbackActionPersona, "user:42", strings.Repeat("1", callbackDataLimit))
+}
+
+func TestCallbackDataRejectsTampering(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	data := NewCallbackData(h.appContext, callbackActionPersona, "user:42", "1")
+	signature := data[strings.LastIndex(data, callbackDataSeparator)+1:]
+
+	other := &AppContext{Config: &Config{TelegramToken: h.appContext.Config.TelegramToken, CallbackSecret: "another secret"}}
+
+	tests := map[string]string{
+		"another dialog":   strings.Replace(data, getCallbackHandle(h.appContext, "user:42"), getCallbackHandle(h.appContext, "user:43"), 1),
+		"another argument": strings.Replace(data, "|1|", "|0|", 1),
+		"truncated":        data[:len(data)-2],
+		"no signature":     strings.TrimSuffix(data, callbackDataSeparator+signature),
+		"signature only":   signature,
+		"empty":            "",
+		"another secret":   NewCallbackData(other, callbackActionPersona, "user:42", "1"),
+	}
+
+	for name, tampered := range tests {
+		if _, _, _, err := parseCallbackData(h.appContext, tampered); err == nil {
+			t.Errorf("expected %s to be rejected", name)
+		}
+	}
+}
+
+func TestTamperedButtonIsNotHandled(t *testing.T) {
+	h := newTestHarness(t, withPersonas)
+
+	h.sendText("/persona")
+	keyboard := h.telegram.lastCallTo("sendMessage")
+
+	tampered := strings.Replace(keyboard.callbackButtons(t)["coder"], "|1|", "|0|", 1)
+	h.pressButton(tampered, h.sentMessage(keyboard))
+
+	if got := h.telegram.lastCallTo("answerCallbackQuery").Params.Get("text"); got != "This button is no longer valid" {
+		t.Errorf("expected the button to be rejected, got %q", got)
+	}
+
+	if persona := GetDialogPersona(h.appContext, "user:42"); persona != nil {
+		t.Errorf("expected the persona not to change, got %s", persona.Name)
+	}
+}
+
+func TestButtonOfAnotherUser(t *testing.T) {
+	h := newTestHarness(t, withPersonas)
+
+	h.sendText("/persona")
+	keyboard := h.telegram.lastCallTo("sendMessage")
+
+	// a chat member presses the button under a message for another user
+	h.user = &tgbotapi.User{ID: 43, UserName: "another_user"}
+	h.pressButton(keyboard.callbackButtons(t)["coder"], h.sentMessage(keyboard))
+
+	if got := h.telegram.lastCallTo("answerCallbackQuery").Params.Get("text"); got != "This button is not for you" {
+		t.Errorf("expected the button to be rejected, got %q", got)
+	}
+
+	if persona := GetDialogPersona(h.appContext, "user:42"); persona != nil {
+		t.Errorf("expected the persona not to change, got %s", persona.Name)
+	}
+}
@@ -2,31 +2,194 @@ package src
 
 import (
 	"encoding/json"
+	"fmt"
+	"github.com/sashabaranov/go-openai"
 	"os"
+	"strings"
 )
 
 const DialogContextTrackingModeNone = "none"
 const DialogContextTrackingModeUser = "user"
 const DialogContextTrackingModeChat = "chat"
+const DialogContextTrackingModeThread = "thread"
+
+const GroupTriggerAlways = "always"
+const GroupTriggerMention = "mention"
+const GroupTriggerReply = "reply"
+const GroupTriggerPrefix = "prefix"
+
+const AccessRuleChat = "chat"
+const AccessRuleChatType = "chat_type"
+const AccessRuleMember = "member"
+
+const ContextPolicyAsk = "ask"
+const ContextPolicySlidingWindow = "sliding_window"
+const ContextPolicySummarize = "summarize"
 
 type Config struct {
 	TelegramToken string `json:"telegram_token"`
 	OpenAIApiKey  string `json:"openai_api_key"`
 
+	// endpoints of a self-hosted Bot API server, in `tgbotapi.APIEndpoint` and `tgbotapi.FileEndpoint` format
+	TelegramApiEndpoint  string `json:"telegram_api_endpoint"`
+	TelegramFileEndpoint string `json:"telegram_file_endpoint"`
+
+	// updates are received with a webhook if its public URL is set, with long polling otherwise
+	Webhook WebhookConfig `json:"webhook"`
+
+	// seconds to wait for running requests on shutdown before they are aborted, 20 by default
+	ShutdownTimeout int `json:"shutdown_timeout"`
+
+	// address of the HTTP server with /metrics, /healthz and /readyz, e.g. `:9090`, it is not started if empty
+	MetricsListenAddress string `json:"metrics_listen_address"`
+
+	// seconds an OpenAI request may take, or a streamed reply may wait for its next part, 120 by default
+	OpenAITimeout int `json:"openai_timeout"`
+	// seconds a Telegram request may take, long polling excluded, 15 by default
+	TelegramTimeout int `json:"telegram_timeout"`
+	// requests failed because of rate limits, server or network errors are retried
+	Retry RetryConfig `json:"retry"`
+	// outbound messages are spaced out to stay within these limits
+	TelegramLimits TelegramLimits `json:"telegram_limits"`
+
+	OpenAIBaseURL    string            `json:"openai_base_url"`
+	OpenAIOrgID      string            `json:"openai_org_id"`
+	OpenAIApiType    string            `json:"openai_api_type"`
+	AzureApiVersion  string            `json:"azure_api_version"`
+	AzureDeployments map[string]string `json:"azure_deployments"`
+
+	// empty list means everyone can use the bot, unless access is restricted or there are rules allowing access
 	Users []string `json:"users"`
+	// only users, admins and users allowed by rules or by admins can use the bot, even if the users list is empty.
+	// Needed to restrict access with admins alone, allow rules restrict it anyway.
+	RestrictAccess bool `json:"restrict_access"`
+	// admins are given by user id, as they are messaged about access requests. They always have access and
+	// can allow and deny users with commands.
+	Admins []int64 `json:"admins"`
+	// rules checked in addition to users, deny rules take priority over everything except admins
+	AccessRules []AccessRule `json:"access_rules"`
+
+	// limits apply to every user and to every group chat as a whole, zero means unlimited
+	UserLimits  Limits `json:"user_limits"`
+	GroupLimits Limits `json:"group_limits"`
+	// LimitOverrides replace limits of particular users, keyed by user name or id, and group chats, keyed by chat id
+	LimitOverrides map[string]Limits `json:"limit_overrides"`
+
+	CallbackSecret string `json:"callback_secret"`
 
 	DialogContextTrackingMode string `json:"dialog_context_tracking_mode"`
 	StreamResponse            bool   `json:"stream_response"`
 	SendReplies               bool   `json:"send_replies"`
 
+	// messages sent while the bot is answering are merged into one user turn, the queue waits this many
+	// milliseconds after the last message before processing, so a burst of messages is not split
+	QueueDebounceMillis int `json:"queue_debounce_millis"`
+
+	// messages in group chats are answered only if they match one of the triggers, empty list means always
+	GroupTriggers      []string `json:"group_triggers"`
+	GroupTriggerPrefix string   `json:"group_trigger_prefix"`
+	// messages that are not answered are saved to the dialog, in thread mode only replies to a thread are saved
+	GroupStoreContext bool `json:"group_store_context"`
+
 	DecodeVoice bool `json:"decode_voice"`
 	AnswerVoice bool `json:"answer_voice"`
 
 	GenerateImages bool `json:"generate_images"`
 
+	Model            string   `json:"model"`
+	Models           []string `json:"models"`
+	Temperature      float32  `json:"temperature"`
+	TopP             float32  `json:"top_p"`
+	MaxTokens        int      `json:"max_tokens"`
+	PresencePenalty  float32  `json:"presence_penalty"`
+	FrequencyPenalty float32  `json:"frequency_penalty"`
+
+	// model used to generate dialog titles, the dialog model is used if empty
+	TitleModel string `json:"title_model"`
+
+	ContextPolicy string `json:"context_policy"`
+	// context sizes in tokens, keyed by a model name or its prefix, the longest matching key is used. They take
+	// priority over sizes known for OpenAI models.
+	ContextLimits map[string]int `json:"context_limits"`
+
+	// prices in USD, keyed by a model name or its prefix, the longest matching key is used
+	Prices map[string]ModelPrice `json:"prices"`
+
+	Personas       []Persona `json:"personas"`
+	DefaultPersona string    `json:"default_persona"`
+
 	Messages map[string]string `json:"messages"`
 }
 
+// WebhookConfig sets up the HTTP server receiving updates from Telegram. If the secret token is empty, it is derived
+// from the bot token. TLS is optional, as the server is usually run behind a proxy terminating it.
+type WebhookConfig struct {
+	ListenAddress string `json:"listen_address"`
+	PublicURL     string `json:"public_url"`
+	SecretToken   string `json:"secret_token"`
+	TLSCertFile   string `json:"tls_cert_file"`
+	TLSKeyFile    string `json:"tls_key_file"`
+	// the certificate is uploaded to Telegram if it is self-signed
+	UploadCertificate bool `json:"upload_certificate"`
+}
+
+// RetryConfig sets up exponential backoff of failed requests. Delays requested by servers with rate limit headers
+// or `retry_after` take priority. Zero values mean defaults.
+type RetryConfig struct {
+	// attempts including the first one, 3 by default
+	MaxAttempts int `json:"max_attempts"`
+	// delay before the first retry, doubled for every next one, 500 by default
+	InitialDelayMillis int `json:"initial_delay_millis"`
+	// backoff delays are capped, 20000 by default
+	MaxDelayMillis int `json:"max_delay_millis"`
+	// the user is shown a status if a delay is at least this long, 3000 by default
+	NoticeDelayMillis int `json:"notice_delay_millis"`
+	// retries are only made if they start within this time since the first attempt, so timed out requests don't
+	// keep the user waiting for several timeouts, 60000 by default
+	MaxTotalMillis int `json:"max_total_millis"`
+}
+
+// TelegramLimits are rates of sent and edited messages, Telegram limits by default: 30 messages per second
+// overall, 1 per second in a chat and 20 per minute in a group. The overall limit is higher for bots with paid broadcasts.
+type TelegramLimits struct {
+	MessagesPerSecond      float64 `json:"messages_per_second"`
+	ChatMessagesPerSecond  float64 `json:"chat_messages_per_second"`
+	GroupMessagesPerMinute float64 `json:"group_messages_per_minute"`
+}
+
+// Persona is a named preset that can be applied to a dialog with /persona command.
+// Empty model and missing temperature mean that values from config are used.
+type Persona struct {
+	Name         string   `json:"name"`
+	SystemPrompt string   `json:"system_prompt"`
+	Model        string   `json:"model"`
+	Temperature  *float32 `json:"temperature"`
+}
+
+// AccessRule allows or denies access in chats, in chats of types, or to members of chats
+type AccessRule struct {
+	Type      string   `json:"type"`
+	Deny      bool     `json:"deny"`
+	ChatIds   []int64  `json:"chat_ids"`
+	ChatTypes []string `json:"chat_types"`
+}
+
+// Limits restrict how much users and group chats can use the bot. Daily limits reset at 00:00 UTC.
+type Limits struct {
+	MessagesPerMinute  int64   `json:"messages_per_minute"`
+	TokensPerDay       int64   `json:"tokens_per_day"`
+	ImagesPerDay       int64   `json:"images_per_day"`
+	VoiceMinutesPerDay float64 `json:"voice_minutes_per_day"`
+}
+
+// ModelPrice is used to estimate the cost of usage shown with /usage command
+type ModelPrice struct {
+	PromptPer1K     float64 `json:"prompt_per_1k"`
+	CompletionPer1K float64 `json:"completion_per_1k"`
+	PerImage        float64 `json:"per_image"`
+	PerAudioMinute  float64 `json:"per_audio_minute"`
+}
+
 func NewConfig(path string) (*Config, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -50,3 +213,116 @@ func (config *Config) GetMessage(name string, def string) string {
 
 	return def
 }
+
+func (config *Config) GetModel() string {
+	if config.Model != "" {
+		return config.Model
+	}
+
+	return openai.GPT3Dot5Turbo
+}
+
+// IsModelAllowed checks if a model can be selected for a dialog with /model command.
+// If `models` list is empty, any model is allowed.
+func (config *Config) IsModelAllowed(model string) bool {
+	if len(config.Models) == 0 {
+		return true
+	}
+
+	for _, allowedModel := range config.Models {
+		if allowedModel == model {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsModelConfigured checks if the model is named in config: the default, selectable, title or persona model
+func (config *Config) IsModelConfigured(model string) bool {
+	if model == config.GetModel() || model == config.TitleModel {
+		return true
+	}
+
+	for _, configuredModel := range config.Models {
+		if configuredModel == model {
+			return true
+		}
+	}
+
+	for _, persona := range config.Personas {
+		if persona.Model == model {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasGroupTrigger checks if messages in group chats are answered on the trigger
+func (config *Config) HasGroupTrigger(trigger string) bool {
+	for _, groupTrigger := range config.GroupTriggers {
+		if groupTrigger == trigger {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (config *Config) GetPersona(name string) *Persona {
+	for i := range config.Personas {
+		if config.Personas[i].Name == name {
+			return &config.Personas[i]
+		}
+	}
+
+	return nil
+}
+
+// GetModelPrice returns the price of the model, `false` if the price is not configured
+func (config *Config) GetModelPrice(model string) (ModelPrice, bool) {
+	var price ModelPrice
+	matchLength := -1
+
+	for prefix, prefixPrice := range config.Prices {
+		if strings.HasPrefix(model, prefix) && len(prefix) > matchLength {
+			price = prefixPrice
+			matchLength = len(prefix)
+		}
+	}
+
+	return price, matchLength >= 0
+}
+
+// GetUserLimits returns limits of the user, overridden ones if configured
+func (config *Config) GetUserLimits(userId int64, userName string) Limits {
+	if limits, ok := config.LimitOverrides[fmt.Sprintf("%d", userId)]; ok {
+		return limits
+	}
+
+	if limits, ok := config.LimitOverrides[userName]; ok && userName != "" {
+		return limits
+	}
+
+	return config.UserLimits
+}
+
+// GetGroupLimits returns limits of the group chat, overridden ones if configured
+func (config *Config) GetGroupLimits(chatId int64) Limits {
+	if limits, ok := config.LimitOverrides[fmt.Sprintf("%d", chatId)]; ok {
+		return limits
+	}
+
+	return config.GroupLimits
+}
+
+func (config *Config) IsAdmin(userId int64) bool {
+	for _, adminId := range config.Admins {
+		if adminId == userId {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,256 @@
+package src
+
+import (
+	"fmt"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"github.com/sashabaranov/go-openai"
+	"openai-telegram-bot/src/protos"
+)
+
+// getContextBudget returns how many tokens the prompt can take, leaving space for the reply
+func getContextBudget(appContext *AppContext, params ChatParams) int {
+	limit := GetModelContextLimit(appContext.Config, params.Model)
+
+	if params.MaxTokens > 0 && params.MaxTokens < limit {
+		return limit - params.MaxTokens
+	}
+
+	return limit - limit/8
+}
+
+// fitDialogContext makes sure the dialog fits into the model context before sending it, applying the configured
+// policy if it does not. Returns messages to send (without a system prompt) and `false` if nothing should be sent.
+func fitDialogContext(appContext *AppContext, dialogId string, params ChatParams, dialogMessages []*protos.DialogMessage, msg *tgbotapi.Message) ([]*protos.DialogMessage, bool) {
+	budget := getContextBudget(appContext, params)
+
+	tokens := EstimateTokens(withSystemPrompt(params, dialogMessages), params.Model)
+	if tokens <= budget {
+		return dialogMessages, true
+	}
+
+	log.Info().Str("dialog", dialogId).Int("tokens", tokens).Int("budget", budget).Msg("Dialog does not fit into context")
+
+	switch appContext.Config.ContextPolicy {
+	case ContextPolicySlidingWindow:
+		return slideDialogWindow(appContext, params, dialogMessages, budget, msg.Chat.ID)
+
+	case ContextPolicySummarize:
+		summarized, err := summarizeDialogHead(appContext, dialogId, params, dialogMessages)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to summarize dialog, falling back to sliding window")
+			summarized = dialogMessages
+		}
+
+		return slideDialogWindow(appContext, params, summarized, budget, msg.Chat.ID)
+
+	default:
+		askContextLimitResolution(appContext, dialogId, msg, len(dialogMessages))
+		return nil, false
+	}
+}
+
+// slideDialogWindow drops the oldest messages until the rest fits into the budget. Stored dialog is not changed.
+func slideDialogWindow(appContext *AppContext, params ChatParams, dialogMessages []*protos.DialogMessage, budget int, chatId int64) ([]*protos.DialogMessage, bool) {
+	// messages are counted once, and dropped ones are subtracted from the total
+	tokens := EstimateTokens(withSystemPrompt(params, nil), params.Model)
+	messageTokens := make([]int, len(dialogMessages))
+	for i, dialogMessage := range dialogMessages {
+		messageTokens[i] = estimateMessageTokens(dialogMessage, params.Model)
+		tokens += messageTokens[i]
+	}
+
+	start := 0
+	for start < len(dialogMessages)-1 && tokens > budget {
+		tokens -= messageTokens[start]
+		start++
+	}
+
+	if tokens > budget {
+		sendError(appContext, "Message is too long for the model context", chatId)
+		return nil, false
+	}
+
+	return dialogMessages[start:], true
+}
+
+// summarizeDialogHead replaces all dialog messages except the last one with their summary
+func summarizeDialogHead(appContext *AppContext, dialogId string, params ChatParams, dialogMessages []*protos.DialogMessage) ([]*protos.DialogMessage, error) {
+	if len(dialogMessages) < 3 {
+		return nil, fmt.Errorf("dialog is too short to summarize")
+	}
+
+	head := dialogMessages[:len(dialogMessages)-1]
+	last := dialogMessages[len(dialogMessages)-1]
+
+	summary, err := summarizeDialog(appContext, params, head)
+	if err != nil {
+		return nil, err
+	}
+
+	// the last message is kept as is, so replies to its Telegram messages still resolve to it
+	err = appContext.Database.ReplaceDialog(dialogId, &protos.DialogMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: summary,
+	}, last)
+	if err != nil {
+		return nil, err
+	}
+
+	return appContext.Database.GetDialog(dialogId)
+}
+
+const contextLimitStartAnew = "anew"
+const contextLimitForgetBeginning = "forget"
+const contextLimitSummarize = "summarize"
+
+const contextLimitPendingNotice = "❕Please choose how to continue the dialog first, the message will be answered after that"
+
+// isContextLimitPending checks if the user has been asked how to continue the dialog and has not chosen yet
+func isContextLimitPending(appContext *AppContext, dialogId string) bool {
+	dialogState, err := appContext.Database.GetDialogState(dialogId)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get dialog state")
+		return false
+	}
+
+	return dialogState == DialogStateContextLimit
+}
+
+// askContextLimitResolution asks the user how to continue a dialog that does not fit into the model context
+func askContextLimitResolution(appContext *AppContext, dialogId string, replyTo *tgbotapi.Message, messageCount int) {
+	// the question is asked once, and the choice answers all messages held since
+	if isContextLimitPending(appContext, dialogId) {
+		sendNotice(appContext, contextLimitPendingNotice, replyTo)
+		return
+	}
+
+	err := appContext.Database.SetDialogState(dialogId, DialogStateContextLimit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to set dialog state")
+	}
+
+	msg := tgbotapi.NewMessage(replyTo.Chat.ID, fmt.Sprintf("‼ Dialog context is too long (%d messages total). Please choose how to continue:", messageCount))
+	msg.DisableWebPagePreview = true
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Start anew", NewCallbackData(appContext, callbackActionContextLimit, dialogId, contextLimitStartAnew)),
+			tgbotapi.NewInlineKeyboardButtonData("Forget beginning", NewCallbackData(appContext, callbackActionContextLimit, dialogId, contextLimitForgetBeginning)),
+			tgbotapi.NewInlineKeyboardButtonData("Summarize history", NewCallbackData(appContext, callbackActionContextLimit, dialogId, contextLimitSummarize)),
+		),
+	)
+
+	if appContext.Config.SendReplies {
+		msg.ReplyToMessageID = replyTo.MessageID
+	}
+
+	_, err = sendWithRetry(appContext, replyTo.Chat.ID, msg)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to send reply")
+	}
+}
+
+// splitPendingQuestion splits the dialog into the history and the user messages after the last answer, which are
+// still to be answered
+func splitPendingQuestion(dialogMessages []*protos.DialogMessage) ([]*protos.DialogMessage, []*protos.DialogMessage) {
+	start := len(dialogMessages)
+	for start > 0 && dialogMessages[start-1].Role == openai.ChatMessageRoleUser {
+		start--
+	}
+
+	return dialogMessages[:start], dialogMessages[start:]
+}
+
+// getPendingQuestionReplyTo returns the message an answer to the pending question should reply to: the last message
+// of the question if it is known
+func getPendingQuestionReplyTo(query *tgbotapi.CallbackQuery, pending []*protos.DialogMessage) *tgbotapi.Message {
+	messageIds := pending[len(pending)-1].TelegramMessageIds
+	if len(messageIds) == 0 {
+		return query.Message
+	}
+
+	return &tgbotapi.Message{MessageID: int(messageIds[len(messageIds)-1]), From: query.From, Chat: query.Message.Chat}
+}
+
+// handleContextLimitCallback shortens the dialog as the user chose, keeping the pending question, and answers it
+func handleContextLimitCallback(appContext *AppContext, query *tgbotapi.CallbackQuery, dialogId string, choice string) (string, error) {
+	if !isContextLimitPending(appContext, dialogId) {
+		return "❕This dialog has already been resolved", nil
+	}
+
+	dialogMessages, err := appContext.Database.GetDialog(dialogId)
+	if err != nil {
+		return "", fmt.Errorf("failed to get dialog messages: %s", err)
+	}
+
+	history, pending := splitPendingQuestion(dialogMessages)
+
+	var result string
+
+	switch choice {
+	case contextLimitStartAnew:
+		err := appContext.Database.ReplaceDialog(dialogId, pending...)
+		if err != nil {
+			return "", fmt.Errorf("failed to delete dialog: %s", err)
+		}
+
+		result = "❕New dialog started!"
+
+	case contextLimitForgetBeginning:
+		// the pending question alone can be too long, then it is shortened as well
+		if len(history) == 0 {
+			history, pending = pending, nil
+		}
+
+		err := appContext.Database.ReplaceDialog(dialogId, append(history[len(history)/2:], pending...)...)
+		if err != nil {
+			return "", fmt.Errorf("failed to decimate dialog: %s", err)
+		}
+
+		result = "❕Beginning of the dialog forgotten"
+
+	case contextLimitSummarize:
+		endTyping := StartTypingStatus(appContext, query.Message.Chat.ID)
+		defer func() { endTyping <- true }()
+
+		if len(history) == 0 {
+			history, pending = pending, nil
+		}
+
+		params := GetChatParams(appContext, dialogId)
+		params.Owner = NewUsageOwner(query.From, query.Message.Chat)
+
+		summary, err := summarizeDialog(appContext, params, history)
+		if err != nil {
+			return "", fmt.Errorf("failed to summarize dialog: %s", err)
+		}
+
+		err = appContext.Database.ReplaceDialog(dialogId, append([]*protos.DialogMessage{{
+			Role:    openai.ChatMessageRoleUser,
+			Content: summary,
+		}}, pending...)...)
+		if err != nil {
+			return "", fmt.Errorf("failed to replace dialog: %s", err)
+		}
+
+		result = "❕Dialog history summarized"
+
+	default:
+		return "", fmt.Errorf("unknown dialog state reply: %s", choice)
+	}
+
+	err = appContext.Database.SetDialogState(dialogId, DialogStateNone)
+	if err != nil {
+		return "", fmt.Errorf("failed to delete dialog state: %s", err)
+	}
+
+	if len(pending) == 0 {
+		return result, nil
+	}
+
+	// the choice is shown before the answer, which takes time
+	updateMsg(appContext, query.Message.Chat.ID, query.Message.MessageID, result)
+	answerDialog(appContext, NewUsageOwner(query.From, query.Message.Chat), dialogId, getPendingQuestionReplyTo(query, pending))
+
+	return "", nil
+}
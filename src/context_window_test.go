@@ -0,0 +1,89 @@
+package src
+
+import (
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/sashabaranov/go-openai"
+	"openai-telegram-bot/src/protos"
+	"strings"
+	"testing"
+)
+
+func TestSummarizePolicyKeepsLastMessage(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.ContextPolicy = ContextPolicySummarize
+		config.ContextLimits = map[string]int{"gpt-3.5-turbo": 100}
+	})
+
+	h.sendText(strings.Repeat("one ", 40))
+	last := h.sendText(strings.Repeat("two ", 40))
+
+	// the answer, two requests to summarize and the answer after summarization
+	if got := h.openai.chatRequestCount(); got != 4 {
+		t.Fatalf("expected the dialog to be summarized, got %d requests", got)
+	}
+
+	dialogMessages, err := h.appContext.Database.GetDialog(GetDialogId(h.appContext, &tgbotapi.Update{Message: last}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dialogMessages) != 3 || !strings.HasPrefix(dialogMessages[0].Content, "This is a summary") {
+		t.Fatalf("expected the summary, the last message and the answer, got %v", dialogMessages)
+	}
+
+	if ids := dialogMessages[1].TelegramMessageIds; len(ids) != 1 || ids[0] != int64(last.MessageID) {
+		t.Errorf("expected the last message to keep its Telegram message, got %v", ids)
+	}
+}
+
+func TestContinueAppliesContextPolicy(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.ContextPolicy = ContextPolicySlidingWindow
+		config.ContextLimits = map[string]int{"gpt-3.5-turbo": 100}
+	})
+
+	longAnswer := strings.Repeat("word ", 60)
+
+	h.openai.addReply(longAnswer)
+	h.sendText("Hi")
+
+	h.openai.addReply(longAnswer)
+	h.sendText("Tell me more")
+
+	answer := h.telegram.lastCallTo("sendMessage")
+	h.pressButton(answer.callbackButtons(t)["⏩ Continue"], h.sentMessage(answer))
+
+	messages := h.openai.lastChatRequest().Messages
+	if len(messages) != 3 || messages[0].Content != "Tell me more" || messages[2].Content != continuePrompt {
+		t.Errorf("expected the beginning of the dialog to be dropped, got %v", messages)
+	}
+}
+
+func TestSlideDialogWindowFitsBudget(t *testing.T) {
+	h := newTestHarness(t, nil)
+	params := ChatParams{Model: "gpt-3.5-turbo", SystemPrompt: "You are a helpful assistant"}
+
+	var dialogMessages []*protos.DialogMessage
+	for i := 1; i <= 20; i++ {
+		dialogMessages = append(dialogMessages, &protos.DialogMessage{Role: openai.ChatMessageRoleUser, Content: strings.Repeat("word ", i)})
+	}
+
+	for _, budget := range []int{50, 100, 200, 1000} {
+		window, ok := slideDialogWindow(h.appContext, params, dialogMessages, budget, testChatId)
+		if !ok {
+			t.Fatalf("expected a window to fit into %d tokens", budget)
+		}
+
+		if tokens := EstimateTokens(withSystemPrompt(params, window), params.Model); tokens > budget {
+			t.Errorf("expected the window to fit into %d tokens, got %d", budget, tokens)
+		}
+
+		// the window is the longest ending of the dialog that fits
+		if len(window) < len(dialogMessages) {
+			longer := dialogMessages[len(dialogMessages)-len(window)-1:]
+			if tokens := EstimateTokens(withSystemPrompt(params, longer), params.Model); tokens <= budget {
+				t.Errorf("expected %d messages to fit into %d tokens, got %d", len(longer), budget, len(window))
+			}
+		}
+	}
+}
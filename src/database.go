@@ -3,10 +3,13 @@ package src
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"github.com/nutsdb/nutsdb"
 	"github.com/nutsdb/nutsdb/ds/list"
 	"google.golang.org/protobuf/proto"
+	"math"
 	"openai-telegram-bot/src/protos"
+	"strings"
 	"time"
 )
 
@@ -32,10 +35,17 @@ func (d *Database) Close() error {
 	return d.db.Close()
 }
 
-func (d *Database) AddDialogMessage(dialogId string, msg protos.DialogMessage) error {
+// Ping checks that the database is open and transactions can be started
+func (d *Database) Ping() error {
+	return d.db.View(func(tx *nutsdb.Tx) error {
+		return nil
+	})
+}
+
+func (d *Database) AddDialogMessage(dialogId string, msg *protos.DialogMessage) error {
 	return d.db.Update(
 		func(tx *nutsdb.Tx) error {
-			marshalled, err := proto.Marshal(&msg)
+			marshalled, err := proto.Marshal(msg)
 			if err != nil {
 				return err
 			}
@@ -45,13 +55,15 @@ func (d *Database) AddDialogMessage(dialogId string, msg protos.DialogMessage) e
 	)
 }
 
-func (d *Database) GetDialog(dialogId string) ([]protos.DialogMessage, error) {
-	var messages []protos.DialogMessage
+func (d *Database) GetDialog(dialogId string) ([]*protos.DialogMessage, error) {
+	var messages []*protos.DialogMessage
 
 	err := d.db.View(
 		func(tx *nutsdb.Tx) error {
 			entries, err := tx.LRange("messages", []byte(dialogId), 0, -1)
-			if err != nil {
+			if isNotFound(err) {
+				return nil
+			} else if err != nil {
 				return err
 			}
 
@@ -62,7 +74,7 @@ func (d *Database) GetDialog(dialogId string) ([]protos.DialogMessage, error) {
 					return err
 				}
 
-				messages = append(messages, *msg)
+				messages = append(messages, msg)
 			}
 
 			return nil
@@ -76,20 +88,50 @@ func (d *Database) GetDialog(dialogId string) ([]protos.DialogMessage, error) {
 }
 
 func (d *Database) ClearDialog(dialogId string) error {
+	return d.db.Update(
+		func(tx *nutsdb.Tx) error {
+			return clearDialog(tx, []byte(dialogId))
+		},
+	)
+}
+
+func clearDialog(tx *nutsdb.Tx, key []byte) error {
+	// looks like we cannot just remove a list with `Delete`, and we can't clear an entire list with `LTrim`
+	// without one item left in it, so we have to do this instead
+	err := tx.LTrim("messages", key, 0, 0)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+
+	_, err = tx.LPop("messages", key)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// ReplaceDialog replaces all messages of the dialog with new ones
+func (d *Database) ReplaceDialog(dialogId string, msgs ...*protos.DialogMessage) error {
 	return d.db.Update(
 		func(tx *nutsdb.Tx) error {
 			key := []byte(dialogId)
 
-			// looks like we cannot just remove a list with `Delete`, and we can't clear an entire list with `LTrim`
-			// without one item left in it, so we have to do this instead
-			err := tx.LTrim("messages", key, 0, 0)
-			if err != nil && !(nutsdb.IsBucketNotFound(err) || errors.Is(err, nutsdb.ErrBucket) || errors.Is(err, list.ErrListNotFound)) {
+			err := clearDialog(tx, key)
+			if err != nil {
 				return err
 			}
 
-			_, err = tx.LPop("messages", key)
-			if err != nil && !(nutsdb.IsBucketNotFound(err) || errors.Is(err, nutsdb.ErrBucket) || errors.Is(err, list.ErrListNotFound)) {
-				return err
+			for _, msg := range msgs {
+				marshalled, err := proto.Marshal(msg)
+				if err != nil {
+					return err
+				}
+
+				err = tx.RPush("messages", key, marshalled)
+				if err != nil {
+					return err
+				}
 			}
 
 			return nil
@@ -97,20 +139,43 @@ func (d *Database) ClearDialog(dialogId string) error {
 	)
 }
 
-func (d *Database) DecimateDialog(dialogId string) error {
-	// delete first half of the messages
+// ReplaceDialogTail removes `count` last messages of the dialog and appends new messages in their place
+func (d *Database) ReplaceDialogTail(dialogId string, count int, msgs ...*protos.DialogMessage) error {
 	return d.db.Update(
 		func(tx *nutsdb.Tx) error {
 			key := []byte(dialogId)
 
-			entryCount, err := tx.LSize("messages", key)
-			if err != nil {
-				return err
+			if count > 0 {
+				size, err := tx.LSize("messages", key)
+				if err != nil && !isNotFound(err) {
+					return err
+				}
+
+				if count > size {
+					return fmt.Errorf("cannot remove %d messages from a dialog of %d", count, size)
+				}
+
+				indexes := make([]int, 0, count)
+				for i := size - count; i < size; i++ {
+					indexes = append(indexes, i)
+				}
+
+				_, err = tx.LRemByIndex("messages", key, indexes...)
+				if err != nil {
+					return err
+				}
 			}
 
-			err = tx.LTrim("messages", key, entryCount/2, -1)
-			if err != nil {
-				return err
+			for _, msg := range msgs {
+				marshalled, err := proto.Marshal(msg)
+				if err != nil {
+					return err
+				}
+
+				err = tx.RPush("messages", key, marshalled)
+				if err != nil {
+					return err
+				}
 			}
 
 			return nil
@@ -118,27 +183,43 @@ func (d *Database) DecimateDialog(dialogId string) error {
 	)
 }
 
-func (d *Database) ReplaceDialog(dialogId string, msg *protos.DialogMessage) error {
+// ForkDialog copies `count` first messages of the dialog, and its model and persona, into a new dialog
+func (d *Database) ForkDialog(dialogId string, forkId string, count int) error {
+	// `LRange` returns the whole list for the end of -1
+	if count < 1 {
+		return fmt.Errorf("failed to fork dialog: at least one message must be copied, got %d", count)
+	}
+
 	return d.db.Update(
 		func(tx *nutsdb.Tx) error {
-			key := []byte(dialogId)
-
-			err := tx.LTrim("messages", key, 0, -1)
+			entries, err := tx.LRange("messages", []byte(dialogId), 0, count-1)
 			if err != nil {
 				return err
 			}
 
-			marshalled, err := proto.Marshal(msg)
-			if err != nil {
-				return err
+			for _, entry := range entries {
+				err = tx.RPush("messages", []byte(forkId), entry)
+				if err != nil {
+					return err
+				}
 			}
 
-			err = tx.RPush("messages", key, marshalled)
-			if err != nil {
-				return err
+			for _, bucket := range []string{"dialog_model", "dialog_persona"} {
+				entry, err := tx.Get(bucket, []byte(dialogId))
+				if isNotFound(err) {
+					continue
+				} else if err != nil {
+					return err
+				}
+
+				err = tx.Put(bucket, []byte(forkId), entry.Value, 0)
+				if err != nil {
+					return err
+				}
 			}
 
-			return nil
+			// forks are deleted with the dialog
+			return tx.SAdd("dialog_forks", []byte(dialogId), []byte(forkId))
 		},
 	)
 }
@@ -225,7 +306,7 @@ func (d *Database) GetDialogState(dialogId string) (int64, error) {
 	err := d.db.View(
 		func(tx *nutsdb.Tx) error {
 			entry, err := tx.Get("dialog_state", []byte(dialogId))
-			if nutsdb.IsBucketNotFound(err) || err.Error() == "key not found in the bucket" {
+			if isNotFound(err) {
 				return nil
 			}
 
@@ -245,6 +326,157 @@ func (d *Database) GetDialogState(dialogId string) (int64, error) {
 	return state, nil
 }
 
+func (d *Database) SetDialogModel(dialogId string, model string) error {
+	return d.db.Update(
+		func(tx *nutsdb.Tx) error {
+			if model == "" {
+				err := tx.Delete("dialog_model", []byte(dialogId))
+				if isNotFound(err) {
+					return nil
+				}
+
+				return err
+			}
+
+			return tx.Put("dialog_model", []byte(dialogId), []byte(model), 0)
+		},
+	)
+}
+
+// GetDialogModel returns a model selected for the dialog with /model command, or an empty string if the dialog
+// uses the default model
+func (d *Database) GetDialogModel(dialogId string) (string, error) {
+	var model string
+
+	err := d.db.View(
+		func(tx *nutsdb.Tx) error {
+			entry, err := tx.Get("dialog_model", []byte(dialogId))
+			if isNotFound(err) {
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			model = string(entry.Value)
+
+			return nil
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return model, nil
+}
+
+func (d *Database) SetDialogPersona(dialogId string, persona string) error {
+	return d.db.Update(
+		func(tx *nutsdb.Tx) error {
+			err := tx.Put("dialog_persona", []byte(dialogId), []byte(persona), 0)
+			if err != nil {
+				return err
+			}
+
+			// persona can specify its own model, so a model selected earlier should not shadow it
+			err = tx.Delete("dialog_model", []byte(dialogId))
+			if isNotFound(err) {
+				return nil
+			}
+
+			return err
+		},
+	)
+}
+
+// GetDialogPersona returns a name of the persona applied to the dialog.
+// Empty name means that persona was explicitly disabled, `false` is returned if nothing was selected for the dialog.
+func (d *Database) GetDialogPersona(dialogId string) (string, bool, error) {
+	var persona string
+	var found bool
+
+	err := d.db.View(
+		func(tx *nutsdb.Tx) error {
+			entry, err := tx.Get("dialog_persona", []byte(dialogId))
+			if isNotFound(err) {
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			persona = string(entry.Value)
+			found = true
+
+			return nil
+		},
+	)
+	if err != nil {
+		return "", false, err
+	}
+
+	return persona, found, nil
+}
+
+// SetDialogLastAnswer remembers a message with the last answer in the dialog, returning the previous one
+func (d *Database) SetDialogLastAnswer(dialogId string, messageId int) (int, error) {
+	var prevMessageId int
+
+	err := d.db.Update(
+		func(tx *nutsdb.Tx) error {
+			entry, err := tx.Get("dialog_last_answer", []byte(dialogId))
+			if err != nil && !isNotFound(err) {
+				return err
+			}
+
+			if err == nil {
+				prevMessageId = int(bytesToInt(entry.Value))
+			}
+
+			return tx.Put("dialog_last_answer", []byte(dialogId), intToBytes(int64(messageId)), uint32((time.Hour * 24 * 7).Seconds()))
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return prevMessageId, nil
+}
+
+func (d *Database) GetDialogLastAnswer(dialogId string) (int, error) {
+	var messageId int
+
+	err := d.db.View(
+		func(tx *nutsdb.Tx) error {
+			entry, err := tx.Get("dialog_last_answer", []byte(dialogId))
+			if isNotFound(err) {
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			messageId = int(bytesToInt(entry.Value))
+
+			return nil
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return messageId, nil
+}
+
+func isNotFound(err error) bool {
+	return err != nil && (nutsdb.IsBucketNotFound(err) || nutsdb.IsKeyNotFound(err) || nutsdb.IsBucketEmpty(err) ||
+		errors.Is(err, nutsdb.ErrNotFoundKey) || errors.Is(err, nutsdb.ErrBucket) || errors.Is(err, list.ErrListNotFound) ||
+		errors.Is(err, nutsdb.ErrPrefixScan))
+}
+
 func intToBytes(i int64) []byte {
 	b := make([]byte, 8)
 	binary.BigEndian.PutUint64(b, uint64(i))
@@ -254,3 +486,559 @@ func intToBytes(i int64) []byte {
 func bytesToInt(b []byte) int64 {
 	return int64(binary.BigEndian.Uint64(b))
 }
+
+// SetMessageDialog remembers the dialog the messages belong to, so replies to them continue the dialog
+func (d *Database) SetMessageDialog(chatId int64, messageIds []int, dialogId string) error {
+	return d.db.Update(
+		func(tx *nutsdb.Tx) error {
+			for _, messageId := range messageIds {
+				key := messageDialogKey(chatId, messageId)
+
+				err := tx.Put("message_dialog", key, []byte(dialogId), 0)
+				if err != nil {
+					return err
+				}
+
+				// messages of the dialog are forgotten with it
+				err = tx.SAdd("dialog_messages", []byte(dialogId), key)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	)
+}
+
+// GetMessageDialog returns the dialog the message belongs to, or an empty string if the message is unknown
+func (d *Database) GetMessageDialog(chatId int64, messageId int) (string, error) {
+	var dialogId string
+
+	err := d.db.View(
+		func(tx *nutsdb.Tx) error {
+			entry, err := tx.Get("message_dialog", messageDialogKey(chatId, messageId))
+			if isNotFound(err) {
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			dialogId = string(entry.Value)
+
+			return nil
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return dialogId, nil
+}
+
+func messageDialogKey(chatId int64, messageId int) []byte {
+	return []byte(fmt.Sprintf("%d:%d", chatId, messageId))
+}
+
+// SetActiveDialog makes the dialog used for new messages with the dialog key
+func (d *Database) SetActiveDialog(dialogKey string, dialogId string) error {
+	return d.db.Update(
+		func(tx *nutsdb.Tx) error {
+			return tx.Put("active_dialog", []byte(dialogKey), []byte(dialogId), 0)
+		},
+	)
+}
+
+// GetActiveDialog returns the dialog used for new messages with the dialog key, or an empty string if the key
+// itself is used as a dialog id
+func (d *Database) GetActiveDialog(dialogKey string) (string, error) {
+	var dialogId string
+
+	err := d.db.View(
+		func(tx *nutsdb.Tx) error {
+			entry, err := tx.Get("active_dialog", []byte(dialogKey))
+			if isNotFound(err) {
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			dialogId = string(entry.Value)
+
+			return nil
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return dialogId, nil
+}
+
+// SetCallbackDialog stores the dialog a short handle of inline buttons refers to
+func (d *Database) SetCallbackDialog(handle string, dialogId string) error {
+	return d.db.Update(
+		func(tx *nutsdb.Tx) error {
+			return tx.Put("callback_dialog", []byte(handle), []byte(dialogId), 0)
+		},
+	)
+}
+
+// GetCallbackDialog returns the dialog of a short handle of inline buttons, or an empty string if it is unknown
+func (d *Database) GetCallbackDialog(handle string) (string, error) {
+	var dialogId string
+
+	err := d.db.View(
+		func(tx *nutsdb.Tx) error {
+			entry, err := tx.Get("callback_dialog", []byte(handle))
+			if isNotFound(err) {
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			dialogId = string(entry.Value)
+			return nil
+		},
+	)
+
+	return dialogId, err
+}
+
+type DialogTitle struct {
+	DialogId string
+	Title    string
+}
+
+func (d *Database) SetDialogTitle(dialogId string, title string) error {
+	return d.db.Update(
+		func(tx *nutsdb.Tx) error {
+			return tx.Put("dialog_title", []byte(dialogId), []byte(title), 0)
+		},
+	)
+}
+
+// GetDialogTitle returns the title of the dialog, or an empty string if the dialog has not been titled yet
+func (d *Database) GetDialogTitle(dialogId string) (string, error) {
+	var title string
+
+	err := d.db.View(
+		func(tx *nutsdb.Tx) error {
+			entry, err := tx.Get("dialog_title", []byte(dialogId))
+			if isNotFound(err) {
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			title = string(entry.Value)
+
+			return nil
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return title, nil
+}
+
+// GetDialogTitles returns titled dialogs of the dialog key, oldest first
+func (d *Database) GetDialogTitles(dialogKey string) ([]DialogTitle, error) {
+	var titles []DialogTitle
+
+	err := d.db.View(
+		func(tx *nutsdb.Tx) error {
+			// the first dialog has the same id as the key
+			entry, err := tx.Get("dialog_title", []byte(dialogKey))
+			if err != nil && !isNotFound(err) {
+				return err
+			}
+
+			if err == nil {
+				titles = append(titles, DialogTitle{DialogId: dialogKey, Title: string(entry.Value)})
+			}
+
+			entries, _, err := tx.PrefixScan("dialog_title", []byte(dialogKey+dialogIdSeparator), 0, math.MaxInt32)
+			if err != nil && !isNotFound(err) {
+				return err
+			}
+
+			for _, entry := range entries {
+				titles = append(titles, DialogTitle{DialogId: string(entry.Key), Title: string(entry.Value)})
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return titles, nil
+}
+
+// DeleteDialog removes messages of the dialog, its forks and everything stored about them
+func (d *Database) DeleteDialog(dialogId string) error {
+	return d.db.Update(
+		func(tx *nutsdb.Tx) error {
+			// forks of every deleted dialog by its id
+			dialogForks := map[string][][]byte{}
+			err := collectDialogForks(tx, dialogId, dialogForks)
+			if err != nil {
+				return err
+			}
+
+			for id, forkIds := range dialogForks {
+				key := []byte(id)
+
+				err = clearDialog(tx, key)
+				if err != nil {
+					return err
+				}
+
+				for _, bucket := range []string{"dialog_title", "dialog_model", "dialog_persona", "dialog_state", "dialog_last_answer"} {
+					err = tx.Delete(bucket, key)
+					if err != nil && !isNotFound(err) {
+						return err
+					}
+				}
+
+				if len(forkIds) > 0 {
+					err = tx.SRem("dialog_forks", key, forkIds...)
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+			return deleteMessageDialogs(tx, dialogForks)
+		},
+	)
+}
+
+// collectDialogForks adds the dialog and its forks, including forks of forks, to the map of forks by dialog id
+func collectDialogForks(tx *nutsdb.Tx, dialogId string, dialogForks map[string][][]byte) error {
+	if _, ok := dialogForks[dialogId]; ok {
+		return nil
+	}
+
+	// members of a set that does not exist are an error without a type, so the set is checked first
+	hasForks, err := tx.SHasKey("dialog_forks", []byte(dialogId))
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+
+	var forkIds [][]byte
+	if hasForks {
+		forkIds, err = tx.SMembers("dialog_forks", []byte(dialogId))
+		if err != nil {
+			return err
+		}
+	}
+
+	dialogForks[dialogId] = forkIds
+
+	for _, forkId := range forkIds {
+		err = collectDialogForks(tx, string(forkId), dialogForks)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteMessageDialogs forgets the dialog of messages that belong to the dialogs, so replies to them do not continue
+// deleted dialogs
+func deleteMessageDialogs(tx *nutsdb.Tx, dialogForks map[string][][]byte) error {
+	for dialogId := range dialogForks {
+		key := []byte(dialogId)
+
+		// members of a set that does not exist are an error without a type, so the set is checked first
+		hasMessages, err := tx.SHasKey("dialog_messages", key)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+
+		if !hasMessages {
+			continue
+		}
+
+		messageKeys, err := tx.SMembers("dialog_messages", key)
+		if err != nil {
+			return err
+		}
+
+		for _, messageKey := range messageKeys {
+			// the message may have been moved to another dialog since
+			entry, err := tx.Get("message_dialog", messageKey)
+			if isNotFound(err) || (err == nil && string(entry.Value) != dialogId) {
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			err = tx.Delete("message_dialog", messageKey)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = tx.SRem("dialog_messages", key, messageKeys...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetPendingDialogRename makes the next message with the dialog key a new title for the dialog.
+// Empty dialog id cancels the rename.
+func (d *Database) SetPendingDialogRename(dialogKey string, dialogId string) error {
+	return d.db.Update(
+		func(tx *nutsdb.Tx) error {
+			if dialogId == "" {
+				err := tx.Delete("dialog_rename", []byte(dialogKey))
+				if isNotFound(err) {
+					return nil
+				}
+
+				return err
+			}
+
+			return tx.Put("dialog_rename", []byte(dialogKey), []byte(dialogId), uint32((time.Minute * 10).Seconds()))
+		},
+	)
+}
+
+func (d *Database) GetPendingDialogRename(dialogKey string) (string, error) {
+	var dialogId string
+
+	err := d.db.View(
+		func(tx *nutsdb.Tx) error {
+			entry, err := tx.Get("dialog_rename", []byte(dialogKey))
+			if isNotFound(err) {
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			dialogId = string(entry.Value)
+
+			return nil
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return dialogId, nil
+}
+
+// AddUsage adds the usage of the model to counters of every scope in every period
+func (d *Database) AddUsage(scopes []string, periods []string, model string, usage *protos.Usage) error {
+	return d.db.Update(
+		func(tx *nutsdb.Tx) error {
+			for _, scope := range scopes {
+				for _, period := range periods {
+					key := []byte(scope + usageKeySeparator + period + usageKeySeparator + model)
+
+					total := &protos.Usage{}
+
+					entry, err := tx.Get("usage", key)
+					if err != nil && !isNotFound(err) {
+						return err
+					}
+
+					if err == nil {
+						err = proto.Unmarshal(entry.Value, total)
+						if err != nil {
+							return err
+						}
+					}
+
+					total.Requests += usage.Requests
+					total.PromptTokens += usage.PromptTokens
+					total.CompletionTokens += usage.CompletionTokens
+					total.Images += usage.Images
+					total.AudioSeconds += usage.AudioSeconds
+
+					marshalled, err := proto.Marshal(total)
+					if err != nil {
+						return err
+					}
+
+					err = tx.Put("usage", key, marshalled, 0)
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+			return nil
+		},
+	)
+}
+
+// GetUsage returns usage counters of the scope in the period by model
+func (d *Database) GetUsage(scope string, period string) (map[string]*protos.Usage, error) {
+	usage := map[string]*protos.Usage{}
+	prefix := scope + usageKeySeparator + period + usageKeySeparator
+
+	err := d.db.View(
+		func(tx *nutsdb.Tx) error {
+			entries, _, err := tx.PrefixScan("usage", []byte(prefix), 0, math.MaxInt32)
+			if isNotFound(err) {
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			for _, entry := range entries {
+				modelUsage := &protos.Usage{}
+				err = proto.Unmarshal(entry.Value, modelUsage)
+				if err != nil {
+					return err
+				}
+
+				usage[strings.TrimPrefix(string(entry.Key), prefix)] = modelUsage
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+// AddRequestCount counts a request for every scope in the window, unless one of the scopes has reached its limit.
+// Zero limits are not checked. Returns the scope that has reached its limit, or an empty string if counted.
+func (d *Database) AddRequestCount(scopes []string, limits []int64, window string, ttl time.Duration) (string, error) {
+	exceededScope := ""
+
+	err := d.db.Update(
+		func(tx *nutsdb.Tx) error {
+			counts := make([]int64, len(scopes))
+
+			for i, scope := range scopes {
+				entry, err := tx.Get("request_count", []byte(scope+usageKeySeparator+window))
+				if isNotFound(err) {
+					continue
+				}
+
+				if err != nil {
+					return err
+				}
+
+				counts[i] = bytesToInt(entry.Value)
+
+				if limits[i] > 0 && counts[i] >= limits[i] {
+					exceededScope = scope
+					return nil
+				}
+			}
+
+			for i, scope := range scopes {
+				err := tx.Put("request_count", []byte(scope+usageKeySeparator+window), intToBytes(counts[i]+1), uint32(ttl.Seconds()))
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	)
+
+	return exceededScope, err
+}
+
+// SetUserAccess saves access of the user, zero TTL means forever
+func (d *Database) SetUserAccess(access *protos.UserAccess, ttl time.Duration) error {
+	marshalled, err := proto.Marshal(access)
+	if err != nil {
+		return err
+	}
+
+	return d.db.Update(
+		func(tx *nutsdb.Tx) error {
+			return tx.Put("user_access", intToBytes(access.UserId), marshalled, uint32(ttl.Seconds()))
+		},
+	)
+}
+
+// GetUserAccess returns access of the user, `nil` if it has not been given or requested
+func (d *Database) GetUserAccess(userId int64) (*protos.UserAccess, error) {
+	var access *protos.UserAccess
+
+	err := d.db.View(
+		func(tx *nutsdb.Tx) error {
+			entry, err := tx.Get("user_access", intToBytes(userId))
+			if isNotFound(err) {
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			access = &protos.UserAccess{}
+			return proto.Unmarshal(entry.Value, access)
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return access, nil
+}
+
+func (d *Database) GetAllUserAccess() ([]*protos.UserAccess, error) {
+	var accesses []*protos.UserAccess
+
+	err := d.db.View(
+		func(tx *nutsdb.Tx) error {
+			entries, err := tx.GetAll("user_access")
+			if isNotFound(err) {
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			for _, entry := range entries {
+				access := &protos.UserAccess{}
+				err = proto.Unmarshal(entry.Value, access)
+				if err != nil {
+					return err
+				}
+
+				accesses = append(accesses, access)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return accesses, nil
+}
@@ -3,9 +3,31 @@ package src
 import (
 	"fmt"
 	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
 )
 
+// GetDialogId returns the dialog the update belongs to: the active dialog of its dialog key
 func GetDialogId(appContext *AppContext, update *tgbotapi.Update) string {
+	dialogKey := GetDialogKey(appContext, update)
+
+	if !supportsNamedDialogs(appContext.Config) {
+		return dialogKey
+	}
+
+	dialogId, err := appContext.Database.GetActiveDialog(dialogKey)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get active dialog")
+	}
+
+	if dialogId == "" {
+		return dialogKey
+	}
+
+	return dialogId
+}
+
+// GetDialogKey returns the key dialogs are tracked by according to the dialog context tracking mode
+func GetDialogKey(appContext *AppContext, update *tgbotapi.Update) string {
 	mode := appContext.Config.DialogContextTrackingMode
 	if mode == DialogContextTrackingModeNone {
 		return fmt.Sprintf("msg:%d", update.Message.MessageID)
@@ -13,7 +35,44 @@ func GetDialogId(appContext *AppContext, update *tgbotapi.Update) string {
 		return fmt.Sprintf("chat:%d", update.Message.Chat.ID)
 	} else if mode == DialogContextTrackingModeUser {
 		return fmt.Sprintf("user:%d", update.Message.From.ID)
+	} else if mode == DialogContextTrackingModeThread {
+		return getThreadDialogId(appContext, update.Message)
 	} else {
 		return fmt.Sprintf("chat:%d", update.Message.Chat.ID)
 	}
 }
+
+// getThreadDialogId returns the dialog of the message the user replies to, or starts a new dialog
+func getThreadDialogId(appContext *AppContext, msg *tgbotapi.Message) string {
+	if msg.ReplyToMessage != nil {
+		dialogId, err := appContext.Database.GetMessageDialog(msg.Chat.ID, msg.ReplyToMessage.MessageID)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to get dialog of replied message")
+		}
+
+		if dialogId != "" {
+			return dialogId
+		}
+	}
+
+	return newThreadDialogId(msg)
+}
+
+// newThreadDialogId returns the dialog started by the message
+func newThreadDialogId(msg *tgbotapi.Message) string {
+	return fmt.Sprintf("thread:%d:%d", msg.Chat.ID, msg.MessageID)
+}
+
+// trackDialogMessages remembers the dialog of the messages, so replies to them continue the dialog. This is only
+// needed for dialogs that are found by replies: threads and forks.
+func trackDialogMessages(appContext *AppContext, dialogId string, chatId int64, messageIds ...int) {
+	isThread := appContext.Config.DialogContextTrackingMode == DialogContextTrackingModeThread
+	if (!isThread && !isForkDialog(dialogId)) || len(messageIds) == 0 {
+		return
+	}
+
+	err := appContext.Database.SetMessageDialog(chatId, messageIds, dialogId)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to save message dialog")
+	}
+}
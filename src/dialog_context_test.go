@@ -0,0 +1,27 @@
+package src
+
+import (
+	"testing"
+)
+
+func TestThreadDialogs(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.DialogContextTrackingMode = DialogContextTrackingModeThread
+	})
+
+	h.sendText("First question")
+	firstAnswer := h.sentMessage(h.telegram.lastCallTo("sendMessage"))
+
+	h.sendText("Unrelated question")
+
+	if got := h.openai.lastChatRequest().Messages; len(got) != 1 {
+		t.Errorf("expected a fresh message to start a new dialog, got %v", got)
+	}
+
+	h.sendReply("Follow-up", firstAnswer)
+
+	got := h.openai.lastChatRequest().Messages
+	if len(got) != 3 || got[0].Content != "First question" || got[2].Content != "Follow-up" {
+		t.Errorf("expected a reply to continue the first dialog, got %v", got)
+	}
+}
@@ -0,0 +1,215 @@
+package src
+
+import (
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+// queuedUpdate is a message or a button action waiting for its turn in the dialog
+type queuedUpdate struct {
+	msg       *tgbotapi.Message
+	dialogKey string
+	// action is run for button presses
+	action func()
+	// notice tells the user the message is queued, it is deleted once the message is processed
+	notice *tgbotapi.Message
+	done   chan struct{}
+}
+
+// dialogQueue serializes processing of a dialog. The first update arriving at an idle dialog processes the queue
+// until it is empty, so no worker goroutines are left behind.
+type dialogQueue struct {
+	updates      []*queuedUpdate
+	lastQueuedAt time.Time
+	processing   bool
+}
+
+var (
+	dialogQueues = struct {
+		sync.Mutex
+		m map[string]*dialogQueue
+	}{m: make(map[string]*dialogQueue)}
+)
+
+// IsDialogBusy checks if updates of the dialog are being processed
+func IsDialogBusy(dialogId string) bool {
+	dialogQueues.Lock()
+	defer dialogQueues.Unlock()
+
+	queue, ok := dialogQueues.m[dialogId]
+	return ok && queue.processing
+}
+
+// enqueueMessage processes the message in its turn and returns once it is processed. Messages sent while the dialog
+// is busy are merged into one user turn.
+func enqueueMessage(appContext *AppContext, dialogKey string, dialogId string, msg *tgbotapi.Message) {
+	update := &queuedUpdate{msg: msg, dialogKey: dialogKey, done: make(chan struct{})}
+
+	// the notice may be deleted right away if the dialog gets free in the meantime, it's fine
+	if IsDialogBusy(dialogId) {
+		update.notice = sendQueuedNotice(appContext, msg)
+	}
+
+	enqueue(appContext, dialogId, update)
+}
+
+// enqueueAction runs the action in its turn and returns once it is done
+func enqueueAction(appContext *AppContext, dialogId string, action func()) {
+	enqueue(appContext, dialogId, &queuedUpdate{action: action, done: make(chan struct{})})
+}
+
+func enqueue(appContext *AppContext, dialogId string, update *queuedUpdate) {
+	dialogQueues.Lock()
+
+	queue, ok := dialogQueues.m[dialogId]
+	if !ok {
+		queue = &dialogQueue{}
+		dialogQueues.m[dialogId] = queue
+	}
+
+	queue.updates = insertQueuedUpdate(queue.updates, update)
+	queue.lastQueuedAt = time.Now()
+
+	isWorker := !queue.processing
+	queue.processing = true
+
+	if !isWorker {
+		dialogBusyUpdates.inc()
+	}
+
+	dialogQueues.Unlock()
+
+	if isWorker {
+		processDialogQueue(appContext, dialogId, queue)
+	}
+
+	<-update.done
+}
+
+// insertQueuedUpdate puts the update in its turn. Button actions are run before queued messages, as they act on the
+// answers the user sees. Updates are handled concurrently, so messages may arrive out of order, they are ordered by
+// ids within their chat, as ids in different chats are not related.
+func insertQueuedUpdate(updates []*queuedUpdate, update *queuedUpdate) []*queuedUpdate {
+	index := len(updates)
+	for i, queued := range updates {
+		if queued.msg == nil {
+			continue
+		}
+
+		if update.msg == nil || (queued.msg.Chat.ID == update.msg.Chat.ID && queued.msg.MessageID > update.msg.MessageID) {
+			index = i
+			break
+		}
+	}
+
+	updates = append(updates, nil)
+	copy(updates[index+1:], updates[index:])
+	updates[index] = update
+
+	return updates
+}
+
+func processDialogQueue(appContext *AppContext, dialogId string, queue *dialogQueue) {
+	for {
+		batch := takeQueuedBatch(appContext, dialogId, queue)
+		if len(batch) == 0 {
+			return
+		}
+
+		processQueuedBatch(appContext, dialogId, batch)
+
+		for _, update := range batch {
+			close(update.done)
+		}
+	}
+}
+
+// takeQueuedBatch waits for the debounce window to pass since the last queued update, and takes the next action or
+// the next messages that can be merged. Returns nothing and removes the queue if it is empty.
+func takeQueuedBatch(appContext *AppContext, dialogId string, queue *dialogQueue) []*queuedUpdate {
+	debounce := time.Duration(appContext.Config.QueueDebounceMillis) * time.Millisecond
+
+	for {
+		dialogQueues.Lock()
+
+		if len(queue.updates) == 0 {
+			delete(dialogQueues.m, dialogId)
+			dialogQueues.Unlock()
+			return nil
+		}
+
+		if wait := debounce - time.Since(queue.lastQueuedAt); wait > 0 {
+			dialogQueues.Unlock()
+			time.Sleep(wait)
+			continue
+		}
+
+		// messages of a dialog tracked per user come from different chats, and are answered in their own chats
+		count := 1
+		if first := queue.updates[0].msg; isMergeableMessage(first) {
+			for count < len(queue.updates) && isMergeableMessage(queue.updates[count].msg) &&
+				queue.updates[count].msg.Chat.ID == first.Chat.ID {
+				count++
+			}
+		}
+
+		batch := queue.updates[:count:count]
+		queue.updates = queue.updates[count:]
+
+		dialogQueues.Unlock()
+
+		return batch
+	}
+}
+
+// isMergeableMessage checks if the message is a plain message that can be merged with others into one user turn
+func isMergeableMessage(msg *tgbotapi.Message) bool {
+	return msg != nil && !msg.IsCommand() && msg.Document == nil
+}
+
+func processQueuedBatch(appContext *AppContext, dialogId string, batch []*queuedUpdate) {
+	msgs := make([]*tgbotapi.Message, 0, len(batch))
+	for _, update := range batch {
+		if update.notice != nil {
+			deleteMessage(appContext, update.notice.Chat.ID, update.notice.MessageID)
+		}
+
+		if update.msg != nil {
+			msgs = append(msgs, update.msg)
+		}
+	}
+
+	if batch[0].action != nil {
+		batch[0].action()
+		return
+	}
+
+	if len(msgs) > 1 {
+		log.Debug().Str("dialog", dialogId).Int("count", len(msgs)).Msg("Merged queued messages")
+	}
+
+	if isMergeableMessage(msgs[0]) {
+		if text := countQueuedMessages(appContext, msgs); text != "" {
+			sendNotice(appContext, text, msgs[len(msgs)-1])
+			return
+		}
+	}
+
+	processMessages(appContext, batch[0].dialogKey, dialogId, msgs)
+}
+
+func sendQueuedNotice(appContext *AppContext, msg *tgbotapi.Message) *tgbotapi.Message {
+	notice := tgbotapi.NewMessage(msg.Chat.ID, "⏳ Queued, I will answer after the current reply")
+	notice.ReplyToMessageID = msg.MessageID
+	notice.DisableNotification = true
+
+	sentMsg, err := sendWithRetry(appContext, msg.Chat.ID, notice)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to send queued notice")
+		return nil
+	}
+
+	return &sentMsg
+}
@@ -0,0 +1,191 @@
+package src
+
+import (
+	"fmt"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMessagesSentWhileAnsweringAreMerged(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.StreamResponse = true
+		config.QueueDebounceMillis = 50
+	})
+
+	h.openai.streamDelay = 300 * time.Millisecond
+	h.openai.addReply("First", " answer")
+	h.openai.addReply("Second answer")
+
+	// updates are handled concurrently, as in production, so they are built upfront
+	var updates []tgbotapi.Update
+	for _, text := range []string{"Hi", "One", "Two"} {
+		msg := h.newMessage()
+		msg.Text = text
+		updates = append(updates, tgbotapi.Update{Message: msg})
+	}
+
+	handlers := sync.WaitGroup{}
+	handle := func(update tgbotapi.Update) {
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			handleUpdate(h.appContext, update)
+		}()
+	}
+
+	handle(updates[0])
+	waitFor(t, func() bool { return IsDialogBusy("user:42") && h.openai.chatRequestCount() == 1 }, time.Second)
+
+	// sent in reverse, the queue keeps the order of messages
+	handle(updates[2])
+	handle(updates[1])
+	handlers.Wait()
+
+	expected := []string{"user: Hi", "assistant: First answer", "user: One\n\nTwo", "assistant: Second answer"}
+	if got := h.dialog(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected dialog %q, got %q", expected, got)
+	}
+
+	var notices int
+	for _, call := range h.telegram.callsTo("sendMessage") {
+		if strings.HasPrefix(call.Params.Get("text"), "⏳ Queued") {
+			notices++
+		}
+	}
+
+	if notices != 2 || len(h.telegram.callsTo("deleteMessage")) != 2 {
+		t.Errorf("expected 2 queued notices to be sent and deleted, got %d sent and %d deleted", notices, len(h.telegram.callsTo("deleteMessage")))
+	}
+
+	if IsDialogBusy("user:42") {
+		t.Errorf("expected the dialog to be free after the queue is processed")
+	}
+}
+
+func TestCommandsAreNotMerged(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.StreamResponse = true
+	})
+
+	h.openai.streamDelay = 300 * time.Millisecond
+	h.openai.addReply("First", " answer")
+
+	first := h.newMessage()
+	first.Text = "Hi"
+
+	command := h.newMessage()
+	command.Text = "/new"
+	command.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: 4}}
+
+	handlers := sync.WaitGroup{}
+	handlers.Add(2)
+	go func() {
+		defer handlers.Done()
+		handleUpdate(h.appContext, tgbotapi.Update{Message: first})
+	}()
+
+	waitFor(t, func() bool { return h.openai.chatRequestCount() == 1 }, time.Second)
+
+	go func() {
+		defer handlers.Done()
+		handleUpdate(h.appContext, tgbotapi.Update{Message: command})
+	}()
+	handlers.Wait()
+
+	// the new dialog is started only after the reply is saved to the old one
+	if got := h.dialog(); len(got) != 0 {
+		t.Errorf("expected a new empty dialog, got %q", got)
+	}
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); got != "❕New dialog started!" {
+		t.Errorf("expected the command to be handled after the reply, got %q", got)
+	}
+}
+
+func TestMergedMessagesAreCountedOnce(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.StreamResponse = true
+		config.QueueDebounceMillis = 50
+		config.UserLimits = Limits{MessagesPerMinute: 2}
+	})
+
+	h.openai.streamDelay = 300 * time.Millisecond
+	h.openai.addReply("First", " answer")
+	h.openai.addReply("Second answer")
+
+	handlers := sync.WaitGroup{}
+	send := func(text string) {
+		msg := h.newMessage()
+		msg.Text = text
+
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			handleUpdate(h.appContext, tgbotapi.Update{Message: msg})
+		}()
+	}
+
+	send("Hi")
+	waitFor(t, func() bool { return IsDialogBusy("user:42") && h.openai.chatRequestCount() == 1 }, time.Second)
+
+	send("One")
+	send("Two")
+	handlers.Wait()
+
+	if h.openai.chatRequestCount() != 2 {
+		t.Errorf("expected merged messages to be answered with one request, got %d requests", h.openai.chatRequestCount())
+	}
+
+	for _, call := range h.telegram.callsTo("sendMessage") {
+		if strings.Contains(call.Params.Get("text"), "messages per minute") {
+			t.Errorf("expected merged messages to be counted as one, got %q", call.Params.Get("text"))
+		}
+	}
+
+	// the limit is still applied to the next request
+	h.sendText("Three")
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); !strings.Contains(got, "messages per minute") {
+		t.Errorf("expected the limit to be reached, got %q", got)
+	}
+}
+
+func TestQueueOrdersMessagesWithinChats(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	newUpdate := func(chatId int64, messageId int) *queuedUpdate {
+		return &queuedUpdate{msg: &tgbotapi.Message{MessageID: messageId, Chat: &tgbotapi.Chat{ID: chatId}, Text: "Hi"}}
+	}
+
+	// a dialog tracked per user gets messages from different chats, their ids are not related
+	var updates []*queuedUpdate
+	for _, update := range []*queuedUpdate{newUpdate(1, 5), newUpdate(2, 3), newUpdate(1, 4), {action: func() {}}} {
+		updates = insertQueuedUpdate(updates, update)
+	}
+
+	var order []string
+	for _, update := range updates {
+		if update.msg == nil {
+			order = append(order, "action")
+		} else {
+			order = append(order, fmt.Sprintf("%d:%d", update.msg.Chat.ID, update.msg.MessageID))
+		}
+	}
+
+	if expected := []string{"action", "1:4", "1:5", "2:3"}; !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected order %q, got %q", expected, order)
+	}
+
+	queue := &dialogQueue{updates: updates[1:]}
+	if batch := takeQueuedBatch(h.appContext, "user:42", queue); len(batch) != 2 {
+		t.Errorf("expected messages of one chat to be merged, got %d", len(batch))
+	}
+
+	if batch := takeQueuedBatch(h.appContext, "user:42", queue); len(batch) != 1 || batch[0].msg.Chat.ID != 2 {
+		t.Errorf("expected the message of another chat to be answered separately")
+	}
+}
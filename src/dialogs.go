@@ -0,0 +1,321 @@
+package src
+
+import (
+	"fmt"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"github.com/sashabaranov/go-openai"
+	"openai-telegram-bot/src/protos"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const callbackActionSwitchDialog = "s"
+const callbackActionRenameDialog = "e"
+const callbackActionDeleteDialog = "x"
+
+// named dialog ids are built from the dialog key and the time the dialog was started
+const dialogIdSeparator = "#"
+
+const maxDialogTitleLength = 48
+const maxListedDialogs = 20
+
+const dialogTitlePrompt = "Write a short title (at most 6 words) for a conversation that starts like this. Reply with the title only, without quotes.\n\n"
+
+// supportsNamedDialogs checks if dialogs can be archived and switched. Dialogs tracked per message and per reply
+// chain are not continued without a reply anyway.
+func supportsNamedDialogs(config *Config) bool {
+	mode := config.DialogContextTrackingMode
+	return mode != DialogContextTrackingModeNone && mode != DialogContextTrackingModeThread
+}
+
+// getDialogKeyOf returns the dialog key a named dialog or a fork belongs to
+func getDialogKeyOf(dialogId string) string {
+	if index := strings.IndexAny(dialogId, dialogIdSeparator+forkSeparator); index >= 0 {
+		return dialogId[:index]
+	}
+
+	return dialogId
+}
+
+func newDialogId(dialogKey string) string {
+	return fmt.Sprintf("%s%s%d", dialogKey, dialogIdSeparator, time.Now().UnixMilli())
+}
+
+// startNewDialog archives the current dialog and makes a new empty one active. If dialogs cannot be switched
+// in the tracking mode, the current dialog is cleared instead.
+func startNewDialog(appContext *AppContext, owner UsageOwner, dialogId string) error {
+	err := appContext.Database.SetDialogState(dialogId, DialogStateNone)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to reset dialog state")
+	}
+
+	if !supportsNamedDialogs(appContext.Config) {
+		return appContext.Database.ClearDialog(dialogId)
+	}
+
+	archiveDialog(appContext, owner, dialogId)
+
+	return appContext.Database.SetActiveDialog(getDialogKeyOf(dialogId), newDialogId(getDialogKeyOf(dialogId)))
+}
+
+// archiveDialog gives the dialog a title, so it is listed in /dialogs. Empty and already titled dialogs are skipped.
+func archiveDialog(appContext *AppContext, owner UsageOwner, dialogId string) {
+	title, err := appContext.Database.GetDialogTitle(dialogId)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get dialog title")
+		return
+	}
+
+	if title != "" {
+		return
+	}
+
+	dialogMessages, err := appContext.Database.GetDialog(dialogId)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get dialog messages")
+		return
+	}
+
+	if len(dialogMessages) == 0 {
+		return
+	}
+
+	err = appContext.Database.SetDialogTitle(dialogId, generateDialogTitle(appContext, owner, dialogId, dialogMessages))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to save dialog title")
+	}
+}
+
+// generateDialogTitle asks the model to name the dialog by its first exchange, falling back to the first message
+func generateDialogTitle(appContext *AppContext, owner UsageOwner, dialogId string, dialogMessages []*protos.DialogMessage) string {
+	var firstExchange []*protos.DialogMessage
+	for _, msg := range dialogMessages {
+		firstExchange = append(firstExchange, msg)
+		if msg.Role == openai.ChatMessageRoleAssistant {
+			break
+		}
+	}
+
+	params := GetChatParams(appContext, dialogId)
+	params.SystemPrompt = ""
+	params.MaxTokens = 20
+	params.Owner = owner
+	if appContext.Config.TitleModel != "" {
+		params.Model = appContext.Config.TitleModel
+	}
+
+	title, err := GetCompleteReply(appContext, params, []*protos.DialogMessage{
+		{
+			Role:    openai.ChatMessageRoleUser,
+			Content: dialogTitlePrompt + mergeDialog(firstExchange),
+		},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to generate dialog title")
+		title = firstExchange[0].Content
+	}
+
+	title = strings.Trim(strings.TrimSpace(title), `"'.`)
+	if title == "" {
+		title = "Untitled dialog"
+	}
+
+	return truncateDialogTitle(title)
+}
+
+func truncateDialogTitle(title string) string {
+	title = strings.Join(strings.Fields(title), " ")
+
+	if utf8.RuneCountInString(title) > maxDialogTitleLength {
+		title = string([]rune(title)[:maxDialogTitleLength-1]) + "…"
+	}
+
+	return title
+}
+
+// sendDialogsKeyboard lists dialogs of the dialog key with buttons to switch to, rename or delete them
+func sendDialogsKeyboard(appContext *AppContext, dialogId string, msg *tgbotapi.Message) {
+	if !supportsNamedDialogs(appContext.Config) {
+		sendError(appContext, "Dialogs cannot be switched in this dialog tracking mode", msg.Chat.ID)
+		return
+	}
+
+	// the active dialog is listed too
+	archiveDialog(appContext, NewUsageOwner(msg.From, msg.Chat), dialogId)
+
+	titles, err := appContext.Database.GetDialogTitles(getDialogKeyOf(dialogId))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get dialog titles")
+		sendError(appContext, "Failed to get dialogs", msg.Chat.ID)
+		return
+	}
+
+	if len(titles) == 0 {
+		sendNotice(appContext, "❕There are no saved dialogs yet", msg)
+		return
+	}
+
+	if len(titles) > maxListedDialogs {
+		titles = titles[len(titles)-maxListedDialogs:]
+	}
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i := len(titles) - 1; i >= 0; i-- {
+		title := titles[i].Title
+		if titles[i].DialogId == dialogId {
+			title = "✅ " + title
+		}
+
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(title, NewCallbackData(appContext, callbackActionSwitchDialog, titles[i].DialogId, "")),
+			tgbotapi.NewInlineKeyboardButtonData("✏️", NewCallbackData(appContext, callbackActionRenameDialog, titles[i].DialogId, "")),
+			tgbotapi.NewInlineKeyboardButtonData("🗑", NewCallbackData(appContext, callbackActionDeleteDialog, titles[i].DialogId, "")),
+		))
+	}
+
+	reply := tgbotapi.NewMessage(msg.Chat.ID, "❕Your dialogs:")
+	reply.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+
+	if appContext.Config.SendReplies {
+		reply.ReplyToMessageID = msg.MessageID
+	}
+
+	_, err = sendWithRetry(appContext, msg.Chat.ID, reply)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to send dialogs")
+	}
+}
+
+// getListedDialogTitle returns the title of a dialog from the list, failing if it has been deleted since
+func getListedDialogTitle(appContext *AppContext, dialogId string) (string, error) {
+	title, err := appContext.Database.GetDialogTitle(dialogId)
+	if err != nil {
+		return "", fmt.Errorf("failed to get dialog title: %s", err)
+	}
+
+	if title == "" {
+		return "", fmt.Errorf("dialog no longer exists")
+	}
+
+	return title, nil
+}
+
+func getActiveDialog(appContext *AppContext, dialogKey string) (string, error) {
+	activeDialogId, err := appContext.Database.GetActiveDialog(dialogKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to get active dialog: %s", err)
+	}
+
+	if activeDialogId == "" {
+		return dialogKey, nil
+	}
+
+	return activeDialogId, nil
+}
+
+func handleSwitchDialogCallback(appContext *AppContext, query *tgbotapi.CallbackQuery, dialogId string, arg string) (string, error) {
+	title, err := getListedDialogTitle(appContext, dialogId)
+	if err != nil {
+		return "", err
+	}
+
+	dialogKey := getDialogKeyOf(dialogId)
+
+	activeDialogId, err := getActiveDialog(appContext, dialogKey)
+	if err != nil {
+		return "", err
+	}
+
+	if activeDialogId == dialogId {
+		return fmt.Sprintf("❕Dialog is already active: %s", title), nil
+	}
+
+	archiveDialog(appContext, NewUsageOwner(query.From, query.Message.Chat), activeDialogId)
+
+	err = appContext.Database.SetActiveDialog(dialogKey, dialogId)
+	if err != nil {
+		return "", fmt.Errorf("failed to switch dialog: %s", err)
+	}
+
+	return fmt.Sprintf("❕Switched to dialog: %s", title), nil
+}
+
+func handleRenameDialogCallback(appContext *AppContext, query *tgbotapi.CallbackQuery, dialogId string, arg string) (string, error) {
+	title, err := getListedDialogTitle(appContext, dialogId)
+	if err != nil {
+		return "", err
+	}
+
+	err = appContext.Database.SetPendingDialogRename(getDialogKeyOf(dialogId), dialogId)
+	if err != nil {
+		return "", fmt.Errorf("failed to start renaming: %s", err)
+	}
+
+	return fmt.Sprintf("✏️ Send a new title for the dialog: %s", title), nil
+}
+
+func handleDeleteDialogCallback(appContext *AppContext, query *tgbotapi.CallbackQuery, dialogId string, arg string) (string, error) {
+	title, err := getListedDialogTitle(appContext, dialogId)
+	if err != nil {
+		return "", err
+	}
+
+	dialogKey := getDialogKeyOf(dialogId)
+
+	activeDialogId, err := getActiveDialog(appContext, dialogKey)
+	if err != nil {
+		return "", err
+	}
+
+	err = appContext.Database.DeleteDialog(dialogId)
+	if err != nil {
+		return "", fmt.Errorf("failed to delete dialog: %s", err)
+	}
+
+	if activeDialogId == dialogId {
+		err = appContext.Database.SetActiveDialog(dialogKey, newDialogId(dialogKey))
+		if err != nil {
+			return "", fmt.Errorf("failed to start a new dialog: %s", err)
+		}
+	}
+
+	return fmt.Sprintf("❕Dialog deleted: %s", title), nil
+}
+
+// renameDialogFromMsg uses the message as a new title if the user is renaming a dialog. Returns `true` if the message
+// has been used.
+func renameDialogFromMsg(appContext *AppContext, dialogKey string, msg *tgbotapi.Message) bool {
+	if !supportsNamedDialogs(appContext.Config) || msg.Text == "" {
+		return false
+	}
+
+	dialogId, err := appContext.Database.GetPendingDialogRename(dialogKey)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get pending dialog rename")
+		return false
+	}
+
+	if dialogId == "" {
+		return false
+	}
+
+	err = appContext.Database.SetPendingDialogRename(dialogKey, "")
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to finish dialog rename")
+	}
+
+	title := truncateDialogTitle(msg.Text)
+
+	err = appContext.Database.SetDialogTitle(dialogId, title)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to save dialog title")
+		sendError(appContext, "Failed to rename dialog", msg.Chat.ID)
+		return true
+	}
+
+	sendNotice(appContext, fmt.Sprintf("❕Dialog renamed to: %s", title), msg)
+
+	return true
+}
@@ -0,0 +1,103 @@
+package src
+
+import (
+	"encoding/json"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"strings"
+	"testing"
+)
+
+// dialogButtons returns callback data of switch, rename and delete buttons of the listed dialog
+func dialogButtons(t *testing.T, call fakeTelegramCall, title string) (string, string, string) {
+	var markup tgbotapi.InlineKeyboardMarkup
+
+	err := json.Unmarshal([]byte(call.Params.Get("reply_markup")), &markup)
+	if err != nil {
+		t.Fatalf("failed to parse reply markup: %s", err)
+	}
+
+	for _, row := range markup.InlineKeyboard {
+		if len(row) == 3 && strings.TrimPrefix(row[0].Text, "✅ ") == title {
+			return *row[0].CallbackData, *row[1].CallbackData, *row[2].CallbackData
+		}
+	}
+
+	t.Fatalf("expected dialog %q to be listed", title)
+	return "", "", ""
+}
+
+func TestDialogsSwitching(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	h.sendText("First question")
+
+	h.openai.addReply("First topic")
+	h.sendText("/new")
+
+	h.sendText("Second question")
+
+	h.openai.addReply("Second topic")
+	h.sendText("/dialogs")
+
+	list := h.telegram.lastCallTo("sendMessage")
+	if buttons := list.callbackButtons(t); buttons["✅ Second topic"] == "" || buttons["First topic"] == "" {
+		t.Fatalf("expected both dialogs to be listed with the active one marked, got %v", buttons)
+	}
+
+	switchData, _, _ := dialogButtons(t, list, "First topic")
+	h.pressButton(switchData, h.sentMessage(list))
+
+	if got := h.telegram.lastCallTo("editMessageText").Params.Get("text"); got != "❕Switched to dialog: First topic" {
+		t.Errorf("expected a switch notification, got %q", got)
+	}
+
+	h.sendText("Follow-up")
+
+	got := h.openai.lastChatRequest().Messages
+	if len(got) != 3 || got[0].Content != "First question" || got[2].Content != "Follow-up" {
+		t.Errorf("expected the first dialog to be continued, got %v", got)
+	}
+}
+
+func TestDialogsRenameAndDelete(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	h.sendText("Question")
+
+	h.openai.addReply("Some topic")
+	h.sendText("/dialogs")
+
+	list := h.telegram.lastCallTo("sendMessage")
+	_, renameData, _ := dialogButtons(t, list, "Some topic")
+	h.pressButton(renameData, h.sentMessage(list))
+
+	h.sendText("Renamed  topic")
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); got != "❕Dialog renamed to: Renamed topic" {
+		t.Errorf("expected a rename notification, got %q", got)
+	}
+
+	if h.openai.chatRequestCount() != 2 {
+		t.Errorf("expected the new title not to be sent to the model")
+	}
+
+	h.sendText("/dialogs")
+
+	list = h.telegram.lastCallTo("sendMessage")
+	_, _, deleteData := dialogButtons(t, list, "Renamed topic")
+	h.pressButton(deleteData, h.sentMessage(list))
+
+	if got := h.telegram.lastCallTo("editMessageText").Params.Get("text"); got != "❕Dialog deleted: Renamed topic" {
+		t.Errorf("expected a delete notification, got %q", got)
+	}
+
+	if got := h.dialog(); len(got) != 0 {
+		t.Errorf("expected a new empty dialog to be active, got %q", got)
+	}
+
+	h.sendText("/dialogs")
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); got != "❕There are no saved dialogs yet" {
+		t.Errorf("expected no dialogs to be listed, got %q", got)
+	}
+}
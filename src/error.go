@@ -28,6 +28,18 @@ func getOpenAIErrorCode(err error) string {
 	return ""
 }
 
+// wrapOpenAIError converts OpenAI errors we can handle into logic errors
+func wrapOpenAIError(err error) error {
+	if getOpenAIErrorCode(err) == LogicErrorContextLengthExceeded {
+		return LogicError{
+			Code:    LogicErrorContextLengthExceeded,
+			Message: "Context length exceeded",
+		}
+	}
+
+	return err
+}
+
 func GetLogicErrorCode(err error) string {
 	if logicErr, ok := err.(LogicError); ok {
 		return logicErr.Code
@@ -0,0 +1,353 @@
+package src
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"github.com/sashabaranov/go-openai"
+	"io"
+	"net/http"
+	"openai-telegram-bot/src/protos"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const ExportFormatMarkdown = "md"
+const ExportFormatJSON = "json"
+const ExportFormatJSONL = "jsonl"
+
+// imported files are read into memory, so their size is limited
+const maxImportSize = 1 << 20
+
+var markdownRoleHeadings = map[string]string{
+	openai.ChatMessageRoleSystem:    "System",
+	openai.ChatMessageRoleUser:      "User",
+	openai.ChatMessageRoleAssistant: "Assistant",
+}
+
+var markdownRoleHeadingPattern = regexp.MustCompile(`^## (System|User|Assistant)\s*$`)
+
+type exportedMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// exportedDialog is the JSON export format. JSONL export has a line per dialog in the OpenAI fine-tuning format,
+// which is the same without a title.
+type exportedDialog struct {
+	Title    string            `json:"title,omitempty"`
+	Messages []exportedMessage `json:"messages"`
+}
+
+func exportDialog(appContext *AppContext, dialogId string, format string, msg *tgbotapi.Message) {
+	format = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(format), "."))
+	if format == "" {
+		format = ExportFormatMarkdown
+	}
+
+	dialogMessages, err := appContext.Database.GetDialog(dialogId)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get dialog messages")
+		sendError(appContext, "Failed to export dialog", msg.Chat.ID)
+		return
+	}
+
+	if len(dialogMessages) == 0 {
+		sendError(appContext, "The dialog is empty, there is nothing to export", msg.Chat.ID)
+		return
+	}
+
+	title, err := appContext.Database.GetDialogTitle(dialogId)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get dialog title")
+	}
+
+	data, err := formatDialog(format, title, dialogMessages)
+	if err != nil {
+		sendError(appContext, fmt.Sprintf("Failed to export dialog: %s", err), msg.Chat.ID)
+		return
+	}
+
+	document := tgbotapi.NewDocument(msg.Chat.ID, tgbotapi.FileBytes{
+		Name:  fmt.Sprintf("dialog-%s.%s", time.Now().Format("2006-01-02-150405"), format),
+		Bytes: data,
+	})
+
+	if appContext.Config.SendReplies {
+		document.ReplyToMessageID = msg.MessageID
+	}
+
+	_, err = sendWithRetry(appContext, msg.Chat.ID, document)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to send exported dialog")
+	}
+}
+
+func formatDialog(format string, title string, dialogMessages []*protos.DialogMessage) ([]byte, error) {
+	exported := exportedDialog{Title: title}
+	for _, msg := range dialogMessages {
+		exported.Messages = append(exported.Messages, exportedMessage{Role: msg.Role, Content: msg.Content})
+	}
+
+	switch format {
+	case ExportFormatMarkdown:
+		builder := strings.Builder{}
+		if title != "" {
+			builder.WriteString("# " + title + "\n\n")
+		}
+
+		for _, msg := range exported.Messages {
+			builder.WriteString("## " + markdownRoleHeadings[msg.Role] + "\n\n" + msg.Content + "\n\n")
+		}
+
+		return []byte(builder.String()), nil
+
+	case ExportFormatJSON:
+		return json.MarshalIndent(exported, "", "  ")
+
+	case ExportFormatJSONL:
+		exported.Title = ""
+
+		line, err := json.Marshal(exported)
+		if err != nil {
+			return nil, err
+		}
+
+		return append(line, '\n'), nil
+
+	default:
+		return nil, fmt.Errorf("unknown format %s, available formats: %s, %s, %s", format,
+			ExportFormatMarkdown, ExportFormatJSON, ExportFormatJSONL)
+	}
+}
+
+// parseDialog reads a dialog exported in the format. Titles are only stored in Markdown and JSON.
+func parseDialog(format string, data []byte) (string, []*protos.DialogMessage, error) {
+	var exported exportedDialog
+
+	switch format {
+	case ExportFormatMarkdown:
+		exported = parseMarkdownDialog(string(data))
+
+	case ExportFormatJSON:
+		// a bare list of messages is accepted too
+		if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+			err := json.Unmarshal(trimmed, &exported.Messages)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid JSON: %s", err)
+			}
+		} else {
+			err := json.Unmarshal(data, &exported)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid JSON: %s", err)
+			}
+		}
+
+	case ExportFormatJSONL:
+		var lines [][]byte
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(nil, maxImportSize)
+		for scanner.Scan() {
+			if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+				lines = append(lines, append([]byte(nil), line...))
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			return "", nil, fmt.Errorf("failed to read lines: %s", err)
+		}
+
+		if len(lines) != 1 {
+			return "", nil, fmt.Errorf("expected a single dialog, the file contains %d", len(lines))
+		}
+
+		err := json.Unmarshal(lines[0], &exported)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid JSON: %s", err)
+		}
+
+	default:
+		return "", nil, fmt.Errorf("unknown file format, expected .%s, .%s or .%s file", ExportFormatMarkdown,
+			ExportFormatJSON, ExportFormatJSONL)
+	}
+
+	var dialogMessages []*protos.DialogMessage
+	for _, msg := range exported.Messages {
+		if _, ok := markdownRoleHeadings[msg.Role]; !ok {
+			return "", nil, fmt.Errorf("unknown message role: %s", msg.Role)
+		}
+
+		if strings.TrimSpace(msg.Content) == "" {
+			continue
+		}
+
+		dialogMessages = append(dialogMessages, &protos.DialogMessage{Role: msg.Role, Content: msg.Content})
+	}
+
+	if len(dialogMessages) == 0 {
+		return "", nil, fmt.Errorf("the file contains no messages")
+	}
+
+	return strings.TrimSpace(exported.Title), dialogMessages, nil
+}
+
+func parseMarkdownDialog(text string) exportedDialog {
+	var exported exportedDialog
+	var current *exportedMessage
+
+	for _, line := range strings.Split(text, "\n") {
+		if match := markdownRoleHeadingPattern.FindStringSubmatch(line); match != nil {
+			for role, heading := range markdownRoleHeadings {
+				if heading == match[1] {
+					exported.Messages = append(exported.Messages, exportedMessage{Role: role})
+				}
+			}
+
+			current = &exported.Messages[len(exported.Messages)-1]
+			continue
+		}
+
+		if current == nil {
+			if title, ok := strings.CutPrefix(line, "# "); ok && exported.Title == "" {
+				exported.Title = title
+			}
+
+			continue
+		}
+
+		current.Content += line + "\n"
+	}
+
+	for i := range exported.Messages {
+		exported.Messages[i].Content = strings.TrimSpace(exported.Messages[i].Content)
+	}
+
+	return exported
+}
+
+func getImportFormat(fileName string) string {
+	switch strings.ToLower(path.Ext(fileName)) {
+	case ".md", ".markdown", ".txt":
+		return ExportFormatMarkdown
+	case ".json":
+		return ExportFormatJSON
+	case ".jsonl":
+		return ExportFormatJSONL
+	default:
+		return ""
+	}
+}
+
+// importDialog loads an exported dialog from the document in the message, or in the message it replies to,
+// as a new dialog
+func importDialog(appContext *AppContext, dialogId string, msg *tgbotapi.Message) {
+	document := msg.Document
+	if document == nil && msg.ReplyToMessage != nil {
+		document = msg.ReplyToMessage.Document
+	}
+
+	if document == nil {
+		sendError(appContext, "Please send an exported dialog file with /import caption, or reply /import to it", msg.Chat.ID)
+		return
+	}
+
+	if !supportsNamedDialogs(appContext.Config) && appContext.Config.DialogContextTrackingMode != DialogContextTrackingModeThread {
+		sendError(appContext, "Dialogs cannot be imported in this dialog tracking mode", msg.Chat.ID)
+		return
+	}
+
+	if document.FileSize > maxImportSize {
+		sendError(appContext, "The file is too large to import", msg.Chat.ID)
+		return
+	}
+
+	data, err := downloadDocument(appContext, document)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to download imported file")
+		sendError(appContext, fmt.Sprintf("Failed to download the file: %s", err), msg.Chat.ID)
+		return
+	}
+
+	title, dialogMessages, err := parseDialog(getImportFormat(document.FileName), data)
+	if err != nil {
+		sendError(appContext, fmt.Sprintf("Failed to import dialog: %s", err), msg.Chat.ID)
+		return
+	}
+
+	if title == "" {
+		title = strings.TrimSuffix(document.FileName, path.Ext(document.FileName))
+	}
+
+	// threads are started by the import message
+	importedId := fmt.Sprintf("thread:%d:%d", msg.Chat.ID, msg.MessageID)
+	if supportsNamedDialogs(appContext.Config) {
+		archiveDialog(appContext, NewUsageOwner(msg.From, msg.Chat), dialogId)
+		importedId = newDialogId(getDialogKeyOf(dialogId))
+	}
+
+	err = appContext.Database.ReplaceDialogTail(importedId, 0, dialogMessages...)
+	if err == nil && supportsNamedDialogs(appContext.Config) {
+		err = appContext.Database.SetDialogTitle(importedId, truncateDialogTitle(title))
+		if err == nil {
+			err = appContext.Database.SetActiveDialog(getDialogKeyOf(importedId), importedId)
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to save imported dialog")
+		sendError(appContext, "Failed to save imported dialog", msg.Chat.ID)
+		return
+	}
+
+	notice := fmt.Sprintf("❕Imported dialog with %d messages: %s", len(dialogMessages), title)
+	if !supportsNamedDialogs(appContext.Config) {
+		notice += "\nReply to this message to continue it"
+	}
+
+	reply := tgbotapi.NewMessage(msg.Chat.ID, notice)
+	if appContext.Config.SendReplies {
+		reply.ReplyToMessageID = msg.MessageID
+	}
+
+	sentMsg, err := sendWithRetry(appContext, msg.Chat.ID, reply)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to send import notification")
+		return
+	}
+
+	trackDialogMessages(appContext, importedId, msg.Chat.ID, msg.MessageID, sentMsg.MessageID)
+}
+
+func downloadDocument(appContext *AppContext, document *tgbotapi.Document) ([]byte, error) {
+	file, err := appContext.TelegramBot.GetFile(tgbotapi.FileConfig{FileID: document.FileID})
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := &http.Client{Timeout: getTelegramTimeout(appContext.Config)}
+
+	resp, err := httpClient.Get(GetFileURL(appContext, file))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImportSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > maxImportSize {
+		return nil, fmt.Errorf("the file is too large")
+	}
+
+	return data, nil
+}
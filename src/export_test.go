@@ -0,0 +1,120 @@
+package src
+
+import (
+	"encoding/json"
+	"github.com/sashabaranov/go-openai"
+	"openai-telegram-bot/src/protos"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDialogFormatsRoundTrip(t *testing.T) {
+	dialogMessages := []*protos.DialogMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: "Be brief"},
+		{Role: openai.ChatMessageRoleUser, Content: "Show me code"},
+		{Role: openai.ChatMessageRoleAssistant, Content: "```go\n# not a heading\n```\n\nDone"},
+	}
+
+	for _, format := range []string{ExportFormatMarkdown, ExportFormatJSON, ExportFormatJSONL} {
+		data, err := formatDialog(format, "Code", dialogMessages)
+		if err != nil {
+			t.Fatalf("failed to format %s: %s", format, err)
+		}
+
+		title, parsed, err := parseDialog(format, data)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %s", format, err)
+		}
+
+		if format != ExportFormatJSONL && title != "Code" {
+			t.Errorf("expected title to survive %s, got %q", format, title)
+		}
+
+		if len(parsed) != len(dialogMessages) {
+			t.Fatalf("expected %d messages from %s, got %d", len(dialogMessages), format, len(parsed))
+		}
+
+		for i := range parsed {
+			if parsed[i].Role != dialogMessages[i].Role || parsed[i].Content != dialogMessages[i].Content {
+				t.Errorf("expected message %d from %s to be %q, got %q", i, format, dialogMessages[i].Content, parsed[i].Content)
+			}
+		}
+	}
+}
+
+func TestParseDialogErrors(t *testing.T) {
+	cases := map[string]string{
+		ExportFormatJSON:  `{"messages": [{"role": "robot", "content": "Hi"}]}`,
+		ExportFormatJSONL: "{\"messages\": [{\"role\": \"user\", \"content\": \"A\"}]}\n{\"messages\": [{\"role\": \"user\", \"content\": \"B\"}]}\n",
+		"":                "whatever",
+	}
+
+	for format, data := range cases {
+		_, _, err := parseDialog(format, []byte(data))
+		if err == nil {
+			t.Errorf("expected %q in format %q to fail", data, format)
+		}
+	}
+
+	_, _, err := parseDialog(ExportFormatMarkdown, []byte("Just some text"))
+	if err == nil {
+		t.Errorf("expected Markdown without messages to fail")
+	}
+
+	// lines after one that is too long to read are not silently dropped
+	data := "{\"messages\": [{\"role\": \"user\", \"content\": \"A\"}]}\n" + strings.Repeat("x", maxImportSize+1)
+	_, _, err = parseDialog(ExportFormatJSONL, []byte(data))
+	if err == nil {
+		t.Errorf("expected JSON lines with a too long line to fail")
+	}
+}
+
+func TestExportAndImport(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	h.sendText("Hi")
+	h.sendText("/export json")
+
+	exported := h.telegram.lastCallTo("sendDocument").Files["document"]
+
+	var dialog exportedDialog
+	err := json.Unmarshal(exported, &dialog)
+	if err != nil {
+		t.Fatalf("failed to parse exported dialog: %s", err)
+	}
+
+	expected := []exportedMessage{{Role: "user", Content: "Hi"}, {Role: "assistant", Content: fakeReplyText}}
+	if !reflect.DeepEqual(dialog.Messages, expected) {
+		t.Fatalf("expected exported messages %v, got %v", expected, dialog.Messages)
+	}
+
+	h.sendText("/new")
+
+	h.sendDocument("saved.json", exported, "/import")
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); !strings.HasPrefix(got, "❕Imported dialog with 2 messages") {
+		t.Errorf("expected an import notification, got %q", got)
+	}
+
+	h.sendText("Continue")
+
+	got := h.openai.lastChatRequest().Messages
+	if len(got) != 3 || got[0].Content != "Hi" || got[2].Content != "Continue" {
+		t.Errorf("expected the imported dialog to be continued, got %v", got)
+	}
+}
+
+func TestExportEmptyDialog(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	h.sendText("/export")
+
+	if len(h.telegram.callsTo("sendDocument")) != 0 {
+		t.Errorf("expected nothing to be exported")
+	}
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); !strings.Contains(got, "empty") {
+		t.Errorf("expected an error message, got %q", got)
+	}
+}
@@ -0,0 +1,258 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sashabaranov/go-openai"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const fakeReplyText = "Hello from the fake model"
+const fakeImageURL = "https://example.com/image.png"
+
+// fakeChatReply is a reply of the fake model. Chunks are sent one by one when streaming.
+type fakeChatReply struct {
+	chunks     []string
+	noChoices  bool
+	errorCode  string
+	statusCode int
+	// headers sent with the error
+	headers map[string]string
+}
+
+// fakeOpenAI is an in-process OpenAI API server with scripted replies
+type fakeOpenAI struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu                    sync.Mutex
+	chatRequests          []openai.ChatCompletionRequest
+	replies               []fakeChatReply
+	imageRequests         []openai.ImageRequest
+	transcriptionRequests int
+	transcription         string
+	streamDelay           time.Duration
+	noImages              bool
+	// responseDelay is waited before a reply or its first part is sent
+	responseDelay time.Duration
+}
+
+func newFakeOpenAI(t *testing.T) *fakeOpenAI {
+	f := &fakeOpenAI{
+		t:             t,
+		transcription: "Text from voice",
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/chat/completions", f.handleChat)
+	mux.HandleFunc("/v1/images/generations", f.handleImages)
+	mux.HandleFunc("/v1/audio/transcriptions", f.handleTranscriptions)
+
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+
+	return f
+}
+
+func (f *fakeOpenAI) baseURL() string {
+	return f.server.URL + "/v1"
+}
+
+// addReply queues a reply, when the queue is empty the model replies with `fakeReplyText`
+func (f *fakeOpenAI) addReply(chunks ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.replies = append(f.replies, fakeChatReply{chunks: chunks})
+}
+
+// addEmptyReply makes the model answer with no choices
+func (f *fakeOpenAI) addEmptyReply() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.replies = append(f.replies, fakeChatReply{noChoices: true})
+}
+
+func (f *fakeOpenAI) addError(statusCode int, code string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.replies = append(f.replies, fakeChatReply{statusCode: statusCode, errorCode: code})
+}
+
+// addRateLimit queues a rate limit error with the headers
+func (f *fakeOpenAI) addRateLimit(headers map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.replies = append(f.replies, fakeChatReply{statusCode: http.StatusTooManyRequests, errorCode: "rate_limit_exceeded", headers: headers})
+}
+
+func (f *fakeOpenAI) lastChatRequest() openai.ChatCompletionRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.chatRequests) == 0 {
+		f.t.Fatal("expected a chat completion request")
+	}
+
+	return f.chatRequests[len(f.chatRequests)-1]
+}
+
+func (f *fakeOpenAI) chatRequestCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.chatRequests)
+}
+
+func (f *fakeOpenAI) nextReply(req openai.ChatCompletionRequest) fakeChatReply {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.chatRequests = append(f.chatRequests, req)
+
+	if len(f.replies) == 0 {
+		return fakeChatReply{chunks: []string{fakeReplyText}}
+	}
+
+	reply := f.replies[0]
+	f.replies = f.replies[1:]
+
+	return reply
+}
+
+func (f *fakeOpenAI) handleChat(w http.ResponseWriter, r *http.Request) {
+	var req openai.ChatCompletionRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reply := f.nextReply(req)
+
+	time.Sleep(f.responseDelay)
+
+	if reply.errorCode != "" {
+		for name, value := range reply.headers {
+			w.Header().Set(name, value)
+		}
+
+		writeOpenAIError(w, reply.statusCode, reply.errorCode)
+		return
+	}
+
+	if !req.Stream {
+		response := openai.ChatCompletionResponse{
+			ID:      "chatcmpl-test",
+			Object:  "chat.completion",
+			Created: time.Now().Unix(),
+			Model:   req.Model,
+			Choices: []openai.ChatCompletionChoice{{
+				Message: openai.ChatCompletionMessage{
+					Role:    openai.ChatMessageRoleAssistant,
+					Content: strings.Join(reply.chunks, ""),
+				},
+				FinishReason: "stop",
+			}},
+			Usage: openai.Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15},
+		}
+		if reply.noChoices {
+			response.Choices = nil
+		}
+
+		writeJSON(w, response)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+
+	for _, chunk := range reply.chunks {
+		data, _ := json.Marshal(openai.ChatCompletionStreamResponse{
+			ID:      "chatcmpl-test",
+			Object:  "chat.completion.chunk",
+			Created: time.Now().Unix(),
+			Model:   req.Model,
+			Choices: []openai.ChatCompletionStreamChoice{{
+				Delta: openai.ChatCompletionStreamChoiceDelta{Content: chunk},
+			}},
+		})
+
+		_, _ = fmt.Fprintf(w, "data: %s\n\n", data)
+		w.(http.Flusher).Flush()
+
+		time.Sleep(f.streamDelay)
+	}
+
+	_, _ = fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+func (f *fakeOpenAI) handleImages(w http.ResponseWriter, r *http.Request) {
+	var req openai.ImageRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	f.imageRequests = append(f.imageRequests, req)
+	noImages := f.noImages
+	f.mu.Unlock()
+
+	response := openai.ImageResponse{
+		Created: time.Now().Unix(),
+		Data:    []openai.ImageResponseDataInner{{URL: fakeImageURL}},
+	}
+	if noImages {
+		response.Data = nil
+	}
+
+	writeJSON(w, response)
+}
+
+func (f *fakeOpenAI) handleTranscriptions(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseMultipartForm(1 << 20)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	f.transcriptionRequests++
+	text := f.transcription
+	f.mu.Unlock()
+
+	writeJSON(w, openai.AudioResponse{Text: text})
+}
+
+func writeOpenAIError(w http.ResponseWriter, statusCode int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+
+	writeJSONBody(w, map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": "Fake error: " + code,
+			"type":    "invalid_request_error",
+			"code":    code,
+		},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	writeJSONBody(w, value)
+}
+
+func writeJSONBody(w http.ResponseWriter, value interface{}) {
+	_ = json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,340 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const fakeBotId = 1000
+
+type fakeTelegramCall struct {
+	Method string
+	Params url.Values
+
+	// uploaded files by field name
+	Files map[string][]byte
+
+	// id of the sent or edited message, if the method returns one
+	MessageID int
+}
+
+// fakeTelegram is an in-process Bot API server that records every call
+type fakeTelegram struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu            sync.Mutex
+	calls         []fakeTelegramCall
+	lastMessageId int
+	updates       []tgbotapi.Update
+	files         map[string][]byte
+	// statuses of chat members by chat and user id
+	members map[string]string
+
+	// errors returned for the next calls to the method instead of a result
+	failures map[string][]fakeTelegramFailure
+}
+
+type fakeTelegramFailure struct {
+	code        int
+	description string
+	retryAfter  int
+	// the call succeeds after the delay, if set
+	delay time.Duration
+}
+
+func newFakeTelegram(t *testing.T) *fakeTelegram {
+	f := &fakeTelegram{
+		t:             t,
+		lastMessageId: 10000,
+		files:         map[string][]byte{},
+		members:       map[string]string{},
+		failures:      map[string][]fakeTelegramFailure{},
+	}
+
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(f.server.Close)
+
+	return f
+}
+
+func (f *fakeTelegram) apiEndpoint() string {
+	return f.server.URL + "/bot%s/%s"
+}
+
+func (f *fakeTelegram) fileEndpoint() string {
+	return f.server.URL + "/file/bot%s/%s"
+}
+
+func (f *fakeTelegram) addFile(fileId string, content []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.files[fileId] = content
+}
+
+func (f *fakeTelegram) addUpdate(update tgbotapi.Update) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.updates = append(f.updates, update)
+}
+
+// failNext makes the next call to the method fail with the description
+func (f *fakeTelegram) setMember(chatId int64, userId int64, status string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.members[fmt.Sprintf("%d:%d", chatId, userId)] = status
+}
+
+func (f *fakeTelegram) failNext(method string, description string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failures[method] = append(f.failures[method], fakeTelegramFailure{code: 400, description: description})
+}
+
+// floodNext makes the next call to the method hit the flood limit, asking to retry after the seconds
+func (f *fakeTelegram) floodNext(method string, retryAfter int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	failure := fakeTelegramFailure{code: 429, description: "Too Many Requests: retry later", retryAfter: retryAfter}
+	f.failures[method] = append(f.failures[method], failure)
+}
+
+// slowNext makes the next call to the method respond after the delay
+func (f *fakeTelegram) slowNext(method string, delay time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failures[method] = append(f.failures[method], fakeTelegramFailure{delay: delay})
+}
+
+func (f *fakeTelegram) callsTo(method string) []fakeTelegramCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var result []fakeTelegramCall
+	for _, call := range f.calls {
+		if call.Method == method {
+			result = append(result, call)
+		}
+	}
+
+	return result
+}
+
+func (f *fakeTelegram) lastCallTo(method string) fakeTelegramCall {
+	calls := f.callsTo(method)
+	if len(calls) == 0 {
+		f.t.Fatalf("expected a call to %s", method)
+	}
+
+	return calls[len(calls)-1]
+}
+
+func (f *fakeTelegram) handle(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/file/") {
+		f.handleFile(w, r)
+		return
+	}
+
+	err := r.ParseMultipartForm(1 << 20)
+	if err != nil && err != http.ErrNotMultipart {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+
+	files := map[string][]byte{}
+	if r.MultipartForm != nil {
+		for field, headers := range r.MultipartForm.File {
+			file, err := headers[0].Open()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			files[field], _ = io.ReadAll(file)
+			_ = file.Close()
+		}
+	}
+
+	f.mu.Lock()
+	callIndex := len(f.calls)
+	f.calls = append(f.calls, fakeTelegramCall{Method: method, Params: r.Form, Files: files})
+
+	var failure *fakeTelegramFailure
+	if failures := f.failures[method]; len(failures) > 0 {
+		failure = &failures[0]
+		f.failures[method] = failures[1:]
+	}
+	f.mu.Unlock()
+
+	if failure != nil && failure.delay > 0 {
+		time.Sleep(failure.delay)
+		failure = nil
+	}
+
+	if failure != nil {
+		response := map[string]interface{}{"ok": false, "error_code": failure.code, "description": failure.description}
+		if failure.retryAfter > 0 {
+			response["parameters"] = map[string]interface{}{"retry_after": failure.retryAfter}
+		}
+
+		writeTelegramResponse(w, response)
+		return
+	}
+
+	result, ok := f.result(method, r.Form)
+	if !ok {
+		writeTelegramResponse(w, map[string]interface{}{"ok": false, "error_code": 404, "description": "Not Found: method not found"})
+		return
+	}
+
+	if msg, ok := result.(tgbotapi.Message); ok {
+		f.mu.Lock()
+		f.calls[callIndex].MessageID = msg.MessageID
+		f.mu.Unlock()
+	}
+
+	writeTelegramResponse(w, map[string]interface{}{"ok": true, "result": result})
+}
+
+func (f *fakeTelegram) result(method string, params url.Values) (interface{}, bool) {
+	switch method {
+	case "getMe":
+		return tgbotapi.User{ID: fakeBotId, IsBot: true, FirstName: "Bot", UserName: "test_bot"}, true
+
+	case "getUpdates":
+		return f.takeUpdates(params), true
+
+	case "sendMessage", "sendPhoto", "sendDocument":
+		return f.newMessage(params), true
+
+	case "editMessageText", "editMessageReplyMarkup":
+		msg := f.newMessage(params)
+		msg.MessageID = int(parseInt(params.Get("message_id")))
+		return msg, true
+
+	case "getFile":
+		fileId := params.Get("file_id")
+		return tgbotapi.File{FileID: fileId, FileUniqueID: fileId, FilePath: "files/" + fileId}, true
+
+	case "getChatMember":
+		f.mu.Lock()
+		status, ok := f.members[params.Get("chat_id")+":"+params.Get("user_id")]
+		f.mu.Unlock()
+
+		if !ok {
+			status = "left"
+		}
+
+		return tgbotapi.ChatMember{User: &tgbotapi.User{ID: parseInt(params.Get("user_id"))}, Status: status}, true
+
+	case "sendChatAction", "answerCallbackQuery", "setMyCommands", "deleteWebhook", "setWebhook", "deleteMessage":
+		return true, true
+
+	default:
+		return nil, false
+	}
+}
+
+func (f *fakeTelegram) takeUpdates(params url.Values) []tgbotapi.Update {
+	offset := int(parseInt(params.Get("offset")))
+
+	// updates are not long polled, but an empty response should not make the client spin
+	deadline := time.Now().Add(100 * time.Millisecond)
+	for {
+		f.mu.Lock()
+		var result []tgbotapi.Update
+		for _, update := range f.updates {
+			if update.UpdateID >= offset {
+				result = append(result, update)
+			}
+		}
+		f.mu.Unlock()
+
+		if len(result) > 0 || time.Now().After(deadline) {
+			return result
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (f *fakeTelegram) newMessage(params url.Values) tgbotapi.Message {
+	f.mu.Lock()
+	f.lastMessageId++
+	messageId := f.lastMessageId
+	f.mu.Unlock()
+
+	chatId := parseInt(params.Get("chat_id"))
+
+	return tgbotapi.Message{
+		MessageID: messageId,
+		From:      &tgbotapi.User{ID: fakeBotId, IsBot: true, UserName: "test_bot"},
+		Date:      int(time.Now().Unix()),
+		Chat:      &tgbotapi.Chat{ID: chatId, Type: "private"},
+		Text:      params.Get("text"),
+	}
+}
+
+func (f *fakeTelegram) handleFile(w http.ResponseWriter, r *http.Request) {
+	fileName := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+
+	f.mu.Lock()
+	content, ok := f.files[fileName]
+	f.mu.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	_, _ = w.Write(content)
+}
+
+func writeTelegramResponse(w http.ResponseWriter, response map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+func parseInt(value string) int64 {
+	result, _ := strconv.ParseInt(value, 10, 64)
+	return result
+}
+
+// callbackButtons returns callback data of inline buttons in a recorded call, keyed by button text
+func (call fakeTelegramCall) callbackButtons(t *testing.T) map[string]string {
+	var markup tgbotapi.InlineKeyboardMarkup
+
+	err := json.Unmarshal([]byte(call.Params.Get("reply_markup")), &markup)
+	if err != nil {
+		t.Fatalf("failed to parse reply markup of %s: %s", call.Method, err)
+	}
+
+	buttons := map[string]string{}
+	for _, row := range markup.InlineKeyboard {
+		for _, button := range row {
+			if button.CallbackData != nil {
+				buttons[button.Text] = *button.CallbackData
+			}
+		}
+	}
+
+	return buttons
+}
@@ -0,0 +1,86 @@
+package src
+
+import (
+	"fmt"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"github.com/sashabaranov/go-openai"
+	"openai-telegram-bot/src/protos"
+	"strings"
+)
+
+// fork dialog ids are built from the dialog key and the id of the message that started them, so ids of forks of forks
+// still fit into callback data
+const forkSeparator = "/"
+
+func isForkDialog(dialogId string) bool {
+	return strings.Contains(dialogId, forkSeparator)
+}
+
+// forkDialogOnReply returns the dialog the message should be answered in. Replies to answers in a fork continue the
+// fork, and a reply to an earlier answer starts a new fork with the history up to that answer, leaving the dialog
+// it was replied in unchanged.
+func forkDialogOnReply(appContext *AppContext, dialogId string, msg *tgbotapi.Message) string {
+	replyTo := msg.ReplyToMessage
+	if replyTo == nil || replyTo.From == nil || replyTo.From.ID != appContext.TelegramBot.Self.ID || msg.IsCommand() {
+		return dialogId
+	}
+
+	forkId, err := appContext.Database.GetMessageDialog(msg.Chat.ID, replyTo.MessageID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get dialog of replied message")
+	}
+
+	if isForkDialog(forkId) && getDialogKeyOf(forkId) == getDialogKeyOf(dialogId) {
+		dialogId = forkId
+	}
+
+	dialogMessages, err := appContext.Database.GetDialog(dialogId)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get dialog messages")
+		return dialogId
+	}
+
+	answerIndex := findAnswerByMessageId(dialogMessages, replyTo.MessageID)
+	if answerIndex < 0 || !hasAnswerAfter(dialogMessages, answerIndex) {
+		return dialogId
+	}
+
+	forkId = fmt.Sprintf("%s%s%d", getDialogKeyOf(dialogId), forkSeparator, msg.MessageID)
+
+	err = appContext.Database.ForkDialog(dialogId, forkId, answerIndex+1)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to fork dialog")
+		return dialogId
+	}
+
+	log.Info().Str("dialog", dialogId).Str("fork", forkId).Msg("Forked dialog from an earlier answer")
+
+	return forkId
+}
+
+func findAnswerByMessageId(dialogMessages []*protos.DialogMessage, messageId int) int {
+	for i := len(dialogMessages) - 1; i >= 0; i-- {
+		if dialogMessages[i].Role != openai.ChatMessageRoleAssistant {
+			continue
+		}
+
+		for _, answerMessageId := range dialogMessages[i].TelegramMessageIds {
+			if answerMessageId == int64(messageId) {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+func hasAnswerAfter(dialogMessages []*protos.DialogMessage, index int) bool {
+	for _, msg := range dialogMessages[index+1:] {
+		if msg.Role == openai.ChatMessageRoleAssistant {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,113 @@
+package src
+
+import (
+	"github.com/sashabaranov/go-openai"
+	"openai-telegram-bot/src/protos"
+	"testing"
+)
+
+func TestForkDialogFromEarlierAnswer(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	h.sendText("First question")
+	firstAnswer := h.sentMessage(h.telegram.lastCallTo("sendMessage"))
+
+	h.sendText("Second question")
+
+	h.sendReply("Alternative question", firstAnswer)
+
+	got := h.openai.lastChatRequest().Messages
+	if len(got) != 3 || got[0].Content != "First question" || got[2].Content != "Alternative question" {
+		t.Fatalf("expected the fork to contain history up to the first answer, got %v", got)
+	}
+
+	if got := h.dialog(); len(got) != 4 {
+		t.Errorf("expected the main dialog to be unchanged, got %q", got)
+	}
+
+	forkAnswer := h.sentMessage(h.telegram.lastCallTo("sendMessage"))
+	h.sendReply("More", forkAnswer)
+
+	got = h.openai.lastChatRequest().Messages
+	if len(got) != 5 || got[2].Content != "Alternative question" || got[4].Content != "More" {
+		t.Errorf("expected a reply to the fork answer to continue the fork, got %v", got)
+	}
+
+	h.sendText("Third question")
+
+	got = h.openai.lastChatRequest().Messages
+	if len(got) != 5 || got[2].Content != "Second question" {
+		t.Errorf("expected new messages to continue the main dialog, got %v", got)
+	}
+}
+
+func TestReplyToLastAnswerDoesNotFork(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	h.sendText("Question")
+	answer := h.sentMessage(h.telegram.lastCallTo("sendMessage"))
+
+	h.sendReply("Follow-up", answer)
+
+	if got := h.dialog(); len(got) != 4 {
+		t.Errorf("expected the reply to be appended to the dialog, got %q", got)
+	}
+}
+
+func TestForkDialogRejectsEmptyFork(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	if err := h.appContext.Database.ForkDialog("chat:1", "chat:1/200", 0); err == nil {
+		t.Errorf("expected forking no messages to fail")
+	}
+}
+
+func TestDeleteDialogRemovesForks(t *testing.T) {
+	h := newTestHarness(t, nil)
+	db := h.appContext.Database
+
+	for _, dialogId := range []string{"chat:1#a", "chat:1#b"} {
+		err := db.AddDialogMessage(dialogId, &protos.DialogMessage{Role: openai.ChatMessageRoleUser, Content: "Hi"})
+		if err != nil {
+			t.Fatalf("failed to add message: %s", err)
+		}
+	}
+
+	mustSucceed := func(err error) {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	mustSucceed(db.SetMessageDialog(1, []int{10}, "chat:1#a"))
+	mustSucceed(db.SetMessageDialog(1, []int{20}, "chat:1#b"))
+	mustSucceed(db.ForkDialog("chat:1#a", "chat:1/11", 1))
+	mustSucceed(db.SetMessageDialog(1, []int{12}, "chat:1/11"))
+	mustSucceed(db.ForkDialog("chat:1/11", "chat:1/13", 1))
+	mustSucceed(db.SetMessageDialog(1, []int{14}, "chat:1/13"))
+	mustSucceed(db.SetMessageDialog(1, []int{30}, "chat:1#a"))
+	mustSucceed(db.SetMessageDialog(1, []int{30}, "chat:1#b"))
+
+	mustSucceed(db.DeleteDialog("chat:1#a"))
+
+	for _, dialogId := range []string{"chat:1#a", "chat:1/11", "chat:1/13"} {
+		if got, _ := db.GetDialog(dialogId); len(got) != 0 {
+			t.Errorf("expected dialog %s to be deleted, got %v", dialogId, got)
+		}
+	}
+
+	for _, messageId := range []int{10, 12, 14} {
+		if got, _ := db.GetMessageDialog(1, messageId); got != "" {
+			t.Errorf("expected message %d to be forgotten, got dialog %s", messageId, got)
+		}
+	}
+
+	for _, messageId := range []int{20, 30} {
+		if got, _ := db.GetMessageDialog(1, messageId); got != "chat:1#b" {
+			t.Errorf("expected message %d of another dialog to be kept, got dialog %q", messageId, got)
+		}
+	}
+
+	// deleting is idempotent, so a repeated button press does not fail
+	mustSucceed(db.DeleteDialog("chat:1#b"))
+	mustSucceed(db.DeleteDialog("chat:1#a"))
+}
@@ -0,0 +1,117 @@
+package src
+
+import (
+	"fmt"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"github.com/sashabaranov/go-openai"
+	"openai-telegram-bot/src/protos"
+	"strings"
+)
+
+func isGroupChat(msg *tgbotapi.Message) bool {
+	return msg.Chat.IsGroup() || msg.Chat.IsSuperGroup()
+}
+
+// isAddressedToBot checks if a message in a group chat should be answered according to configured group triggers.
+// Commands are always handled, unless they are addressed to another bot.
+func isAddressedToBot(appContext *AppContext, msg *tgbotapi.Message) bool {
+	config := appContext.Config
+	bot := appContext.TelegramBot.Self
+
+	if msg.IsCommand() {
+		command := msg.CommandWithAt()
+		atIndex := strings.Index(command, "@")
+		return atIndex < 0 || strings.EqualFold(command[atIndex+1:], bot.UserName)
+	}
+
+	if len(config.GroupTriggers) == 0 || config.HasGroupTrigger(GroupTriggerAlways) {
+		return true
+	}
+
+	if config.HasGroupTrigger(GroupTriggerReply) && msg.ReplyToMessage != nil && msg.ReplyToMessage.From != nil &&
+		msg.ReplyToMessage.From.ID == bot.ID {
+		return true
+	}
+
+	if config.HasGroupTrigger(GroupTriggerMention) && isBotMentioned(appContext, msg) {
+		return true
+	}
+
+	if config.HasGroupTrigger(GroupTriggerPrefix) && config.GroupTriggerPrefix != "" &&
+		strings.HasPrefix(msg.Text, config.GroupTriggerPrefix) {
+		return true
+	}
+
+	return false
+}
+
+func isBotMentioned(appContext *AppContext, msg *tgbotapi.Message) bool {
+	bot := appContext.TelegramBot.Self
+
+	for _, entity := range msg.Entities {
+		if entity.Type == "text_mention" && entity.User != nil && entity.User.ID == bot.ID {
+			return true
+		}
+	}
+
+	return bot.UserName != "" && strings.Contains(strings.ToLower(msg.Text), "@"+strings.ToLower(bot.UserName))
+}
+
+// stripGroupTrigger removes the trigger prefix and bot mentions, so they are not sent to the model
+func stripGroupTrigger(appContext *AppContext, text string) string {
+	prefix := appContext.Config.GroupTriggerPrefix
+	if prefix != "" && appContext.Config.HasGroupTrigger(GroupTriggerPrefix) {
+		text = strings.TrimPrefix(text, prefix)
+	}
+
+	userName := appContext.TelegramBot.Self.UserName
+	if userName != "" {
+		mention := "@" + strings.ToLower(userName)
+		for {
+			index := strings.Index(strings.ToLower(text), mention)
+			if index < 0 {
+				break
+			}
+
+			text = text[:index] + text[index+len(mention):]
+		}
+	}
+
+	return strings.TrimSpace(text)
+}
+
+// formatGroupMessage prefixes the text with the sender name if group context is stored, so the model can tell
+// group members apart
+func formatGroupMessage(appContext *AppContext, msg *tgbotapi.Message, text string) string {
+	if !appContext.Config.GroupStoreContext {
+		return text
+	}
+
+	return fmt.Sprintf("%s: %s", GetFormattedSenderName(msg), text)
+}
+
+// storeGroupMessage saves a message the bot does not answer, so it knows what the group was talking about
+func storeGroupMessage(appContext *AppContext, dialogId string, msg *tgbotapi.Message) {
+	if !appContext.Config.GroupStoreContext || msg.Text == "" {
+		return
+	}
+
+	// a message that does not reply to a thread would start a dialog of its own, which is never answered
+	isThread := appContext.Config.DialogContextTrackingMode == DialogContextTrackingModeThread
+	if isThread && dialogId == newThreadDialogId(msg) {
+		return
+	}
+
+	err := appContext.Database.AddDialogMessage(dialogId, &protos.DialogMessage{
+		Role:               openai.ChatMessageRoleUser,
+		Content:            formatGroupMessage(appContext, msg, msg.Text),
+		TelegramMessageIds: []int64{int64(msg.MessageID)},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to save group message")
+		return
+	}
+
+	trackDialogMessages(appContext, dialogId, msg.Chat.ID, msg.MessageID)
+}
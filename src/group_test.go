@@ -0,0 +1,122 @@
+package src
+
+import (
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"reflect"
+	"testing"
+)
+
+func TestGroupIgnoresUnaddressedMessages(t *testing.T) {
+	h := newTestHarness(t, withGroupTriggers)
+	h.inGroup()
+
+	h.sendText("Hi everyone")
+
+	if h.openai.chatRequestCount() != 0 {
+		t.Errorf("expected no chat requests, got %d", h.openai.chatRequestCount())
+	}
+
+	if got := h.dialog(); len(got) != 0 {
+		t.Errorf("expected empty dialog, got %q", got)
+	}
+}
+
+func TestGroupTriggers(t *testing.T) {
+	h := newTestHarness(t, withGroupTriggers)
+	h.inGroup()
+
+	h.sendText("@test_bot what time is it?")
+	h.sendText("bot, what day is it?")
+
+	answer := h.sentMessage(h.telegram.lastCallTo("sendMessage"))
+	answer.From = &tgbotapi.User{ID: fakeBotId, IsBot: true, UserName: "test_bot"}
+	h.sendReply("and tomorrow?", answer)
+
+	if h.openai.chatRequestCount() != 3 {
+		t.Fatalf("expected 3 chat requests, got %d", h.openai.chatRequestCount())
+	}
+
+	expected := []string{
+		"user: what time is it?", "assistant: " + fakeReplyText,
+		"user: what day is it?", "assistant: " + fakeReplyText,
+		"user: and tomorrow?", "assistant: " + fakeReplyText,
+	}
+	if got := h.dialog(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected dialog %q, got %q", expected, got)
+	}
+}
+
+func TestGroupCommandToAnotherBot(t *testing.T) {
+	h := newTestHarness(t, withGroupTriggers)
+	h.inGroup()
+
+	h.sendText("/imagine@other_bot a cat")
+	h.sendText("/imagine@test_bot a dog")
+
+	if len(h.openai.imageRequests) != 1 || h.openai.imageRequests[0].Prompt != "a dog" {
+		t.Errorf("expected only the command to this bot to be handled, got %v", h.openai.imageRequests)
+	}
+}
+
+func TestGroupStoresContext(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		withGroupTriggers(config)
+		config.GroupStoreContext = true
+	})
+	h.inGroup()
+
+	h.sendText("Let's meet at 5")
+
+	h.user = &tgbotapi.User{ID: 43, UserName: "other_user"}
+	h.sendText("@test_bot when do we meet?")
+
+	if h.openai.chatRequestCount() != 1 {
+		t.Fatalf("expected a chat request, got %d", h.openai.chatRequestCount())
+	}
+
+	messages := h.openai.lastChatRequest().Messages
+	if len(messages) != 2 || messages[0].Content != "@test_user (#42): Let's meet at 5" ||
+		messages[1].Content != "@other_user (#43): when do we meet?" {
+		t.Errorf("expected group messages with sender names, got %v", messages)
+	}
+}
+
+func TestGroupStoresContextInThreads(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		withGroupTriggers(config)
+		config.DialogContextTrackingMode = DialogContextTrackingModeThread
+		config.GroupStoreContext = true
+	})
+	h.inGroup()
+
+	h.sendText("@test_bot when do we meet?")
+	answer := h.sentMessage(h.telegram.lastCallTo("sendMessage"))
+	// replies to other group members are not addressed to the bot
+	answer.From = &tgbotapi.User{ID: 43, UserName: "other_user"}
+
+	// a message outside of threads is not saved into a thread of its own
+	greeting := h.sendText("Hi everyone")
+	if got, _ := h.appContext.Database.GetDialog(newThreadDialogId(greeting)); len(got) != 0 {
+		t.Errorf("expected no dialog for an unaddressed message, got %v", got)
+	}
+
+	// a reply into the thread is saved, and replies to it continue the thread
+	note := h.sendReply("Let's meet at 5", answer)
+	h.sendReply("@test_bot so when?", note)
+
+	if h.openai.chatRequestCount() != 2 {
+		t.Fatalf("expected 2 chat requests, got %d", h.openai.chatRequestCount())
+	}
+
+	expected := []string{
+		"@test_user (#42): when do we meet?", fakeReplyText,
+		"@test_user (#42): Let's meet at 5", "@test_user (#42): so when?",
+	}
+	var got []string
+	for _, msg := range h.openai.lastChatRequest().Messages {
+		got = append(got, msg.Content)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected thread messages %q, got %q", expected, got)
+	}
+}
@@ -0,0 +1,270 @@
+package src
+
+import (
+	"fmt"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testUserId = 42
+const testChatId = 42
+
+// fakeFFmpeg copies the input file to the output, so voice messages can be decoded without real ffmpeg
+const fakeFFmpeg = `#!/bin/sh
+input=""
+while [ "$#" -gt 1 ]; do
+	if [ "$1" = "-i" ]; then
+		input="$2"
+	fi
+	shift
+done
+cp "$input" "$1"
+`
+
+// testHarness drives the bot with updates, talking to fake Telegram and OpenAI servers
+type testHarness struct {
+	t          *testing.T
+	appContext *AppContext
+	telegram   *fakeTelegram
+	openai     *fakeOpenAI
+
+	// chat new messages are sent to
+	chat *tgbotapi.Chat
+	// author of new messages
+	user *tgbotapi.User
+
+	lastUpdateId  int
+	lastMessageId int
+}
+
+func newTestHarness(t *testing.T, configure func(config *Config)) *testHarness {
+	telegram := newFakeTelegram(t)
+	openAI := newFakeOpenAI(t)
+
+	config := &Config{
+		TelegramToken:             "123:test",
+		TelegramApiEndpoint:       telegram.apiEndpoint(),
+		TelegramFileEndpoint:      telegram.fileEndpoint(),
+		OpenAIApiKey:              "test",
+		OpenAIBaseURL:             openAI.baseURL(),
+		DialogContextTrackingMode: DialogContextTrackingModeUser,
+		DecodeVoice:               true,
+		AnswerVoice:               true,
+		GenerateImages:            true,
+		// waiting for Telegram limits would only slow tests down, tests of the limits set them
+		TelegramLimits: TelegramLimits{MessagesPerSecond: 1000, ChatMessagesPerSecond: 1000, GroupMessagesPerMinute: 60000},
+	}
+
+	if configure != nil {
+		configure(config)
+	}
+
+	// outbound messages are limited per process
+	telegramLimiter.Lock()
+	telegramLimiter.global = time.Time{}
+	telegramLimiter.chats = make(map[int64]time.Time)
+	telegramLimiter.Unlock()
+
+	// health is tracked per process
+	botHealth.Lock()
+	botHealth.polling = false
+	botHealth.lastPollAt = time.Time{}
+	botHealth.shuttingDown = false
+	botHealth.Unlock()
+
+	// memberships are cached per process
+	chatMemberCache.Lock()
+	chatMemberCache.m = make(map[string]chatMemberCacheEntry)
+	chatMemberCache.Unlock()
+
+	// handles of buttons are cached per process, but stored per database
+	callbackHandles.Lock()
+	callbackHandles.m = make(map[string]string)
+	callbackHandles.Unlock()
+
+	binDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(binDir, "ffmpeg"), []byte(fakeFFmpeg), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("TMPDIR", t.TempDir())
+
+	appContext, err := NewAppContextWithConfig(config, t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create app context: %s", err)
+	}
+
+	t.Cleanup(func() {
+		_ = appContext.Database.Close()
+	})
+
+	return &testHarness{
+		t:             t,
+		appContext:    appContext,
+		telegram:      telegram,
+		openai:        openAI,
+		chat:          &tgbotapi.Chat{ID: testChatId, Type: "private"},
+		user:          &tgbotapi.User{ID: testUserId, UserName: "test_user", FirstName: "Test"},
+		lastMessageId: 100,
+	}
+}
+
+// withAccessControl is an option of newTestHarness that makes `testAdminId` an admin and restricts access to allowed
+// users
+func withAccessControl(config *Config) {
+	config.Admins = []int64{testAdminId}
+	config.RestrictAccess = true
+}
+
+// withGroupTriggers is an option of newTestHarness that tracks dialogs per chat and answers mentions, replies and
+// messages starting with `bot,` in groups
+func withGroupTriggers(config *Config) {
+	config.DialogContextTrackingMode = DialogContextTrackingModeChat
+	config.GroupTriggers = []string{GroupTriggerMention, GroupTriggerReply, GroupTriggerPrefix}
+	config.GroupTriggerPrefix = "bot,"
+}
+
+// withPersonas is an option of newTestHarness that adds personas with and without their own model and temperature
+func withPersonas(config *Config) {
+	coderTemperature, preciseTemperature := float32(0.1), float32(0)
+
+	config.Personas = []Persona{
+		{Name: "pirate", SystemPrompt: "Talk like a pirate"},
+		{Name: "coder", SystemPrompt: "Answer with code", Model: "gpt-4", Temperature: &coderTemperature},
+		{Name: "precise", SystemPrompt: "Answer precisely", Temperature: &preciseTemperature},
+	}
+}
+
+// withFastRetries is an option of newTestHarness that shortens delays between retries
+func withFastRetries(config *Config) {
+	config.Retry.InitialDelayMillis = 10
+}
+
+// withTelegramLimits is an option of newTestHarness that restores the default Telegram limits
+func withTelegramLimits(config *Config) {
+	config.TelegramLimits = TelegramLimits{}
+}
+
+// inGroup makes new messages come from a group
+func (h *testHarness) inGroup() {
+	h.chat = &tgbotapi.Chat{ID: -100, Type: "supergroup", Title: "Team"}
+}
+
+func (h *testHarness) newMessage() *tgbotapi.Message {
+	h.lastMessageId++
+
+	return &tgbotapi.Message{
+		MessageID: h.lastMessageId,
+		From:      h.user,
+		Date:      int(time.Now().Unix()),
+		Chat:      h.chat,
+	}
+}
+
+func (h *testHarness) handle(update tgbotapi.Update) {
+	h.lastUpdateId++
+	update.UpdateID = h.lastUpdateId
+
+	handleUpdate(h.appContext, update)
+}
+
+// sendText sends a text message, text starting with a slash is sent as a command
+func (h *testHarness) sendText(text string) *tgbotapi.Message {
+	return h.sendReply(text, nil)
+}
+
+func (h *testHarness) sendReply(text string, replyTo *tgbotapi.Message) *tgbotapi.Message {
+	msg := h.newMessage()
+	msg.Text = text
+	msg.ReplyToMessage = replyTo
+
+	if strings.HasPrefix(text, "/") {
+		commandLength := len(strings.SplitN(text, " ", 2)[0])
+		msg.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: commandLength}}
+	}
+
+	h.handle(tgbotapi.Update{Message: msg})
+
+	return msg
+}
+
+func (h *testHarness) sendVoice(fileId string, content []byte) *tgbotapi.Message {
+	h.telegram.addFile(fileId, content)
+
+	msg := h.newMessage()
+	msg.Voice = &tgbotapi.Voice{FileID: fileId, FileUniqueID: fileId, Duration: 1, MimeType: "audio/ogg"}
+
+	h.handle(tgbotapi.Update{Message: msg})
+
+	return msg
+}
+
+// sendDocument sends a file with the caption
+func (h *testHarness) sendDocument(fileName string, content []byte, caption string) *tgbotapi.Message {
+	fileId := fmt.Sprintf("document%d", h.lastMessageId)
+	h.telegram.addFile(fileId, content)
+
+	msg := h.newMessage()
+	msg.Caption = caption
+	msg.Document = &tgbotapi.Document{FileID: fileId, FileUniqueID: fileId, FileName: fileName, FileSize: len(content)}
+
+	h.handle(tgbotapi.Update{Message: msg})
+
+	return msg
+}
+
+// pressButton presses an inline button with the callback data under the message
+func (h *testHarness) pressButton(data string, message *tgbotapi.Message) {
+	h.handle(tgbotapi.Update{
+		CallbackQuery: &tgbotapi.CallbackQuery{
+			ID:      "query",
+			From:    h.user,
+			Message: message,
+			Data:    data,
+		},
+	})
+}
+
+// sentMessage returns a message as the bot sent it, so it can be used in callback queries
+func (h *testHarness) sentMessage(call fakeTelegramCall) *tgbotapi.Message {
+	return &tgbotapi.Message{
+		MessageID: call.MessageID,
+		From:      &tgbotapi.User{ID: fakeBotId, IsBot: true},
+		Chat:      h.chat,
+		Text:      call.Params.Get("text"),
+	}
+}
+
+func (h *testHarness) dialog() []string {
+	dialogId := GetDialogId(h.appContext, &tgbotapi.Update{Message: h.newMessage()})
+
+	dialogMessages, err := h.appContext.Database.GetDialog(dialogId)
+	if err != nil {
+		h.t.Fatalf("failed to get dialog: %s", err)
+	}
+
+	var result []string
+	for _, msg := range dialogMessages {
+		result = append(result, msg.Role+": "+msg.Content)
+	}
+
+	return result
+}
+
+// waitFor polls the condition until it is met, failing the test after the timeout
+func waitFor(t *testing.T, condition func() bool, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition was not met in time")
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,130 @@
+package src
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// long polling returns at least every 60 seconds, so a poll is late if there was none for longer
+const maxTelegramPollAge = 2 * time.Minute
+
+const metricsShutdownTimeout = 5 * time.Second
+
+var (
+	botHealth = struct {
+		sync.Mutex
+		// updates are received with polling, not with a webhook
+		polling      bool
+		lastPollAt   time.Time
+		shuttingDown bool
+	}{}
+)
+
+// startPollHealth makes readiness depend on successful polls, the bot is ready until the first poll is late
+func startPollHealth() {
+	botHealth.Lock()
+	defer botHealth.Unlock()
+
+	botHealth.polling = true
+	botHealth.lastPollAt = time.Now()
+}
+
+func recordTelegramPoll() {
+	botHealth.Lock()
+	defer botHealth.Unlock()
+
+	botHealth.lastPollAt = time.Now()
+}
+
+func setShuttingDown() {
+	botHealth.Lock()
+	defer botHealth.Unlock()
+
+	botHealth.shuttingDown = true
+}
+
+// checkReadiness returns the reason the bot can't handle updates, or an empty string if it can
+func checkReadiness(appContext *AppContext) string {
+	err := appContext.Database.Ping()
+	if err != nil {
+		return fmt.Sprintf("database: %s", err)
+	}
+
+	botHealth.Lock()
+	defer botHealth.Unlock()
+
+	if botHealth.shuttingDown {
+		return "shutting down"
+	}
+
+	if pollAge := time.Since(botHealth.lastPollAt); botHealth.polling && pollAge > maxTelegramPollAge {
+		return fmt.Sprintf("last successful Telegram poll was %s ago", pollAge.Round(time.Second))
+	}
+
+	return ""
+}
+
+func newMetricsHandler(appContext *AppContext) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteMetrics(w)
+	})
+
+	// the process is alive as long as its database is usable
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		err := appContext.Database.Ping()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("database: %s", err), http.StatusServiceUnavailable)
+			return
+		}
+
+		_, _ = fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if reason := checkReadiness(appContext); reason != "" {
+			http.Error(w, reason, http.StatusServiceUnavailable)
+			return
+		}
+
+		_, _ = fmt.Fprintln(w, "ok")
+	})
+
+	return mux
+}
+
+// StartMetricsServer serves metrics and health checks if the listen address is set. The returned function stops
+// the server.
+func StartMetricsServer(appContext *AppContext) func() {
+	listenAddress := appContext.Config.MetricsListenAddress
+	if listenAddress == "" {
+		return func() {}
+	}
+
+	server := &http.Server{Addr: listenAddress, Handler: newMetricsHandler(appContext)}
+
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal().Err(err).Msg("Failed to serve metrics")
+		}
+	}()
+
+	log.Info().Str("address", listenAddress).Msg("Serving metrics and health checks")
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+		defer cancel()
+
+		err := server.Shutdown(ctx)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to stop metrics server")
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package src
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getHealthEndpoint(t *testing.T, h *testHarness, path string) (int, string) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	newMetricsHandler(h.appContext).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+	return rec.Code, rec.Body.String()
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	h.sendText("Hi")
+
+	code, body := getHealthEndpoint(t, h, "/metrics")
+	if code != http.StatusOK {
+		t.Fatalf("expected metrics to be served, got %d", code)
+	}
+
+	for _, expected := range []string{
+		"# TYPE bot_updates_received_total counter",
+		`bot_updates_received_total{type="message"}`,
+		`bot_openai_request_duration_seconds_count{endpoint="chat",model="gpt-3.5-turbo"}`,
+		"bot_active_streams 0",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected metrics to contain %q, got:\n%s", expected, body)
+		}
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	if code, _ := getHealthEndpoint(t, h, "/healthz"); code != http.StatusOK {
+		t.Errorf("expected the bot to be healthy, got %d", code)
+	}
+
+	if code, _ := getHealthEndpoint(t, h, "/readyz"); code != http.StatusOK {
+		t.Errorf("expected the bot to be ready, got %d", code)
+	}
+
+	botHealth.Lock()
+	botHealth.polling = true
+	botHealth.lastPollAt = time.Now().Add(-maxTelegramPollAge - time.Minute)
+	botHealth.Unlock()
+
+	if code, body := getHealthEndpoint(t, h, "/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "Telegram poll") {
+		t.Errorf("expected the bot not to be ready after a late poll, got %d %q", code, body)
+	}
+
+	recordTelegramPoll()
+
+	if code, _ := getHealthEndpoint(t, h, "/readyz"); code != http.StatusOK {
+		t.Errorf("expected the bot to be ready after a poll, got %d", code)
+	}
+
+	_ = h.appContext.Database.Close()
+
+	if code, body := getHealthEndpoint(t, h, "/healthz"); code != http.StatusServiceUnavailable || !strings.HasPrefix(body, "database") {
+		t.Errorf("expected the bot not to be healthy with a closed database, got %d %q", code, body)
+	}
+
+	if code, _ := getHealthEndpoint(t, h, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected the bot not to be ready with a closed database, got %d", code)
+	}
+}
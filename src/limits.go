@@ -0,0 +1,209 @@
+package src
+
+import (
+	"fmt"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// messages per minute are counted in minute windows, counters are kept a bit longer than the window
+const rateWindowFormat = "2006-01-02T15:04"
+const rateCounterTTL = 2 * time.Minute
+
+// limitedRequest is what a message or a button asks the bot to do, it is checked against limits before
+// any OpenAI request is made
+type limitedRequest struct {
+	// Message is a request for a chat completion, it is counted as a message per minute and needs tokens
+	Message bool
+	// Queued messages may be merged into one OpenAI request, so they are counted as a message per minute when taken
+	// from the queue instead, see `countQueuedMessages`
+	Queued       bool
+	Images       int64
+	VoiceSeconds int64
+}
+
+type limitScope struct {
+	scope  string
+	limits Limits
+	// subject is who has reached the limit in the message to the user
+	subject string
+}
+
+func getLimitScopes(appContext *AppContext, user *tgbotapi.User, chat *tgbotapi.Chat) []limitScope {
+	scopes := []limitScope{{
+		scope:   getUserUsageScope(user.ID),
+		limits:  appContext.Config.GetUserLimits(user.ID, user.UserName),
+		subject: "You have",
+	}}
+
+	if chat.IsGroup() || chat.IsSuperGroup() {
+		scopes = append(scopes, limitScope{
+			scope:   getChatUsageScope(chat.ID),
+			limits:  appContext.Config.GetGroupLimits(chat.ID),
+			subject: "This chat has",
+		})
+	}
+
+	return scopes
+}
+
+// getMessageRequest returns what the message asks for. Commands that don't call OpenAI are not limited.
+func getMessageRequest(appContext *AppContext, msg *tgbotapi.Message) limitedRequest {
+	switch msg.Command() {
+	case "imagine":
+		if !appContext.Config.GenerateImages {
+			return limitedRequest{}
+		}
+
+		return limitedRequest{Images: 1}
+	case "edit":
+		return limitedRequest{Message: true}
+	case "":
+	default:
+		return limitedRequest{}
+	}
+
+	if msg.Document != nil {
+		return limitedRequest{}
+	}
+
+	if msg.Voice != nil {
+		if !appContext.Config.DecodeVoice {
+			return limitedRequest{}
+		}
+
+		return limitedRequest{Message: appContext.Config.AnswerVoice, VoiceSeconds: int64(msg.Voice.Duration)}
+	}
+
+	return limitedRequest{Message: true}
+}
+
+// getCallbackRequest returns what the button asks for, only answer actions and summarizing call OpenAI
+func getCallbackRequest(action string, arg string) limitedRequest {
+	if action == callbackActionRegenerate || action == callbackActionContinue ||
+		(action == callbackActionContextLimit && arg == contextLimitSummarize) {
+		return limitedRequest{Message: true}
+	}
+
+	return limitedRequest{}
+}
+
+// checkLimits checks the request against limits of the user and of the group chat, and counts it as a message.
+// Returns a message saying which limit has been reached and when it resets, or an empty string.
+// Failing to read counters doesn't block the request.
+func checkLimits(appContext *AppContext, request limitedRequest, user *tgbotapi.User, chat *tgbotapi.Chat) string {
+	if user == nil || chat == nil {
+		return ""
+	}
+
+	now := time.Now().UTC()
+	scopes := getLimitScopes(appContext, user, chat)
+
+	for _, scope := range scopes {
+		text, err := checkDailyLimits(appContext, scope, request, now)
+		if err != nil {
+			log.Error().Err(err).Str("scope", scope.scope).Msg("Failed to check daily limits")
+			continue
+		}
+
+		if text != "" {
+			return text
+		}
+	}
+
+	if !request.Message || request.Queued {
+		return ""
+	}
+
+	return countMessage(appContext, scopes, now)
+}
+
+// countQueuedMessages counts messages taken from the queue together as one message per minute, as they are answered
+// with one request. The request is counted for the sender of the first message asking for an answer. Returns a message saying which
+// limit has been reached, or an empty string.
+func countQueuedMessages(appContext *AppContext, msgs []*tgbotapi.Message) string {
+	for _, msg := range msgs {
+		if msg.From == nil || !getMessageRequest(appContext, msg).Message {
+			continue
+		}
+
+		return countMessage(appContext, getLimitScopes(appContext, msg.From, msg.Chat), time.Now().UTC())
+	}
+
+	return ""
+}
+
+// countMessage counts a message per minute in every scope, unless one of them has reached its limit
+func countMessage(appContext *AppContext, scopes []limitScope, now time.Time) string {
+	keys := make([]string, len(scopes))
+	limits := make([]int64, len(scopes))
+	for i, scope := range scopes {
+		keys[i] = scope.scope
+		limits[i] = scope.limits.MessagesPerMinute
+	}
+
+	exceededScope, err := appContext.Database.AddRequestCount(keys, limits, now.Format(rateWindowFormat), rateCounterTTL)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to count request")
+		return ""
+	}
+
+	for _, scope := range scopes {
+		if scope.scope == exceededScope {
+			resetIn := now.Truncate(time.Minute).Add(time.Minute).Sub(now)
+
+			return fmt.Sprintf("⏳ %s reached the limit of %d messages per minute. Please try again in %s.",
+				scope.subject, scope.limits.MessagesPerMinute, formatResetDuration(resetIn))
+		}
+	}
+
+	return ""
+}
+
+func checkDailyLimits(appContext *AppContext, scope limitScope, request limitedRequest, now time.Time) (string, error) {
+	limits := scope.limits
+	if limits.TokensPerDay == 0 && limits.ImagesPerDay == 0 && limits.VoiceMinutesPerDay == 0 {
+		return "", nil
+	}
+
+	usage, err := appContext.Database.GetUsage(scope.scope, now.Format(usageDayFormat))
+	if err != nil {
+		return "", err
+	}
+
+	total := sumUsage(usage)
+
+	limit := ""
+	if request.Message && limits.TokensPerDay > 0 && total.PromptTokens+total.CompletionTokens >= limits.TokensPerDay {
+		limit = fmt.Sprintf("%d tokens", limits.TokensPerDay)
+	} else if request.Images > 0 && limits.ImagesPerDay > 0 && total.Images+request.Images > limits.ImagesPerDay {
+		limit = fmt.Sprintf("%d images", limits.ImagesPerDay)
+	} else if request.VoiceSeconds > 0 && limits.VoiceMinutesPerDay > 0 &&
+		float64(total.AudioSeconds+request.VoiceSeconds) > limits.VoiceMinutesPerDay*60 {
+		limit = fmt.Sprintf("%g voice minutes", limits.VoiceMinutesPerDay)
+	}
+
+	if limit == "" {
+		return "", nil
+	}
+
+	resetAt := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+
+	return fmt.Sprintf("⏳ %s reached the daily limit of %s. It resets at 00:00 UTC, in %s.",
+		scope.subject, limit, formatResetDuration(resetAt.Sub(now))), nil
+}
+
+func formatResetDuration(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%ds", int((d+time.Second-1)/time.Second))
+	}
+
+	// durations are rounded up, so the limit has surely reset by then
+	minutes := int((d + time.Minute - 1) / time.Minute)
+	if minutes < 60 {
+		return fmt.Sprintf("%dm", minutes)
+	}
+
+	return fmt.Sprintf("%dh %dm", minutes/60, minutes%60)
+}
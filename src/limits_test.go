@@ -0,0 +1,132 @@
+package src
+
+import (
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessagesPerMinuteLimit(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.UserLimits = Limits{MessagesPerMinute: 1}
+	})
+
+	h.sendText("Hi")
+	h.sendText("Hi again")
+
+	if h.openai.chatRequestCount() != 1 {
+		t.Errorf("expected only the first message to be answered, got %d requests", h.openai.chatRequestCount())
+	}
+
+	got := h.telegram.lastCallTo("sendMessage").Params.Get("text")
+	if !strings.HasPrefix(got, "⏳ You have reached the limit of 1 messages per minute. Please try again in ") {
+		t.Errorf("expected a rate limit message, got %q", got)
+	}
+
+	h.sendText("/usage")
+
+	if !strings.Contains(h.telegram.lastCallTo("sendMessage").Params.Get("text"), "Usage of") {
+		t.Errorf("expected commands not calling the model to be allowed")
+	}
+}
+
+func TestDailyLimits(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.UserLimits = Limits{TokensPerDay: 15}
+	})
+
+	h.sendText("Hi")
+	h.sendText("Hi again")
+
+	if h.openai.chatRequestCount() != 1 {
+		t.Errorf("expected only the first message to be answered, got %d requests", h.openai.chatRequestCount())
+	}
+
+	got := h.telegram.lastCallTo("sendMessage").Params.Get("text")
+	if !strings.HasPrefix(got, "⏳ You have reached the daily limit of 15 tokens. It resets at 00:00 UTC, in ") {
+		t.Errorf("expected a token limit message, got %q", got)
+	}
+
+	h = newTestHarness(t, func(config *Config) {
+		config.UserLimits = Limits{ImagesPerDay: 1, VoiceMinutesPerDay: 0.02}
+		config.AnswerVoice = false
+	})
+
+	h.sendText("/imagine A cat")
+	h.sendText("/imagine A dog")
+
+	if len(h.openai.imageRequests) != 1 {
+		t.Errorf("expected one image to be generated, got %d", len(h.openai.imageRequests))
+	}
+
+	h.sendVoice("voice1", []byte("ogg"))
+	h.sendVoice("voice2", []byte("ogg"))
+
+	if h.openai.transcriptionRequests != 1 {
+		t.Errorf("expected one voice message to be decoded, got %d", h.openai.transcriptionRequests)
+	}
+}
+
+func TestGroupLimits(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		withGroupTriggers(config)
+		config.GroupLimits = Limits{MessagesPerMinute: 1}
+		config.LimitOverrides = map[string]Limits{"-200": {}}
+	})
+	h.inGroup()
+
+	h.sendText("bot, hi")
+
+	h.user = &tgbotapi.User{ID: testUserId + 1, UserName: "other_user"}
+	h.sendText("bot, hi")
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); !strings.HasPrefix(got, "⏳ This chat has reached the limit") {
+		t.Errorf("expected the chat limit message, got %q", got)
+	}
+
+	h.chat = &tgbotapi.Chat{ID: -200, Type: "supergroup", Title: "Unlimited"}
+	h.sendText("bot, hi")
+	h.sendText("bot, hi")
+
+	if h.openai.chatRequestCount() != 3 {
+		t.Errorf("expected messages in the chat with overridden limits to be answered, got %d requests", h.openai.chatRequestCount())
+	}
+}
+
+func TestLimitsPersist(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	for i := 0; i < 2; i++ {
+		exceeded, err := h.appContext.Database.AddRequestCount([]string{"user:1"}, []int64{2}, "window", time.Minute)
+		if err != nil || exceeded != "" {
+			t.Fatalf("expected request %d to be counted, got %q, %v", i, exceeded, err)
+		}
+	}
+
+	exceeded, err := h.appContext.Database.AddRequestCount([]string{"user:2", "user:1"}, []int64{0, 2}, "window", time.Minute)
+	if err != nil || exceeded != "user:1" {
+		t.Errorf("expected the limit to be reached, got %q, %v", exceeded, err)
+	}
+
+	exceeded, err = h.appContext.Database.AddRequestCount([]string{"user:2"}, []int64{1}, "window", time.Minute)
+	if err != nil || exceeded != "" {
+		t.Errorf("expected requests not to be counted when a limit is reached, got %q, %v", exceeded, err)
+	}
+}
+
+func TestFormatResetDuration(t *testing.T) {
+	cases := map[time.Duration]string{
+		300 * time.Millisecond:       "1s",
+		42 * time.Second:             "42s",
+		time.Minute:                  "1m",
+		90 * time.Second:             "2m",
+		5*time.Hour + 12*time.Minute: "5h 12m",
+	}
+
+	for d, expected := range cases {
+		if got := formatResetDuration(d); got != expected {
+			t.Errorf("expected %s to be formatted as %q, got %q", d, expected, got)
+		}
+	}
+}
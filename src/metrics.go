@@ -0,0 +1,230 @@
+package src
+
+import (
+	"fmt"
+	"github.com/sashabaranov/go-openai"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics are exposed in Prometheus text format. The format is simple enough to be written without a client library.
+
+const metricsLabelSeparator = "\xff"
+
+var metricsRegistry []*metric
+
+var (
+	updatesReceived = newCounter("bot_updates_received_total",
+		"Updates received from Telegram by type.", "type")
+	commandsHandled = newCounter("bot_commands_total",
+		"Commands handled by name, unknown commands are counted as `unknown`.", "command")
+	openAIRequestDuration = newHistogram("bot_openai_request_duration_seconds",
+		"Duration of OpenAI requests by endpoint and model, streams are measured until their first part.",
+		[]float64{0.25, 0.5, 1, 2.5, 5, 10, 20, 40, 80}, "endpoint", "model")
+	openAIErrors = newCounter("bot_openai_errors_total",
+		"Failed OpenAI requests by endpoint and model, each retry is counted.", "endpoint", "model")
+	tokensUsed = newCounter("bot_tokens_used_total",
+		"Tokens used by model and type, streamed replies are estimated.", "model", "type")
+	telegramSendFailures = newCounter("bot_telegram_send_failures_total",
+		"Messages that failed to be sent or edited after retries, by Telegram error code.", "code")
+	activeStreams = newGauge("bot_active_streams",
+		"Replies being streamed.")
+	dialogBusyUpdates = newCounter("bot_dialog_busy_updates_total",
+		"Messages and button presses queued because their dialog was busy.")
+)
+
+// models that are not configured are counted as this, as any model can be selected if `models` list is empty, and
+// every selected model would add series
+const otherModelLabel = "other"
+
+// getModelLabel returns the model as a label value, only configured models and models of images and voice
+// are counted by name
+func getModelLabel(config *Config, model string) string {
+	if config.IsModelConfigured(model) || model == openai.Whisper1 || strings.HasPrefix(model, "dall-e-") {
+		return model
+	}
+
+	return otherModelLabel
+}
+
+// metric is a family of series with the same name, one per combination of label values
+type metric struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	// histograms only, counts are not cumulative
+	bucketCounts []uint64
+	count        uint64
+}
+
+func newMetric(name string, help string, kind string, buckets []float64, labelNames []string) *metric {
+	m := &metric{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     make(map[string]*metricSeries),
+	}
+
+	metricsRegistry = append(metricsRegistry, m)
+
+	return m
+}
+
+func newCounter(name string, help string, labelNames ...string) *metric {
+	return newMetric(name, help, "counter", nil, labelNames)
+}
+
+func newGauge(name string, help string, labelNames ...string) *metric {
+	return newMetric(name, help, "gauge", nil, labelNames)
+}
+
+func newHistogram(name string, help string, buckets []float64, labelNames ...string) *metric {
+	return newMetric(name, help, "histogram", buckets, labelNames)
+}
+
+// getSeries returns the series with the label values, the metric has to be locked
+func (m *metric) getSeries(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, metricsLabelSeparator)
+
+	series, ok := m.series[key]
+	if !ok {
+		series = &metricSeries{labelValues: labelValues, bucketCounts: make([]uint64, len(m.buckets))}
+		m.series[key] = series
+	}
+
+	return series
+}
+
+func (m *metric) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+func (m *metric) dec(labelValues ...string) {
+	m.add(-1, labelValues...)
+}
+
+func (m *metric) add(value float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.getSeries(labelValues).value += value
+}
+
+// observe adds the value to a histogram
+func (m *metric) observe(value float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	series := m.getSeries(labelValues)
+	series.value += value
+	series.count++
+
+	for i, bound := range m.buckets {
+		if value <= bound {
+			series.bucketCounts[i]++
+			break
+		}
+	}
+}
+
+func (m *metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, escapeMetricHelp(m.help), m.name, m.kind)
+
+	// metrics without labels are always exposed, so they are seen before they change
+	if len(m.labelNames) == 0 {
+		m.getSeries(nil)
+	}
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series := m.series[key]
+
+		if m.kind != "histogram" {
+			_, _ = fmt.Fprintf(w, "%s%s %s\n", m.name, formatMetricLabels(m.labelNames, series.labelValues, ""), formatMetricValue(series.value))
+			continue
+		}
+
+		var cumulative uint64
+		for i, bound := range m.buckets {
+			cumulative += series.bucketCounts[i]
+			labels := formatMetricLabels(m.labelNames, series.labelValues, formatMetricValue(bound))
+			_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labels, cumulative)
+		}
+
+		labels := formatMetricLabels(m.labelNames, series.labelValues, "+Inf")
+		_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labels, series.count)
+
+		labels = formatMetricLabels(m.labelNames, series.labelValues, "")
+		_, _ = fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labels, formatMetricValue(series.value))
+		_, _ = fmt.Fprintf(w, "%s_count%s %d\n", m.name, labels, series.count)
+	}
+}
+
+// WriteMetrics writes all metrics in Prometheus text format
+func WriteMetrics(w io.Writer) {
+	for _, m := range metricsRegistry {
+		m.write(w)
+	}
+}
+
+// formatMetricLabels formats label pairs, with `le` label of a histogram bucket if it is not empty
+func formatMetricLabels(names []string, values []string, le string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escapeMetricLabel(values[i])))
+	}
+
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf(`le="%s"`, le))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeMetricLabel(value string) string {
+	return metricLabelEscaper.Replace(value)
+}
+
+var metricHelpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeMetricHelp(help string) string {
+	return metricHelpEscaper.Replace(help)
+}
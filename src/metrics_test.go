@@ -0,0 +1,135 @@
+package src
+
+import (
+	"bytes"
+	"github.com/sashabaranov/go-openai"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// get returns the value of a counter or a gauge, or the sum of a histogram, zero for series not seen yet
+func (m *metric) get(labelValues ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	series, ok := m.series[strings.Join(labelValues, metricsLabelSeparator)]
+	if !ok {
+		return 0
+	}
+
+	return series.value
+}
+
+func TestMetricsCountUpdatesAndRequests(t *testing.T) {
+	h := newTestHarness(t, withFastRetries)
+
+	messages := updatesReceived.get("message")
+	commands := commandsHandled.get("usage")
+	unknownCommands := commandsHandled.get("unknown")
+	errors := openAIErrors.get("chat", openai.GPT3Dot5Turbo)
+	completionTokens := tokensUsed.get(openai.GPT3Dot5Turbo, "completion")
+
+	h.openai.addError(http.StatusInternalServerError, "server_error")
+	h.sendText("Hi")
+	h.sendText("/usage")
+	h.sendText("/nonexistent")
+
+	if got := updatesReceived.get("message") - messages; got != 3 {
+		t.Errorf("expected 3 messages to be counted, got %v", got)
+	}
+
+	if got := commandsHandled.get("usage") - commands; got != 1 {
+		t.Errorf("expected the command to be counted, got %v", got)
+	}
+
+	if got := commandsHandled.get("unknown") - unknownCommands; got != 1 {
+		t.Errorf("expected the unknown command to be counted as unknown, got %v", got)
+	}
+
+	if got := openAIErrors.get("chat", openai.GPT3Dot5Turbo) - errors; got != 1 {
+		t.Errorf("expected the retried error to be counted, got %v", got)
+	}
+
+	if got := tokensUsed.get(openai.GPT3Dot5Turbo, "completion") - completionTokens; got <= 0 {
+		t.Errorf("expected completion tokens to be counted, got %v", got)
+	}
+
+	if got := activeStreams.get(); got != 0 {
+		t.Errorf("expected no active streams, got %v", got)
+	}
+}
+
+func TestMetricsModelLabel(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.Model = openai.GPT4
+		config.Models = []string{openai.GPT4, "gpt-4o"}
+		config.TitleModel = "gpt-4o-mini"
+		config.Personas = []Persona{{Name: "coder", Model: "o3"}}
+	})
+
+	tests := map[string]string{
+		openai.GPT4:          openai.GPT4,
+		"gpt-4o":             "gpt-4o",
+		"gpt-4o-mini":        "gpt-4o-mini",
+		"o3":                 "o3",
+		openai.Whisper1:      openai.Whisper1,
+		"dall-e-512x512":     "dall-e-512x512",
+		"gpt-4o-2024-08-06":  otherModelLabel,
+		"made-up-model-name": otherModelLabel,
+	}
+
+	for model, expected := range tests {
+		if got := getModelLabel(h.appContext.Config, model); got != expected {
+			t.Errorf("expected %q to be labeled %q, got %q", model, expected, got)
+		}
+	}
+
+	// any model can be selected without `models` list, it is counted as other
+	h = newTestHarness(t, nil)
+	otherTokens := tokensUsed.get(otherModelLabel, "completion")
+
+	h.sendText("/model my-llama")
+	h.sendText("Hi")
+
+	if got := tokensUsed.get(otherModelLabel, "completion") - otherTokens; got <= 0 {
+		t.Errorf("expected tokens of a model that is not configured to be counted as other, got %v", got)
+	}
+
+	if got := tokensUsed.get("my-llama", "completion"); got != 0 {
+		t.Errorf("expected no series for a model that is not configured, got %v", got)
+	}
+}
+
+func TestMetricsTextFormat(t *testing.T) {
+	m := &metric{
+		name:       "test_duration_seconds",
+		help:       "Test durations.",
+		kind:       "histogram",
+		labelNames: []string{"name"},
+		buckets:    []float64{1, 5},
+		series:     make(map[string]*metricSeries),
+	}
+
+	m.observe(0.5, `say "hi"`)
+	m.observe(3, `say "hi"`)
+	m.observe(10, `say "hi"`)
+
+	out := &bytes.Buffer{}
+	m.write(out)
+
+	expected := strings.Join([]string{
+		"# HELP test_duration_seconds Test durations.",
+		"# TYPE test_duration_seconds histogram",
+		`test_duration_seconds_bucket{name="say \"hi\"",le="1"} 1`,
+		`test_duration_seconds_bucket{name="say \"hi\"",le="5"} 2`,
+		`test_duration_seconds_bucket{name="say \"hi\"",le="+Inf"} 3`,
+		`test_duration_seconds_sum{name="say \"hi\""} 13.5`,
+		`test_duration_seconds_count{name="say \"hi\""} 3`,
+		"",
+	}, "\n")
+
+	if out.String() != expected {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+}
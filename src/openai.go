@@ -3,43 +3,70 @@ package src
 import (
 	"context"
 	"errors"
+	"github.com/rs/zerolog/log"
 	"github.com/sashabaranov/go-openai"
 	"io"
+	"math"
 	"openai-telegram-bot/src/protos"
+	"strings"
+	"time"
 )
 
-func GetCompleteReply(appContext *AppContext, messages []protos.DialogMessage) (string, error) {
-	openaiMessages := make([]openai.ChatCompletionMessage, len(messages))
-	for i, msg := range messages {
-		openaiMessages[i] = openai.ChatCompletionMessage{
-			Role:    msg.Role,
-			Content: msg.Content,
-		}
+// ChatParams holds the model and sampling parameters used to request a chat completion
+type ChatParams struct {
+	Model            string
+	Temperature      float32
+	TopP             float32
+	MaxTokens        int
+	PresencePenalty  float32
+	FrequencyPenalty float32
+	SystemPrompt     string
+	// Owner is who the usage of the request is accounted to
+	Owner UsageOwner
+}
+
+// GetChatParams returns parameters from config, overridden by the persona applied to the dialog and then
+// by the model selected for the dialog
+func GetChatParams(appContext *AppContext, dialogId string) ChatParams {
+	config := appContext.Config
+
+	params := ChatParams{
+		Model:            config.GetModel(),
+		Temperature:      config.Temperature,
+		TopP:             config.TopP,
+		MaxTokens:        config.MaxTokens,
+		PresencePenalty:  config.PresencePenalty,
+		FrequencyPenalty: config.FrequencyPenalty,
 	}
 
-	resp, err := appContext.OpenAI.CreateChatCompletion(
-		context.Background(),
-		openai.ChatCompletionRequest{
-			Model:    openai.GPT3Dot5Turbo,
-			Messages: openaiMessages,
-		},
-	)
+	if persona := GetDialogPersona(appContext, dialogId); persona != nil {
+		params.SystemPrompt = persona.SystemPrompt
 
-	if err != nil {
-		if getOpenAIErrorCode(err) == "context_length_exceeded" {
-			return "", LogicError{
-				Code:    LogicErrorContextLengthExceeded,
-				Message: "Context length exceeded",
+		if persona.Model != "" {
+			params.Model = persona.Model
+		}
+
+		if persona.Temperature != nil {
+			params.Temperature = *persona.Temperature
+
+			// zero temperature is omitted from requests, and the smallest one is the same
+			if params.Temperature == 0 {
+				params.Temperature = math.SmallestNonzeroFloat32
 			}
 		}
+	}
 
-		return "", err
+	dialogModel, err := appContext.Database.GetDialogModel(dialogId)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get dialog model")
+	} else if dialogModel != "" {
+		params.Model = dialogModel
 	}
 
-	return resp.Choices[0].Message.Content, nil
+	return params
 }
 
-func StreamReply(appContext *AppContext, messages []protos.DialogMessage, replyCh chan string) error {
+func buildChatRequest(params ChatParams, messages []*protos.DialogMessage) openai.ChatCompletionRequest {
 	openaiMessages := make([]openai.ChatCompletionMessage, len(messages))
 	for i, msg := range messages {
 		openaiMessages[i] = openai.ChatCompletionMessage{
@@ -48,37 +75,146 @@ func StreamReply(appContext *AppContext, messages []protos.DialogMessage, replyC
 		}
 	}
 
-	req := openai.ChatCompletionRequest{
-		Model:    openai.GPT3Dot5Turbo0301,
-		Messages: openaiMessages,
-		Stream:   true,
+	return openai.ChatCompletionRequest{
+		Model:            params.Model,
+		Messages:         openaiMessages,
+		Temperature:      params.Temperature,
+		TopP:             params.TopP,
+		MaxTokens:        params.MaxTokens,
+		PresencePenalty:  params.PresencePenalty,
+		FrequencyPenalty: params.FrequencyPenalty,
 	}
+}
 
-	stream, err := appContext.OpenAI.CreateChatCompletionStream(context.Background(), req)
-	if err != nil {
+// withSystemPrompt prepends the system prompt to dialog messages. The prompt is not stored in the database,
+// so changing a persona affects the whole dialog.
+func withSystemPrompt(params ChatParams, messages []*protos.DialogMessage) []*protos.DialogMessage {
+	if params.SystemPrompt == "" {
+		return messages
+	}
+
+	result := make([]*protos.DialogMessage, 0, len(messages)+1)
+	result = append(result, &protos.DialogMessage{
+		Role:    openai.ChatMessageRoleSystem,
+		Content: params.SystemPrompt,
+	})
+
+	return append(result, messages...)
+}
+
+func GetCompleteReply(appContext *AppContext, params ChatParams, messages []*protos.DialogMessage) (string, error) {
+	var resp openai.ChatCompletionResponse
+	err := retryOpenAI(appContext, "chat", params.Model, func(ctx context.Context) error {
+		var err error
+		resp, err = appContext.Chat.CreateChatCompletion(ctx, buildChatRequest(params, messages))
 		return err
+	})
+
+	if err != nil {
+		return "", wrapOpenAIError(err)
 	}
 
-	defer stream.Close()
+	recordUsage(appContext, params.Owner, params.Model, &protos.Usage{
+		Requests:         1,
+		PromptTokens:     int64(resp.Usage.PromptTokens),
+		CompletionTokens: int64(resp.Usage.CompletionTokens),
+	})
+
+	if len(resp.Choices) == 0 {
+		return "", errors.New("model returned no reply")
+	}
+
+	return resp.Choices[0].Message.Content, nil
+}
+
+// ReplyDelta is a piece of a streamed reply. The last value sent before the channel is closed can carry an error.
+type ReplyDelta struct {
+	Content string
+	Err     error
+}
+
+// StreamReply sends reply deltas to the channel and closes it when the reply is complete or an error occurs
+func StreamReply(appContext *AppContext, params ChatParams, messages []*protos.DialogMessage, replyCh chan ReplyDelta) {
 	defer close(replyCh)
 
-	for {
-		response, err := stream.Recv()
-		if errors.Is(err, io.EOF) {
-			break
+	req := buildChatRequest(params, messages)
+	req.Stream = true
+
+	// errors of a failed request are only seen when the stream is read, so the request is retried until its first
+	// part is received
+	var stream ChatStream
+	var timeout *requestTimeout
+	var response openai.ChatCompletionStreamResponse
+	var recvErr error
+	err := withRetry(appContext.Context, appContext.Config, openAIRetryPolicy, func(ctx context.Context) error {
+		timeout = newRequestTimeout(ctx, getOpenAITimeout(appContext.Config))
+		started := time.Now()
+
+		var err error
+		stream, err = appContext.Chat.CreateChatCompletionStream(timeout.ctx, req)
+		if err == nil {
+			response, recvErr = stream.Recv()
+			if recvErr != nil && !errors.Is(recvErr, io.EOF) {
+				stream.Close()
+				err = recvErr
+			}
 		}
 
+		err = timeout.wrap(err)
+		observeOpenAIRequest(appContext.Config, "chat_stream", params.Model, started, err)
+
 		if err != nil {
+			timeout.stop()
 			return err
 		}
 
-		replyCh <- response.Choices[0].Delta.Content
+		return nil
+	})
+	if err != nil {
+		replyCh <- ReplyDelta{Err: wrapOpenAIError(err)}
+		return
 	}
 
-	return nil
+	defer timeout.stop()
+	defer stream.Close()
+
+	// streamed responses don't report usage, so it is estimated
+	completion := strings.Builder{}
+	defer func() {
+		recordUsage(appContext, params.Owner, params.Model, &protos.Usage{
+			Requests:         1,
+			PromptTokens:     int64(EstimateTokens(messages, params.Model)),
+			CompletionTokens: int64(CountTextTokens(completion.String(), params.Model)),
+		})
+	}()
+
+	for {
+		if errors.Is(recvErr, io.EOF) {
+			return
+		}
+
+		if recvErr != nil {
+			recvErr = timeout.wrap(recvErr)
+			if !errors.Is(recvErr, context.Canceled) {
+				openAIErrors.inc("chat_stream", getModelLabel(appContext.Config, params.Model))
+			}
+
+			replyCh <- ReplyDelta{Err: wrapOpenAIError(recvErr)}
+			return
+		}
+
+		if len(response.Choices) > 0 {
+			completion.WriteString(response.Choices[0].Delta.Content)
+			replyCh <- ReplyDelta{Content: response.Choices[0].Delta.Content}
+		}
+
+		// the timeout is for waiting for the next part, not for the whole reply
+		timeout.reset()
+		response, recvErr = stream.Recv()
+	}
 }
 
-func Imagine(appContext *AppContext, prompt string) (string, error) {
+func Imagine(appContext *AppContext, owner UsageOwner, prompt string) (string, error) {
 	prompt, size := parsePrompt(prompt)
 
 	reqUrl := openai.ImageRequest{
@@ -88,11 +224,23 @@ func Imagine(appContext *AppContext, prompt string) (string, error) {
 		N:              1,
 	}
 
-	respUrl, err := appContext.OpenAI.CreateImage(context.Background(), reqUrl)
+	var respUrl openai.ImageResponse
+	err := retryOpenAI(appContext, "images", "dall-e-"+size, func(ctx context.Context) error {
+		var err error
+		respUrl, err = appContext.Images.CreateImage(ctx, reqUrl)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
 
+	// image prices depend on the size only
+	recordUsage(appContext, owner, "dall-e-"+size, &protos.Usage{Requests: 1, Images: int64(len(respUrl.Data))})
+
+	if len(respUrl.Data) == 0 {
+		return "", errors.New("no image returned")
+	}
+
 	return respUrl.Data[0].URL, nil
 }
 
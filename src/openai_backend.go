@@ -0,0 +1,162 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sashabaranov/go-openai"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const OpenAIApiTypeOpenAI = "openai"
+const OpenAIApiTypeAzure = "azure"
+
+const defaultAzureApiVersion = "2023-03-15-preview"
+
+// OpenAIBackend implements all backends with OpenAI API or any server compatible with it
+type OpenAIBackend struct {
+	client *openai.Client
+}
+
+func NewOpenAIBackend(config *Config) (*OpenAIBackend, error) {
+	clientConfig := openai.DefaultConfig(config.OpenAIApiKey)
+
+	if config.OpenAIBaseURL != "" {
+		clientConfig.BaseURL = strings.TrimRight(config.OpenAIBaseURL, "/")
+	}
+
+	if config.OpenAIOrgID != "" {
+		clientConfig.OrgID = config.OpenAIOrgID
+	}
+
+	if config.OpenAIApiType == OpenAIApiTypeAzure {
+		if config.OpenAIBaseURL == "" {
+			return nil, fmt.Errorf("openai_base_url should be set to the resource endpoint to use Azure")
+		}
+
+		baseURL, err := url.Parse(clientConfig.BaseURL)
+		if err != nil {
+			return nil, err
+		}
+
+		clientConfig.HTTPClient = &http.Client{
+			Transport: &azureTransport{
+				apiKey:      config.OpenAIApiKey,
+				apiVersion:  config.AzureApiVersion,
+				deployments: config.AzureDeployments,
+				basePath:    baseURL.Path,
+				base:        http.DefaultTransport,
+			},
+		}
+	} else if config.OpenAIApiType != "" && config.OpenAIApiType != OpenAIApiTypeOpenAI {
+		return nil, fmt.Errorf("unknown openai_api_type: %s", config.OpenAIApiType)
+	}
+
+	transport := clientConfig.HTTPClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	clientConfig.HTTPClient = &http.Client{Transport: &retryHintTransport{base: transport}}
+
+	return &OpenAIBackend{
+		client: openai.NewClientWithConfig(clientConfig),
+	}, nil
+}
+
+func (b *OpenAIBackend) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	return b.client.CreateChatCompletion(ctx, req)
+}
+
+func (b *OpenAIBackend) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (ChatStream, error) {
+	stream, err := b.client.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+func (b *OpenAIBackend) CreateImage(ctx context.Context, req openai.ImageRequest) (openai.ImageResponse, error) {
+	return b.client.CreateImage(ctx, req)
+}
+
+func (b *OpenAIBackend) CreateTranscription(ctx context.Context, req openai.AudioRequest) (openai.AudioResponse, error) {
+	return b.client.CreateTranscription(ctx, req)
+}
+
+// azureTransport rewrites OpenAI requests to Azure OpenAI Service format: requests go to a model deployment,
+// API version is passed in the query, and the key is sent in `api-key` header instead of a bearer token
+type azureTransport struct {
+	apiKey      string
+	apiVersion  string
+	deployments map[string]string
+	basePath    string
+	base        http.RoundTripper
+}
+
+func (t *azureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	model, err := getRequestModel(req)
+	if err != nil {
+		return nil, err
+	}
+
+	deployment, ok := t.deployments[model]
+	if !ok {
+		// azure does not allow dots in deployment names, so by convention `gpt-3.5-turbo` is deployed as `gpt-35-turbo`
+		deployment = strings.ReplaceAll(model, ".", "")
+	}
+
+	apiVersion := t.apiVersion
+	if apiVersion == "" {
+		apiVersion = defaultAzureApiVersion
+	}
+
+	// the request is changed, so it should be cloned first
+	req = req.Clone(req.Context())
+
+	endpoint := strings.TrimPrefix(req.URL.Path, t.basePath)
+	req.URL.Path = fmt.Sprintf("%s/openai/deployments/%s%s", t.basePath, url.PathEscape(deployment), endpoint)
+	req.URL.RawQuery = url.Values{"api-version": {apiVersion}}.Encode()
+
+	req.Header.Del("Authorization")
+	req.Header.Set("api-key", t.apiKey)
+
+	return t.base.RoundTrip(req)
+}
+
+// getRequestModel reads a model from the request body, leaving the body intact
+func getRequestModel(req *http.Request) (string, error) {
+	if req.Body == nil || !strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		// transcriptions are the only multipart requests we send
+		return openai.Whisper1, nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return "", err
+	}
+
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	var payload struct {
+		Model string `json:"model"`
+	}
+
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		return "", err
+	}
+
+	if payload.Model == "" {
+		// image requests do not specify a model
+		return "dall-e", nil
+	}
+
+	return payload.Model, nil
+}
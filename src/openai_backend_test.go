@@ -0,0 +1,150 @@
+package src
+
+import (
+	"context"
+	"github.com/sashabaranov/go-openai"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// recordedRequest is a request received by a backend server, with its body read
+type recordedRequest struct {
+	path   string
+	query  string
+	header http.Header
+	body   string
+}
+
+func newRecordingServer(t *testing.T, requests *[]recordedRequest) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		*requests = append(*requests, recordedRequest{path: r.URL.Path, query: r.URL.RawQuery, header: r.Header, body: string(body)})
+
+		writeJSON(w, openai.ChatCompletionResponse{
+			Choices: []openai.ChatCompletionChoice{{Message: openai.ChatCompletionMessage{Content: fakeReplyText}}},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestAzureBackend(t *testing.T) {
+	var requests []recordedRequest
+	server := newRecordingServer(t, &requests)
+
+	backend, err := NewOpenAIBackend(&Config{
+		OpenAIApiKey:     "azure-key",
+		OpenAIBaseURL:    server.URL + "/resource/",
+		OpenAIApiType:    OpenAIApiTypeAzure,
+		AzureDeployments: map[string]string{"gpt-4": "my-gpt4"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, model := range []string{"gpt-4", "gpt-3.5-turbo"} {
+		_, err = backend.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{Model: model})
+		if err != nil {
+			t.Fatalf("failed to request %s: %s", model, err)
+		}
+	}
+
+	expectedPaths := []string{
+		"/resource/openai/deployments/my-gpt4/chat/completions",
+		// dots are not allowed in deployment names
+		"/resource/openai/deployments/gpt-35-turbo/chat/completions",
+	}
+
+	for i, req := range requests {
+		if req.path != expectedPaths[i] {
+			t.Errorf("expected request to %s, got %s", expectedPaths[i], req.path)
+		}
+
+		if req.query != "api-version="+defaultAzureApiVersion {
+			t.Errorf("expected the default API version, got %q", req.query)
+		}
+
+		if req.header.Get("api-key") != "azure-key" || req.header.Get("Authorization") != "" {
+			t.Errorf("expected the key to be sent in api-key header only")
+		}
+	}
+
+	// the body is read to find the deployment, and has to be sent as is
+	if len(requests) != 2 || requests[0].body == "" {
+		t.Errorf("expected the request body to be sent")
+	}
+}
+
+func TestOpenAICompatibleBackend(t *testing.T) {
+	var requests []recordedRequest
+	server := newRecordingServer(t, &requests)
+
+	backend, err := NewOpenAIBackend(&Config{
+		OpenAIApiKey:  "key",
+		OpenAIBaseURL: server.URL + "/v1/",
+		OpenAIOrgID:   "org",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = backend.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{Model: "llama"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := requests[0]
+	if req.path != "/v1/chat/completions" || req.header.Get("Authorization") != "Bearer key" || req.header.Get("OpenAI-Organization") != "org" {
+		t.Errorf("expected an OpenAI request to the base URL, got %s with %v", req.path, req.header)
+	}
+}
+
+func TestBackendConfigErrors(t *testing.T) {
+	configs := map[string]*Config{
+		"unknown API type":       {OpenAIApiType: "another"},
+		"Azure without base URL": {OpenAIApiType: OpenAIApiTypeAzure},
+	}
+
+	for name, config := range configs {
+		if _, err := NewOpenAIBackend(config); err == nil {
+			t.Errorf("expected an error for %s", name)
+		}
+	}
+}
+
+// stubChatBackend answers every request with the same text, without any server
+type stubChatBackend struct {
+	requests []openai.ChatCompletionRequest
+}
+
+func (b *stubChatBackend) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	b.requests = append(b.requests, req)
+
+	return openai.ChatCompletionResponse{
+		Choices: []openai.ChatCompletionChoice{{Message: openai.ChatCompletionMessage{Content: "Hello from the stub"}}},
+	}, nil
+}
+
+func (b *stubChatBackend) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (ChatStream, error) {
+	return nil, io.ErrUnexpectedEOF
+}
+
+func TestCustomChatBackend(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	backend := &stubChatBackend{}
+	h.appContext.Chat = backend
+
+	h.sendText("Hi")
+
+	if len(backend.requests) != 1 || h.openai.chatRequestCount() != 0 {
+		t.Errorf("expected the request to go to the custom backend")
+	}
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); got != "Hello from the stub" {
+		t.Errorf("expected the reply of the custom backend, got %q", got)
+	}
+}
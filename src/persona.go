@@ -0,0 +1,114 @@
+package src
+
+import (
+	"fmt"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"strings"
+)
+
+const personaNone = "none"
+
+func selectDialogPersona(appContext *AppContext, dialogId string, name string, msg *tgbotapi.Message) {
+	name = strings.TrimSpace(name)
+
+	if name == "" {
+		sendPersonaKeyboard(appContext, dialogId, msg)
+		return
+	}
+
+	text, err := applyDialogPersona(appContext, dialogId, name)
+	if err != nil {
+		sendError(appContext, fmt.Sprintf("Failed to change persona: %s", err), msg.Chat.ID)
+		return
+	}
+
+	sendNotice(appContext, text, msg)
+}
+
+func applyDialogPersona(appContext *AppContext, dialogId string, name string) (string, error) {
+	if name == personaNone {
+		name = ""
+	} else if appContext.Config.GetPersona(name) == nil {
+		return "", fmt.Errorf("unknown persona %s", name)
+	}
+
+	err := appContext.Database.SetDialogPersona(dialogId, name)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to set dialog persona")
+		return "", err
+	}
+
+	if name == "" {
+		return "❕Persona disabled", nil
+	}
+
+	return fmt.Sprintf("❕Persona changed to %s", name), nil
+}
+
+// GetDialogPersona returns the persona applied to the dialog, or the default one if nothing was selected
+func GetDialogPersona(appContext *AppContext, dialogId string) *Persona {
+	personaName := appContext.Config.DefaultPersona
+
+	dialogPersona, found, err := appContext.Database.GetDialogPersona(dialogId)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get dialog persona")
+	} else if found {
+		personaName = dialogPersona
+	}
+
+	return appContext.Config.GetPersona(personaName)
+}
+
+func handlePersonaCallback(appContext *AppContext, query *tgbotapi.CallbackQuery, dialogId string, arg string) (string, error) {
+	name := personaNone
+	if arg != personaNone {
+		index, err := strconv.Atoi(arg)
+		if err != nil || index < 0 || index >= len(appContext.Config.Personas) {
+			return "", fmt.Errorf("unknown persona")
+		}
+
+		name = appContext.Config.Personas[index].Name
+	}
+
+	text, err := applyDialogPersona(appContext, dialogId, name)
+	if err != nil {
+		return "", fmt.Errorf("failed to change persona: %s", err)
+	}
+
+	return text, nil
+}
+
+func sendPersonaKeyboard(appContext *AppContext, dialogId string, msg *tgbotapi.Message) {
+	if len(appContext.Config.Personas) == 0 {
+		sendError(appContext, "No personas configured", msg.Chat.ID)
+		return
+	}
+
+	// callback data is limited in size, so personas are referenced by index
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i, persona := range appContext.Config.Personas {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(persona.Name, NewCallbackData(appContext, callbackActionPersona, dialogId, strconv.Itoa(i))),
+		))
+	}
+
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("No persona", NewCallbackData(appContext, callbackActionPersona, dialogId, personaNone)),
+	))
+
+	currentPersona := personaNone
+	if persona := GetDialogPersona(appContext, dialogId); persona != nil {
+		currentPersona = persona.Name
+	}
+
+	reply := tgbotapi.NewMessage(msg.Chat.ID, fmt.Sprintf("Current persona: %s. Choose a persona for this dialog:", currentPersona))
+	reply.ReplyToMessageID = msg.MessageID
+	reply.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+
+	_, err := sendWithRetry(appContext, msg.Chat.ID, reply)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to send persona keyboard")
+	}
+}
@@ -0,0 +1,122 @@
+package src
+
+import (
+	"github.com/sashabaranov/go-openai"
+	"testing"
+)
+
+func TestPersonaCommand(t *testing.T) {
+	h := newTestHarness(t, withPersonas)
+
+	h.sendText("/persona pirate")
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); got != "❕Persona changed to pirate" {
+		t.Errorf("expected the persona to be changed, got %q", got)
+	}
+
+	h.sendText("Hi")
+
+	messages := h.openai.lastChatRequest().Messages
+	if len(messages) != 2 || messages[0].Role != openai.ChatMessageRoleSystem || messages[0].Content != "Talk like a pirate" {
+		t.Fatalf("expected the system prompt of the persona to be sent first, got %v", messages)
+	}
+
+	// the system prompt is not stored, so the persona can be changed in the middle of a dialog
+	h.sendText("/persona none")
+	h.sendText("Hi again")
+
+	for _, msg := range h.openai.lastChatRequest().Messages {
+		if msg.Role == openai.ChatMessageRoleSystem {
+			t.Errorf("expected no system prompt after the persona was disabled, got %q", msg.Content)
+		}
+	}
+}
+
+func TestPersonaZeroTemperature(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		withPersonas(config)
+		config.Temperature = 0.7
+	})
+
+	h.sendText("/persona pirate")
+	h.sendText("Hi")
+
+	if got := h.openai.lastChatRequest().Temperature; got != 0.7 {
+		t.Errorf("expected the temperature from config without one of the persona, got %v", got)
+	}
+
+	h.sendText("/persona precise")
+	h.sendText("Hi")
+
+	if got := h.openai.lastChatRequest().Temperature; got == 0 || got > 0.001 {
+		t.Errorf("expected zero temperature of the persona to be sent, got %v", got)
+	}
+}
+
+func TestPersonaOverridesModel(t *testing.T) {
+	h := newTestHarness(t, withPersonas)
+
+	h.sendText("/model gpt-3.5-turbo-16k")
+	h.sendText("/persona coder")
+	h.sendText("Hi")
+
+	req := h.openai.lastChatRequest()
+	if req.Model != "gpt-4" || req.Temperature != 0.1 {
+		t.Errorf("expected the model and temperature of the persona, got %q and %v", req.Model, req.Temperature)
+	}
+
+	// a model selected after the persona takes priority
+	h.sendText("/model gpt-3.5-turbo-16k")
+	h.sendText("Hi")
+
+	if got := h.openai.lastChatRequest().Model; got != "gpt-3.5-turbo-16k" {
+		t.Errorf("expected the selected model, got %q", got)
+	}
+}
+
+func TestPersonaKeyboard(t *testing.T) {
+	h := newTestHarness(t, withPersonas)
+
+	h.sendText("/persona")
+
+	keyboard := h.telegram.lastCallTo("sendMessage")
+	if got := keyboard.Params.Get("text"); got != "Current persona: none. Choose a persona for this dialog:" {
+		t.Errorf("expected a persona keyboard, got %q", got)
+	}
+
+	data, ok := keyboard.callbackButtons(t)["coder"]
+	if !ok {
+		t.Fatalf("expected a button for every persona")
+	}
+
+	h.pressButton(data, h.sentMessage(keyboard))
+
+	if got := h.telegram.lastCallTo("editMessageText").Params.Get("text"); got != "❕Persona changed to coder" {
+		t.Errorf("expected the keyboard to be replaced with a notification, got %q", got)
+	}
+
+	h.sendText("Hi")
+
+	if got := h.openai.lastChatRequest().Messages[0].Content; got != "Answer with code" {
+		t.Errorf("expected the system prompt of the chosen persona, got %q", got)
+	}
+}
+
+func TestDefaultPersona(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		withPersonas(config)
+		config.DefaultPersona = "pirate"
+	})
+
+	h.sendText("/persona unknown")
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); got != "‼ Failed to change persona: unknown persona unknown" {
+		t.Errorf("expected an error message, got %q", got)
+	}
+
+	h.sendText("Hi")
+
+	if got := h.openai.lastChatRequest().Messages[0].Content; got != "Talk like a pirate" {
+		t.Errorf("expected the system prompt of the default persona, got %q", got)
+	}
+}
@@ -1,10 +1,20 @@
 package src
 
 import (
+	"context"
 	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/rs/zerolog/log"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
+const defaultShutdownTimeout = 20 * time.Second
+
+// aborted requests still need some time to save partial replies
+const abortGracePeriod = 5 * time.Second
+
 func Run() {
 	appContext, err := NewAppContext()
 	if err != nil {
@@ -15,12 +25,119 @@ func Run() {
 
 	setBotCommands(appContext)
 
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
+	shutdownCtx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+
+	requestsCtx, abortRequests := context.WithCancel(context.Background())
+	defer abortRequests()
+
+	appContext.Context = requestsCtx
+
+	var updates tgbotapi.UpdatesChannel
+	var stopReceiving func()
+	if appContext.Config.Webhook.PublicURL != "" {
+		updates, stopReceiving, err = ListenForWebhook(appContext)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to start webhook")
+		}
+	} else {
+		updates, stopReceiving = pollUpdates(appContext)
+	}
+
+	stopMetrics := StartMetricsServer(appContext)
+	defer stopMetrics()
+
+	handlers := sync.WaitGroup{}
+	handle := func(update tgbotapi.Update) {
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			handleUpdate(appContext, update)
+		}()
+	}
+
+loop:
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				break loop
+			}
+
+			handle(update)
+
+		case <-shutdownCtx.Done():
+			break loop
+		}
+	}
+
+	log.Info().Msg("Shutting down, waiting for running requests")
+	setShuttingDown()
+
+	// updates in the channel are already acknowledged to Telegram, so once no more are received they are handled
+	// before waiting for handlers
+	stopReceiving()
+	drainUpdates(updates, handle)
+
+	shutdown(appContext, &handlers, abortRequests)
+}
+
+// drainUpdates handles updates left in the channel, without waiting for new ones
+func drainUpdates(updates tgbotapi.UpdatesChannel, handle func(update tgbotapi.Update)) {
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				return
+			}
+
+			handle(update)
+
+		default:
+			return
+		}
+	}
+}
+
+// shutdown waits for running handlers, aborting their requests if they take too long, and closes the database.
+// The database is left open if handlers are still running, as closing it under them may corrupt dialogs.
+func shutdown(appContext *AppContext, handlers *sync.WaitGroup, abortRequests context.CancelFunc) {
+	timeout := defaultShutdownTimeout
+	if appContext.Config.ShutdownTimeout > 0 {
+		timeout = time.Duration(appContext.Config.ShutdownTimeout) * time.Second
+	}
+
+	if !waitTimeout(handlers, timeout) {
+		log.Warn().Msg("Running requests have not finished in time, aborting them")
+		abortRequests()
+
+		if !waitTimeout(handlers, abortGracePeriod) {
+			log.Error().Msg("Running requests have not finished after aborting, exiting without closing database")
+			return
+		}
+	}
+
+	err := appContext.Database.Close()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to close database")
+		return
+	}
+
+	log.Info().Msg("Shut down")
+}
 
-	updates := appContext.TelegramBot.GetUpdatesChan(u)
+// waitTimeout waits for the group, returns `false` if the timeout expires first
+func waitTimeout(group *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		group.Wait()
+		close(done)
+	}()
 
-	for update := range updates {
-		go handleUpdate(appContext, update)
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
 	}
 }
@@ -0,0 +1,113 @@
+package src
+
+import (
+	"context"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShutdownAbortsRunningReplies(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.StreamResponse = true
+		config.ShutdownTimeout = 1
+	})
+
+	h.openai.streamDelay = 2 * time.Second
+	h.openai.addReply("Partial", " answer")
+
+	ctx, abortRequests := context.WithCancel(context.Background())
+	defer abortRequests()
+
+	h.appContext.Context = ctx
+
+	handlers := sync.WaitGroup{}
+	handlers.Add(1)
+	go func() {
+		defer handlers.Done()
+		h.sendText("Hi")
+	}()
+
+	started := time.Now()
+	shutdown(h.appContext, &handlers, abortRequests)
+
+	if elapsed := time.Since(started); elapsed > time.Second+abortGracePeriod {
+		t.Errorf("expected shutdown to finish after aborting requests, took %s", elapsed)
+	}
+
+	var texts []string
+	for _, call := range append(h.telegram.callsTo("sendMessage"), h.telegram.callsTo("editMessageText")...) {
+		texts = append(texts, call.Params.Get("text"))
+	}
+
+	if got := strings.Join(texts, "\n"); !strings.Contains(got, "Partial"+partialReplyMarker) || !strings.Contains(got, "restarting") {
+		t.Errorf("expected the partial reply to be marked and the user to be told about the restart, got %q", got)
+	}
+
+	if _, err := h.appContext.Database.GetDialog("user:42"); err == nil {
+		t.Errorf("expected the database to be closed")
+	}
+}
+
+func TestShutdownWaitsForRunningReplies(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.StreamResponse = true
+	})
+
+	h.openai.streamDelay = 300 * time.Millisecond
+	h.openai.addReply("Complete", " answer")
+
+	handlers := sync.WaitGroup{}
+	handlers.Add(1)
+	go func() {
+		defer handlers.Done()
+		h.sendText("Hi")
+	}()
+
+	shutdown(h.appContext, &handlers, func() {
+		t.Errorf("expected requests not to be aborted")
+	})
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); got != "Complete answer" {
+		t.Errorf("expected the reply to be finished, got %q", got)
+	}
+}
+
+func TestDrainUpdates(t *testing.T) {
+	updates := make(chan tgbotapi.Update, 3)
+	updates <- tgbotapi.Update{UpdateID: 1}
+	updates <- tgbotapi.Update{UpdateID: 2}
+
+	var handled []int
+	drainUpdates(updates, func(update tgbotapi.Update) {
+		handled = append(handled, update.UpdateID)
+	})
+
+	if len(handled) != 2 || handled[0] != 1 || handled[1] != 2 {
+		t.Errorf("expected buffered updates to be handled in order, got %v", handled)
+	}
+
+	close(updates)
+	drainUpdates(updates, func(update tgbotapi.Update) {
+		t.Errorf("expected a closed channel to be drained, got %v", update)
+	})
+}
+
+func TestShutdownKeepsDatabaseOpenForRunningHandlers(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.ShutdownTimeout = 1
+	})
+
+	// a handler that ignores the abort
+	handlers := sync.WaitGroup{}
+	handlers.Add(1)
+	defer handlers.Done()
+
+	shutdown(h.appContext, &handlers, func() {})
+
+	if err := h.appContext.Database.Ping(); err != nil {
+		t.Errorf("expected the database to stay open under running handlers, got %s", err)
+	}
+}
@@ -0,0 +1,334 @@
+package src
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Telegram counts message length in UTF-16 code units after parsing entities
+const telegramMessageLimit = 4096
+
+// lines longer than this are split by words before splitting a reply into messages, so any line fits into a message
+const maxLineLength = telegramMessageLimit / 2
+
+const codeFence = "```"
+
+var (
+	inlineCodePattern = regexp.MustCompile("`([^`\n]+)`")
+	linkPattern       = regexp.MustCompile(`\[([^\]\n]+)\]\(([^)\s]+)\)`)
+	headingPattern    = regexp.MustCompile(`^#{1,6}\s+(.*)$`)
+	listItemPattern   = regexp.MustCompile(`^(\s*)[-*+]\s+(.*)$`)
+)
+
+// emphasisDelimiters are matched in order, so double delimiters take priority over single ones
+var emphasisDelimiters = []struct {
+	delimiter string
+	tag       string
+	// underscores and single asterisks only format whole words, so they are literal in names like snake_case
+	wholeWords bool
+}{
+	{"**", "b", false},
+	{"__", "b", true},
+	{"~~", "s", false},
+	{"*", "i", true},
+	{"_", "i", true},
+}
+
+// RenderMarkdown converts Markdown produced by the model into Telegram HTML. Unclosed code blocks are closed, so
+// partially streamed replies can be rendered too.
+func RenderMarkdown(text string) string {
+	var rendered []string
+	var code []string
+	codeLang := ""
+	inCode := false
+
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), codeFence) {
+			if inCode {
+				rendered = append(rendered, renderCodeBlock(code, codeLang))
+				code = nil
+			} else {
+				codeLang = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), codeFence))
+			}
+
+			inCode = !inCode
+			continue
+		}
+
+		if inCode {
+			code = append(code, line)
+		} else {
+			rendered = append(rendered, renderLine(line))
+		}
+	}
+
+	if inCode {
+		rendered = append(rendered, renderCodeBlock(code, codeLang))
+	}
+
+	return strings.Join(rendered, "\n")
+}
+
+func renderCodeBlock(lines []string, lang string) string {
+	code := html.EscapeString(strings.Join(lines, "\n"))
+
+	if lang != "" {
+		return `<pre><code class="language-` + html.EscapeString(lang) + `">` + code + "</code></pre>"
+	}
+
+	return "<pre>" + code + "</pre>"
+}
+
+func renderLine(line string) string {
+	if match := headingPattern.FindStringSubmatch(line); match != nil {
+		return "<b>" + renderInline(match[1]) + "</b>"
+	}
+
+	if match := listItemPattern.FindStringSubmatch(line); match != nil {
+		return match[1] + "• " + renderInline(match[2])
+	}
+
+	return renderInline(line)
+}
+
+// renderInline formats a single line. Code spans are rendered as is, other formatting is applied to the rest.
+func renderInline(line string) string {
+	builder := strings.Builder{}
+
+	last := 0
+	for _, loc := range inlineCodePattern.FindAllStringSubmatchIndex(line, -1) {
+		builder.WriteString(renderFormatting(line[last:loc[0]]))
+		builder.WriteString("<code>" + html.EscapeString(line[loc[2]:loc[3]]) + "</code>")
+		last = loc[1]
+	}
+
+	builder.WriteString(renderFormatting(line[last:]))
+
+	return builder.String()
+}
+
+// renderFormatting renders links, and emphasis outside of link addresses
+func renderFormatting(text string) string {
+	builder := strings.Builder{}
+
+	last := 0
+	for _, loc := range linkPattern.FindAllStringSubmatchIndex(text, -1) {
+		builder.WriteString(renderEmphasis(text[last:loc[0]]))
+		builder.WriteString(`<a href="` + html.EscapeString(text[loc[4]:loc[5]]) + `">` + renderEmphasis(text[loc[2]:loc[3]]) + "</a>")
+		last = loc[1]
+	}
+
+	builder.WriteString(renderEmphasis(text[last:]))
+
+	return builder.String()
+}
+
+// renderEmphasis renders bold, italic and strikethrough text. Open delimiters are kept on a stack, so tags are always
+// nested: a closing delimiter closes its tag and leaves delimiters opened inside it as text, as do delimiters that
+// are never closed.
+func renderEmphasis(text string) string {
+	type openDelimiter struct {
+		delimiter string
+		tag       string
+		// index of the delimiter in pieces, it is replaced with a tag once closed
+		index int
+	}
+
+	var pieces []string
+	var stack []openDelimiter
+	plain := strings.Builder{}
+
+	flushPlain := func() {
+		if plain.Len() > 0 {
+			pieces = append(pieces, html.EscapeString(plain.String()))
+			plain.Reset()
+		}
+	}
+
+	for i := 0; i < len(text); {
+		delimiter, tag, wholeWords := matchEmphasisDelimiter(text[i:])
+		if delimiter == "" {
+			_, size := utf8.DecodeRuneInString(text[i:])
+			plain.WriteString(text[i : i+size])
+			i += size
+			continue
+		}
+
+		// delimiters are only checked against adjacent characters, so they are never consumed with them
+		before, beforeSize := utf8.DecodeLastRuneInString(text[:i])
+		after, afterSize := utf8.DecodeRuneInString(text[i+len(delimiter):])
+		canOpen := afterSize > 0 && !unicode.IsSpace(after) && (!wholeWords || !isWordRune(before))
+		canClose := beforeSize > 0 && !unicode.IsSpace(before) && (!wholeWords || !isWordRune(after))
+
+		opener := -1
+		if canClose {
+			for j := len(stack) - 1; j >= 0; j-- {
+				if stack[j].delimiter == delimiter {
+					opener = j
+					break
+				}
+			}
+		}
+
+		// empty tags are not closed, Telegram rejects them
+		if opener >= 0 && (plain.Len() > 0 || stack[opener].index < len(pieces)-1) {
+			flushPlain()
+			pieces[stack[opener].index] = "<" + tag + ">"
+			pieces = append(pieces, "</"+tag+">")
+			stack = stack[:opener]
+		} else if canOpen {
+			flushPlain()
+			stack = append(stack, openDelimiter{delimiter: delimiter, tag: tag, index: len(pieces)})
+			pieces = append(pieces, html.EscapeString(delimiter))
+		} else {
+			plain.WriteString(delimiter)
+		}
+
+		i += len(delimiter)
+	}
+
+	flushPlain()
+
+	return strings.Join(pieces, "")
+}
+
+func matchEmphasisDelimiter(text string) (delimiter string, tag string, wholeWords bool) {
+	for _, emphasis := range emphasisDelimiters {
+		if strings.HasPrefix(text, emphasis.delimiter) {
+			return emphasis.delimiter, emphasis.tag, emphasis.wholeWords
+		}
+	}
+
+	return "", "", false
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// textLength returns the length of the text as Telegram counts it
+func textLength(text string) int {
+	return len(utf16.Encode([]rune(text)))
+}
+
+// SplitMarkdown splits the text into parts that fit into a message. Text is split on line boundaries, and code
+// blocks split between parts are closed and reopened, so every part renders on its own. Parts are measured before
+// rendering, as markup only makes text shorter, so a part fits whether it is rendered or sent as plain text after
+// Telegram fails to parse it.
+func SplitMarkdown(text string, limit int) []string {
+	var parts []string
+	var lines []string
+	// length of the lines joined into a part
+	length := 0
+	openFence := ""
+
+	closeLines := func(lines []string, fence string) string {
+		part := strings.Join(lines, "\n")
+		if fence != "" {
+			part += "\n" + codeFence
+		}
+
+		return part
+	}
+
+	for _, line := range splitLongLines(text, maxLineLength) {
+		fenceAfter := openFence
+		if strings.HasPrefix(strings.TrimSpace(line), codeFence) {
+			if openFence == "" {
+				fenceAfter = strings.TrimSpace(line)
+			} else {
+				fenceAfter = ""
+			}
+		}
+
+		candidateLength := length + textLength(line)
+		if len(lines) > 0 {
+			candidateLength++
+		}
+
+		if fenceAfter != "" {
+			candidateLength += textLength("\n" + codeFence)
+		}
+
+		hasContent := len(lines) > 1 || (len(lines) == 1 && openFence == "")
+		if hasContent && candidateLength > limit {
+			parts = append(parts, closeLines(lines, openFence))
+
+			lines = nil
+			length = 0
+			if openFence != "" {
+				lines = append(lines, openFence)
+				length = textLength(openFence)
+			}
+		}
+
+		if len(lines) > 0 {
+			length++
+		}
+
+		lines = append(lines, line)
+		length += textLength(line)
+		openFence = fenceAfter
+	}
+
+	if len(lines) > 0 {
+		parts = append(parts, strings.Join(lines, "\n"))
+	}
+
+	return parts
+}
+
+// splitLongLines splits lines longer than `maxLength` characters, as Telegram counts them, preferably on spaces.
+// Spaces at a cut are dropped, except in code blocks, where they are indentation.
+func splitLongLines(text string, maxLength int) []string {
+	var result []string
+	inCode := false
+
+	for _, line := range strings.Split(text, "\n") {
+		isFence := strings.HasPrefix(strings.TrimSpace(line), codeFence)
+
+		for textLength(line) > maxLength {
+			cut := getCutIndex(line, maxLength)
+			if space := strings.LastIndex(line[:cut], " "); space > 0 {
+				cut = space
+			}
+
+			result = append(result, line[:cut])
+
+			line = line[cut:]
+			if !inCode {
+				line = strings.TrimLeft(line, " ")
+			}
+		}
+
+		result = append(result, line)
+
+		if isFence {
+			inCode = !inCode
+		}
+	}
+
+	return result
+}
+
+// getCutIndex returns the byte index the text is cut at to fit into `maxLength` characters, as Telegram counts them.
+// At least one character is kept, so the text gets shorter.
+func getCutIndex(text string, maxLength int) int {
+	length := 0
+	for i, r := range text {
+		length += len(utf16.Encode([]rune{r}))
+		if length > maxLength {
+			if i == 0 {
+				return utf8.RuneLen(r)
+			}
+
+			return i
+		}
+	}
+
+	return len(text)
+}
@@ -0,0 +1,125 @@
+package src
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		expected string
+	}{
+		{"plain text", "just text", "just text"},
+		{"escaping", "1 < 2 & 3 > 2", "1 &lt; 2 &amp; 3 &gt; 2"},
+		{"bold", "**bold** and __bold__", "<b>bold</b> and <b>bold</b>"},
+		{"italic", "*a* and _b_", "<i>a</i> and <i>b</i>"},
+		{"adjacent italics", "*a* *b*", "<i>a</i> <i>b</i>"},
+		{"strikethrough", "~~gone~~", "<s>gone</s>"},
+		{"nested emphasis", "**a *b* c**", "<b>a <i>b</i> c</b>"},
+		{"crossing emphasis", "**a _b** c_", "<b>a _b</b> c_"},
+		{"crossing emphasis closed inside", "_a *b_ c*", "<i>a *b</i> c*"},
+		{"unclosed emphasis", "**a *b", "**a *b"},
+		{"empty emphasis", "****", "****"},
+		{"spaced asterisks", "a * b * c", "a * b * c"},
+		{"snake case", "call snake_case_name now", "call snake_case_name now"},
+		{"multiplication", "2*3*4", "2*3*4"},
+		{"heading", "## Title", "<b>Title</b>"},
+		{"list", "- one\n* two\n  + three", "• one\n• two\n  • three"},
+		{"inline code", "`a*b*c < d` *e*", "<code>a*b*c &lt; d</code> <i>e</i>"},
+		{"link", "see [a & b](http://x.com/?a=1&b=<2>)", `see <a href="http://x.com/?a=1&amp;b=&lt;2&gt;">a &amp; b</a>`},
+		{"link with underscores", "[*docs*](http://x.com/a_b_c) _end_", `<a href="http://x.com/a_b_c"><i>docs</i></a> <i>end</i>`},
+		{"code block", "```go\nx := a*b*c < 1\n```", `<pre><code class="language-go">x := a*b*c &lt; 1</code></pre>`},
+		{"code block without language", "```\n**x**\n```\n**y**", "<pre>**x**</pre>\n<b>y</b>"},
+		{"unclosed code block", "text\n```\nunclosed", "text\n<pre>unclosed</pre>"},
+	}
+
+	for _, test := range tests {
+		if got := RenderMarkdown(test.text); got != test.expected {
+			t.Errorf("%s: expected %q to render as %q, got %q", test.name, test.text, test.expected, got)
+		}
+	}
+}
+
+func TestSplitMarkdown(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		limit int
+		parts []string
+	}{
+		{"short text", "line one\nline two", 100, []string{"line one\nline two"}},
+		{"split on lines", "aaaa\nbbbb\ncccc", 9, []string{"aaaa\nbbbb", "cccc"}},
+		{"exact boundary", "aaaa\nbbbb", 9, []string{"aaaa\nbbbb"}},
+		{"over boundary", "aaaa\nbbbbb", 9, []string{"aaaa", "bbbbb"}},
+		{
+			"code block reopened",
+			"```go\nline1\nline2\nline3\n```",
+			21,
+			[]string{"```go\nline1\nline2\n```", "```go\nline3\n```"},
+		},
+		{"empty text", "", 10, []string{""}},
+	}
+
+	for _, test := range tests {
+		parts := SplitMarkdown(test.text, test.limit)
+		if strings.Join(parts, "|") != strings.Join(test.parts, "|") {
+			t.Errorf("%s: expected parts %q, got %q", test.name, test.parts, parts)
+		}
+	}
+}
+
+func TestSplitMarkdownFitsLimit(t *testing.T) {
+	var lines []string
+	for i := 0; i < 300; i++ {
+		lines = append(lines, "some **bold** text with [a long link](https://example.com/"+strings.Repeat("path/", 20)+") & more")
+		if i%50 == 0 {
+			lines = append(lines, "```python", "print('code < block')", "print('more code')")
+		}
+		if i%50 == 25 {
+			lines = append(lines, "```")
+		}
+	}
+	// a line longer than a message is split by words
+	lines = append(lines, strings.Repeat("word ", telegramMessageLimit))
+	text := strings.Join(lines, "\n")
+
+	parts := SplitMarkdown(text, telegramMessageLimit)
+	if len(parts) < 2 {
+		t.Fatalf("expected text to be split, got %d parts", len(parts))
+	}
+
+	for i, part := range parts {
+		// raw parts are sent as plain text when Telegram fails to parse the rendered ones
+		if textLength(part) > telegramMessageLimit {
+			t.Errorf("expected part %d to fit into a message, got %d characters", i, textLength(part))
+		}
+
+		if strings.Count(part, "```")%2 != 0 {
+			t.Errorf("expected code blocks of part %d to be closed", i)
+		}
+	}
+}
+
+func TestSplitLongLines(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		maxLength int
+		lines     []string
+	}{
+		{"on spaces", "one two three", 8, []string{"one two", "three"}},
+		{"without spaces", "abcdefgh", 3, []string{"abc", "def", "gh"}},
+		{"characters outside the basic plane", "😀😀😀 😀", 4, []string{"😀😀", "😀", "😀"}},
+		{"indentation in code", "```\n  a b c d\n```", 6, []string{"```", "  a b", " c d", "```"}},
+		{"spaces after code", "```\n```\nab  cd", 3, []string{"```", "```", "ab", "cd"}},
+	}
+
+	for _, test := range tests {
+		lines := splitLongLines(test.text, test.maxLength)
+		if strings.Join(lines, "|") != strings.Join(test.lines, "|") {
+			t.Errorf("%s: expected lines %q, got %q", test.name, test.lines, lines)
+		}
+	}
+}
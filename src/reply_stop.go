@@ -0,0 +1,92 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"sync"
+)
+
+const callbackActionStop = "t"
+
+var errReplyStopped = errors.New("reply stopped by user")
+
+var (
+	runningReplies = struct {
+		sync.Mutex
+		m map[string]context.CancelCauseFunc
+	}{m: make(map[string]context.CancelCauseFunc)}
+)
+
+// startStoppableReply returns the app context with requests that are cancelled when the reply of the dialog is
+// stopped. The returned function has to be called once the reply is finished.
+func startStoppableReply(appContext *AppContext, dialogId string) (*AppContext, func()) {
+	ctx, cancel := context.WithCancelCause(appContext.Context)
+
+	runningReplies.Lock()
+	runningReplies.m[dialogId] = cancel
+	runningReplies.Unlock()
+
+	replyContext := *appContext
+	replyContext.Context = ctx
+
+	return &replyContext, func() {
+		runningReplies.Lock()
+		delete(runningReplies.m, dialogId)
+		runningReplies.Unlock()
+
+		cancel(nil)
+	}
+}
+
+// stopReplies cancels running replies in the dialog and its forks, returns `false` if there are none
+func stopReplies(dialogId string) bool {
+	runningReplies.Lock()
+	defer runningReplies.Unlock()
+
+	dialogKey := getDialogKeyOf(dialogId)
+
+	stopped := false
+	for replyDialogId, cancel := range runningReplies.m {
+		if getDialogKeyOf(replyDialogId) == dialogKey {
+			cancel(errReplyStopped)
+			stopped = true
+		}
+	}
+
+	return stopped
+}
+
+// isReplyStopped checks if requests of the context are cancelled by the user, not by shutdown
+func isReplyStopped(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errReplyStopped)
+}
+
+// newStopKeyboard is shown under a reply while it is being streamed
+func newStopKeyboard(appContext *AppContext, dialogId string) tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("⏹ Stop", NewCallbackData(appContext, callbackActionStop, dialogId, "")),
+		),
+	)
+}
+
+// handleStopCommand is handled out of the dialog queue, as the queue is busy with the reply to stop
+func handleStopCommand(appContext *AppContext, dialogId string, msg *tgbotapi.Message) {
+	if !stopReplies(dialogId) {
+		sendNotice(appContext, "❕There is no reply to stop", msg)
+		return
+	}
+
+	log.Debug().Str("dialog", dialogId).Msg("Reply stopped with command")
+}
+
+// handleStopCallback stops the streamed reply, its message is finished by the stream itself
+func handleStopCallback(appContext *AppContext, query *tgbotapi.CallbackQuery, dialogId string, arg string) (string, error) {
+	if stopReplies(dialogId) {
+		log.Debug().Str("dialog", dialogId).Msg("Reply stopped with button")
+	}
+
+	return "", nil
+}
@@ -0,0 +1,89 @@
+package src
+
+import (
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startStreamedReply sends a message answered with a slow stream, and waits until the streamed reply is sent
+func startStreamedReply(t *testing.T, h *testHarness) (*sync.WaitGroup, fakeTelegramCall) {
+	h.openai.streamDelay = 400 * time.Millisecond
+	h.openai.addReply("Partial", " answer", " continues", " forever", " and", " ever")
+
+	msg := h.newMessage()
+	msg.Text = "Hi"
+
+	handlers := &sync.WaitGroup{}
+	handlers.Add(1)
+	go func() {
+		defer handlers.Done()
+		handleUpdate(h.appContext, tgbotapi.Update{Message: msg})
+	}()
+
+	waitFor(t, func() bool { return len(h.telegram.callsTo("sendMessage")) > 0 }, 2*time.Second)
+
+	return handlers, h.telegram.lastCallTo("sendMessage")
+}
+
+func assertReplyStopped(t *testing.T, h *testHarness) {
+	dialog := h.dialog()
+	if len(dialog) != 2 {
+		t.Fatalf("expected the partial reply to be saved, got %q", dialog)
+	}
+
+	if got := dialog[1]; !strings.HasPrefix(got, "assistant: Partial") || !strings.HasSuffix(got, partialReplyMarker) || strings.Contains(got, "ever") {
+		t.Errorf("expected the reply to be truncated and marked, got %q", got)
+	}
+
+	if h.openai.chatRequestCount() != 1 {
+		t.Errorf("expected a single chat request, got %d", h.openai.chatRequestCount())
+	}
+
+	lastEdit := h.telegram.lastCallTo("editMessageText").Params
+	if !strings.HasSuffix(lastEdit.Get("text"), "[reply interrupted]") || strings.Contains(lastEdit.Get("reply_markup"), "Stop") {
+		t.Errorf("expected the message to be marked and the stop button to be removed, got %q with %q", lastEdit.Get("text"), lastEdit.Get("reply_markup"))
+	}
+}
+
+func TestStopCommand(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.StreamResponse = true
+	})
+
+	handlers, _ := startStreamedReply(t, h)
+
+	h.sendText("/stop")
+	handlers.Wait()
+
+	assertReplyStopped(t, h)
+}
+
+func TestStopButton(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.StreamResponse = true
+	})
+
+	handlers, reply := startStreamedReply(t, h)
+
+	if !strings.Contains(reply.Params.Get("reply_markup"), "Stop") {
+		t.Fatalf("expected the streamed reply to have the stop button, got %q", reply.Params.Get("reply_markup"))
+	}
+
+	h.pressButton(NewCallbackData(h.appContext, callbackActionStop, "user:42", ""), h.sentMessage(reply))
+	handlers.Wait()
+
+	assertReplyStopped(t, h)
+}
+
+func TestStopWithoutReply(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	h.sendText("/stop")
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); got != "❕There is no reply to stop" {
+		t.Errorf("expected a notice, got %q", got)
+	}
+}
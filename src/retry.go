@@ -0,0 +1,352 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"github.com/sashabaranov/go-openai"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultRetryAttempts = 3
+const defaultRetryInitialDelay = 500 * time.Millisecond
+const defaultRetryMaxDelay = 20 * time.Second
+const defaultRetryNoticeDelay = 3 * time.Second
+const defaultRetryMaxTotal = 60 * time.Second
+
+// retryPolicy decides which errors of a service are transient
+type retryPolicy struct {
+	name string
+	// classify checks if the request can be retried, and returns the delay requested by the server, zero if none
+	classify func(err error, hint *retryHint) (bool, time.Duration)
+	// notify shows the user a status when a delay is noticeable
+	notify bool
+}
+
+var openAIRetryPolicy = retryPolicy{name: "openai", classify: isRetryableOpenAIError, notify: true}
+
+var telegramRetryPolicy = retryPolicy{name: "telegram", classify: isRetryableTelegramError}
+
+// telegramSendRetryPolicy doesn't retry sends that may have been delivered, e.g. the ones that timed out waiting for
+// the response, as the retry would duplicate the message
+var telegramSendRetryPolicy = retryPolicy{name: "telegram", classify: isRetryableTelegramSendError}
+
+// retryHint is filled from the response by the transport, as OpenAI client errors don't have status codes
+// and headers in all cases. It is set and read in the goroutine making the request.
+type retryHint struct {
+	statusCode int
+	retryAfter time.Duration
+}
+
+type retryHintKey struct{}
+
+type retryNoticeKey struct{}
+
+// withRetryNotice makes noticeable retries of requests with the context call the function
+func withRetryNotice(ctx context.Context, notice func(delay time.Duration)) context.Context {
+	return context.WithValue(ctx, retryNoticeKey{}, notice)
+}
+
+// withRetry calls the function until it succeeds, fails with a permanent error, runs out of attempts or time,
+// or the context is cancelled. Delays grow exponentially with jitter, unless the server asks for a longer one.
+func withRetry(ctx context.Context, config *Config, policy retryPolicy, call func(ctx context.Context) error) error {
+	retryConfig := config.Retry
+
+	maxAttempts := retryConfig.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultRetryAttempts
+	}
+
+	maxDelay := getMillis(retryConfig.MaxDelayMillis, defaultRetryMaxDelay)
+	maxTotal := getMillis(retryConfig.MaxTotalMillis, defaultRetryMaxTotal)
+	started := time.Now()
+
+	for attempt := 1; ; attempt++ {
+		hint := &retryHint{}
+
+		err := call(context.WithValue(ctx, retryHintKey{}, hint))
+		if err == nil || attempt >= maxAttempts || ctx.Err() != nil {
+			return err
+		}
+
+		retry, serverDelay := policy.classify(err, hint)
+		if !retry {
+			return err
+		}
+
+		if serverDelay > maxDelay {
+			log.Warn().Err(err).Str("service", policy.name).Dur("delay", serverDelay).Msg("Requested retry delay is too long, giving up")
+			return err
+		}
+
+		delay := getBackoffDelay(retryConfig, attempt, maxDelay)
+		if serverDelay > delay {
+			delay = serverDelay
+		}
+
+		if elapsed := time.Since(started); elapsed+delay > maxTotal {
+			log.Warn().Err(err).Str("service", policy.name).Dur("elapsed", elapsed).Msg("Request failed, out of time to retry")
+			return err
+		}
+
+		log.Warn().Err(err).Str("service", policy.name).Int("attempt", attempt).Dur("delay", delay).Msg("Request failed, retrying")
+
+		if notice, ok := ctx.Value(retryNoticeKey{}).(func(time.Duration)); ok && policy.notify && delay >= getMillis(retryConfig.NoticeDelayMillis, defaultRetryNoticeDelay) {
+			notice(delay)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// getBackoffDelay doubles the delay for every attempt, and picks a random one from its upper half,
+// so clients failed at once don't retry at once
+func getBackoffDelay(retryConfig RetryConfig, attempt int, maxDelay time.Duration) time.Duration {
+	delay := getMillis(retryConfig.InitialDelayMillis, defaultRetryInitialDelay)
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func getMillis(value int, defaultValue time.Duration) time.Duration {
+	if value <= 0 {
+		return defaultValue
+	}
+
+	return time.Duration(value) * time.Millisecond
+}
+
+// retryOpenAI runs the request with a timeout, retrying it on rate limits, server and network errors
+func retryOpenAI(appContext *AppContext, endpoint string, model string, call func(ctx context.Context) error) error {
+	return withRetry(appContext.Context, appContext.Config, openAIRetryPolicy, func(ctx context.Context) error {
+		timeout := newRequestTimeout(ctx, getOpenAITimeout(appContext.Config))
+		defer timeout.stop()
+
+		started := time.Now()
+		err := timeout.wrap(call(timeout.ctx))
+		observeOpenAIRequest(appContext.Config, endpoint, model, started, err)
+
+		return err
+	})
+}
+
+// observeOpenAIRequest records the duration and the error of the request, cancelled requests are not counted as
+// errors, as the user or shutdown cancelled them
+func observeOpenAIRequest(config *Config, endpoint string, model string, started time.Time, err error) {
+	model = getModelLabel(config, model)
+	openAIRequestDuration.observe(time.Since(started).Seconds(), endpoint, model)
+
+	if err != nil && !errors.Is(err, context.Canceled) {
+		openAIErrors.inc(endpoint, model)
+	}
+}
+
+func isRetryableOpenAIError(err error, hint *retryHint) (bool, time.Duration) {
+	if errors.Is(err, errRequestTimeout) {
+		return true, 0
+	}
+
+	// waiting doesn't restore the quota
+	if getOpenAIErrorCode(err) == "insufficient_quota" {
+		return false, 0
+	}
+
+	statusCode := hint.statusCode
+
+	var apiErr *openai.APIError
+	var requestErr *openai.RequestError
+	if errors.As(err, &apiErr) && apiErr.StatusCode != 0 {
+		statusCode = apiErr.StatusCode
+	} else if errors.As(err, &requestErr) && requestErr.StatusCode != 0 {
+		statusCode = requestErr.StatusCode
+	}
+
+	if statusCode != 0 && statusCode != http.StatusOK {
+		return isRetryableStatus(statusCode), hint.retryAfter
+	}
+
+	return isNetworkError(err), 0
+}
+
+// sendWithRetry sends the message to the chat with callTelegram
+func sendWithRetry(appContext *AppContext, chatId int64, chattable tgbotapi.Chattable) (tgbotapi.Message, error) {
+	var msg tgbotapi.Message
+	err := callTelegram(appContext, chatId, getTelegramRetryPolicy(chattable), func() error {
+		var err error
+		msg, err = appContext.TelegramBot.Send(chattable)
+		return err
+	})
+
+	return msg, err
+}
+
+// requestWithRetry makes a request to the chat that returns no message, e.g. deletes a message or answers a button
+// press, with callTelegram
+func requestWithRetry(appContext *AppContext, chatId int64, chattable tgbotapi.Chattable) error {
+	return callTelegram(appContext, chatId, getTelegramRetryPolicy(chattable), func() error {
+		_, err := appContext.TelegramBot.Request(chattable)
+		return err
+	})
+}
+
+// getTelegramRetryPolicy returns the policy to retry the request with. Edits, deletions, chat actions and button
+// answers have the same effect when repeated, anything else may send a message twice.
+func getTelegramRetryPolicy(chattable tgbotapi.Chattable) retryPolicy {
+	switch chattable.(type) {
+	case tgbotapi.EditMessageTextConfig, tgbotapi.EditMessageReplyMarkupConfig, tgbotapi.EditMessageCaptionConfig,
+		tgbotapi.DeleteMessageConfig, tgbotapi.ChatActionConfig, tgbotapi.CallbackConfig:
+		return telegramRetryPolicy
+	default:
+		return telegramSendRetryPolicy
+	}
+}
+
+// callTelegram makes the request to the chat within Telegram limits, retrying it with the policy. Every message,
+// edit, deletion, chat action and button answer is made with it, so they all count against the limits. Reads and
+// registering the bot on start are not limited.
+func callTelegram(appContext *AppContext, chatId int64, policy retryPolicy, call func() error) error {
+	err := withRetry(appContext.Context, appContext.Config, policy, func(ctx context.Context) error {
+		// the wait is short and not interrupted, as the final text of a stopped reply still has to be sent
+		time.Sleep(reserveTelegramSend(appContext.Config, chatId))
+
+		err := call()
+
+		var telegramErr *tgbotapi.Error
+		if errors.As(err, &telegramErr) && telegramErr.RetryAfter > 0 {
+			delayTelegramChat(appContext.Config, chatId, time.Duration(telegramErr.RetryAfter)*time.Second)
+		}
+
+		return err
+	})
+
+	if err != nil {
+		telegramSendFailures.inc(getTelegramErrorCode(err))
+	}
+
+	return err
+}
+
+// getTelegramErrorCode returns the code of the error returned by Telegram, or `network` if there is no response
+func getTelegramErrorCode(err error) string {
+	var telegramErr *tgbotapi.Error
+	if errors.As(err, &telegramErr) {
+		return strconv.Itoa(telegramErr.Code)
+	}
+
+	return "network"
+}
+
+func isRetryableTelegramError(err error, _ *retryHint) (bool, time.Duration) {
+	var telegramErr *tgbotapi.Error
+	if errors.As(err, &telegramErr) {
+		if telegramErr.RetryAfter > 0 {
+			return true, time.Duration(telegramErr.RetryAfter) * time.Second
+		}
+
+		return isRetryableStatus(telegramErr.Code), 0
+	}
+
+	return isNetworkError(err), 0
+}
+
+// isRetryableTelegramSendError retries sends on flood limits and server errors, which Telegram returns for messages
+// it did not send, and on failures to connect. Other network errors may happen after the message was sent.
+func isRetryableTelegramSendError(err error, hint *retryHint) (bool, time.Duration) {
+	var telegramErr *tgbotapi.Error
+	if errors.As(err, &telegramErr) {
+		return isRetryableTelegramError(err, hint)
+	}
+
+	return isConnectError(err), 0
+}
+
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError
+}
+
+// isNetworkError checks if the request failed to connect, timed out or the connection was dropped
+func isNetworkError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isConnectError checks if the request failed before it was sent, as the connection could not be made
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// retryHintTransport passes the status code and the delay requested by OpenAI to the retry of the request
+type retryHintTransport struct {
+	base http.RoundTripper
+}
+
+func (t *retryHintTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	if hint, ok := req.Context().Value(retryHintKey{}).(*retryHint); ok {
+		hint.statusCode = resp.StatusCode
+		hint.retryAfter = getRetryAfter(resp)
+	}
+
+	return resp, nil
+}
+
+// getRetryAfter reads the delay from `Retry-After` headers, or from rate limit headers if a limit is exhausted
+func getRetryAfter(resp *http.Response) time.Duration {
+	if millis, err := strconv.ParseFloat(resp.Header.Get("retry-after-ms"), 64); err == nil {
+		return time.Duration(millis * float64(time.Millisecond))
+	}
+
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+
+		if date, err := http.ParseTime(retryAfter); err == nil {
+			return time.Until(date)
+		}
+	}
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return 0
+	}
+
+	// reset times look like `1s` or `6m0s`
+	var retryAfter time.Duration
+	for _, limit := range []string{"requests", "tokens"} {
+		if resp.Header.Get("x-ratelimit-remaining-"+limit) != "0" {
+			continue
+		}
+
+		reset, err := time.ParseDuration(resp.Header.Get("x-ratelimit-reset-" + limit))
+		if err == nil && reset > retryAfter {
+			retryAfter = reset
+		}
+	}
+
+	return retryAfter
+}
@@ -0,0 +1,59 @@
+package src
+
+import (
+	"fmt"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+// retryStatus tells the user that the reply is delayed by retries, the status is removed once the reply is done
+type retryStatus struct {
+	appContext *AppContext
+	replyTo    *tgbotapi.Message
+
+	mu    sync.Mutex
+	msgId int
+}
+
+func newRetryStatus(appContext *AppContext, replyTo *tgbotapi.Message) *retryStatus {
+	return &retryStatus{appContext: appContext, replyTo: replyTo}
+}
+
+func (s *retryStatus) show(delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	text := fmt.Sprintf("⏳ The model is busy, retrying in %s…", delay.Round(time.Second))
+
+	if s.msgId != 0 {
+		updateMsg(s.appContext, s.replyTo.Chat.ID, s.msgId, text)
+		return
+	}
+
+	msg := tgbotapi.NewMessage(s.replyTo.Chat.ID, text)
+	msg.DisableNotification = true
+
+	if s.appContext.Config.SendReplies {
+		msg.ReplyToMessageID = s.replyTo.MessageID
+	}
+
+	sentMsg, err := sendWithRetry(s.appContext, s.replyTo.Chat.ID, msg)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to send retry status")
+		return
+	}
+
+	s.msgId = sentMsg.MessageID
+}
+
+func (s *retryStatus) hide() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.msgId != 0 {
+		deleteMessage(s.appContext, s.replyTo.Chat.ID, s.msgId)
+		s.msgId = 0
+	}
+}
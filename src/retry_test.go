@@ -0,0 +1,231 @@
+package src
+
+import (
+	"context"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryServerError(t *testing.T) {
+	h := newTestHarness(t, withFastRetries)
+
+	h.openai.addError(http.StatusInternalServerError, "server_error")
+	h.openai.addError(http.StatusBadGateway, "bad_gateway")
+
+	h.sendText("Hi")
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); got != fakeReplyText {
+		t.Errorf("expected the reply after retries, got %q", got)
+	}
+
+	if got := h.openai.chatRequestCount(); got != 3 {
+		t.Errorf("expected 3 chat requests, got %d", got)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	h := newTestHarness(t, withFastRetries)
+
+	for i := 0; i < 3; i++ {
+		h.openai.addError(http.StatusServiceUnavailable, "overloaded")
+	}
+
+	h.sendText("Hi")
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); !strings.HasPrefix(got, "‼ Failed to get reply") {
+		t.Errorf("expected an error message, got %q", got)
+	}
+
+	if got := h.openai.chatRequestCount(); got != 3 {
+		t.Errorf("expected 3 chat requests, got %d", got)
+	}
+}
+
+func TestNoRetryOnPermanentErrors(t *testing.T) {
+	h := newTestHarness(t, withFastRetries)
+
+	h.openai.addError(http.StatusTooManyRequests, "insufficient_quota")
+	h.sendText("Hi")
+
+	if got := h.openai.chatRequestCount(); got != 1 {
+		t.Errorf("expected exhausted quota not to be retried, got %d requests", got)
+	}
+}
+
+func TestRetryStreamRateLimit(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		withFastRetries(config)
+		config.StreamResponse = true
+		config.Retry.NoticeDelayMillis = 500
+	})
+
+	h.openai.addRateLimit(map[string]string{"Retry-After": "1"})
+
+	started := time.Now()
+	h.sendText("Hi")
+
+	if elapsed := time.Since(started); elapsed < time.Second {
+		t.Errorf("expected the retry to wait for the requested delay, took %s", elapsed)
+	}
+
+	status := h.telegram.callsTo("sendMessage")[0]
+	if got := status.Params.Get("text"); got != "⏳ The model is busy, retrying in 1s…" {
+		t.Fatalf("expected a retry status, got %q", got)
+	}
+
+	deleted := h.telegram.callsTo("deleteMessage")
+	if len(deleted) != 1 || parseInt(deleted[0].Params.Get("message_id")) != int64(status.MessageID) {
+		t.Errorf("expected the retry status to be deleted")
+	}
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); got != fakeReplyText {
+		t.Errorf("expected the reply after the retry, got %q", got)
+	}
+}
+
+func TestStreamTimeout(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		withFastRetries(config)
+		config.StreamResponse = true
+		config.OpenAITimeout = 1
+	})
+
+	h.openai.streamDelay = 1500 * time.Millisecond
+	h.openai.addReply("Partial", " answer")
+
+	h.sendText("Hi")
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); !strings.Contains(got, errRequestTimeout.Error()) {
+		t.Errorf("expected a timeout error, got %q", got)
+	}
+
+	if got := h.dialog(); len(got) != 2 || got[1] != "assistant: Partial"+partialReplyMarker {
+		t.Errorf("expected the partial reply to be saved, got %q", got)
+	}
+}
+
+func TestRetryTelegramFloodLimit(t *testing.T) {
+	h := newTestHarness(t, withFastRetries)
+
+	h.telegram.floodNext("sendMessage", 1)
+
+	started := time.Now()
+	h.sendText("Hi")
+
+	if elapsed := time.Since(started); elapsed < time.Second {
+		t.Errorf("expected the retry to wait for retry_after, took %s", elapsed)
+	}
+
+	calls := h.telegram.callsTo("sendMessage")
+	if len(calls) != 2 || calls[1].Params.Get("text") != fakeReplyText {
+		t.Errorf("expected the reply to be sent again, got %d calls", len(calls))
+	}
+}
+
+func TestTelegramSendIsNotRetriedOnTimeout(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		withFastRetries(config)
+		config.TelegramTimeout = 1
+	})
+
+	// the reply is delivered, but the response comes too late
+	h.telegram.slowNext("sendMessage", 1500*time.Millisecond)
+	h.sendText("Hi")
+
+	replies := 0
+	for _, call := range h.telegram.callsTo("sendMessage") {
+		if call.Params.Get("text") == fakeReplyText {
+			replies++
+		}
+	}
+
+	if replies != 1 {
+		t.Errorf("expected the reply to be sent once, got %d", replies)
+	}
+}
+
+func TestTelegramRetryPolicy(t *testing.T) {
+	dialErr := &url.Error{Op: "Post", Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}
+	timeoutErr := &url.Error{Op: "Post", Err: context.DeadlineExceeded}
+
+	tests := []struct {
+		name      string
+		chattable tgbotapi.Chattable
+		err       error
+		retry     bool
+	}{
+		{"send not connected", tgbotapi.NewMessage(1, "text"), dialErr, true},
+		{"send timed out", tgbotapi.NewMessage(1, "text"), timeoutErr, false},
+		{"send server error", tgbotapi.NewMessage(1, "text"), &tgbotapi.Error{Code: 502}, true},
+		{"send bad request", tgbotapi.NewMessage(1, "text"), &tgbotapi.Error{Code: 400}, false},
+		{"edit timed out", tgbotapi.NewEditMessageText(1, 2, "text"), timeoutErr, true},
+		{"deletion timed out", tgbotapi.NewDeleteMessage(1, 2), timeoutErr, true},
+	}
+
+	for _, test := range tests {
+		if retry, _ := getTelegramRetryPolicy(test.chattable).classify(test.err, &retryHint{}); retry != test.retry {
+			t.Errorf("%s: expected retry to be %t", test.name, test.retry)
+		}
+	}
+}
+
+func TestGetRetryAfter(t *testing.T) {
+	cases := []struct {
+		status   int
+		headers  map[string]string
+		expected time.Duration
+	}{
+		{http.StatusTooManyRequests, map[string]string{"Retry-After": "3"}, 3 * time.Second},
+		{http.StatusServiceUnavailable, map[string]string{"retry-after-ms": "250"}, 250 * time.Millisecond},
+		{http.StatusTooManyRequests, map[string]string{
+			"x-ratelimit-remaining-requests": "10",
+			"x-ratelimit-reset-requests":     "1s",
+			"x-ratelimit-remaining-tokens":   "0",
+			"x-ratelimit-reset-tokens":       "6m0s",
+		}, 6 * time.Minute},
+		{http.StatusInternalServerError, map[string]string{"x-ratelimit-remaining-tokens": "0", "x-ratelimit-reset-tokens": "1s"}, 0},
+	}
+
+	for _, c := range cases {
+		resp := &http.Response{StatusCode: c.status, Header: http.Header{}}
+		for name, value := range c.headers {
+			resp.Header.Set(name, value)
+		}
+
+		if got := getRetryAfter(resp); got != c.expected {
+			t.Errorf("expected %s for %v, got %s", c.expected, c.headers, got)
+		}
+	}
+}
+
+func TestRetryTimeBudget(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		withFastRetries(config)
+		config.StreamResponse = true
+		config.OpenAITimeout = 1
+		config.Retry.MaxTotalMillis = 500
+	})
+
+	h.openai.responseDelay = 1500 * time.Millisecond
+
+	started := time.Now()
+	h.sendText("Hi")
+
+	if got := h.openai.chatRequestCount(); got != 1 {
+		t.Errorf("expected a timed out request not to be retried after the budget, got %d requests", got)
+	}
+
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("expected the reply to fail after a single timeout, took %s", elapsed)
+	}
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); !strings.Contains(got, errRequestTimeout.Error()) {
+		t.Errorf("expected a timeout error, got %q", got)
+	}
+}
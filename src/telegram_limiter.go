@@ -0,0 +1,121 @@
+package src
+
+import (
+	"sync"
+	"time"
+)
+
+// messages in a chat can be sent in short bursts, as long as the average rate is kept
+const telegramChatBurst = 3
+
+// the state of chats that have been quiet for a while is the same as of unknown ones, so it is pruned
+const telegramLimiterPruneSize = 1000
+
+var (
+	// telegramLimiter spaces out outbound messages to stay within Telegram limits. The next free slot is tracked
+	// overall and per chat, allowing bursts by the cell rate algorithm.
+	telegramLimiter = struct {
+		sync.Mutex
+		global time.Time
+		chats  map[int64]time.Time
+	}{chats: make(map[int64]time.Time)}
+)
+
+// getTelegramIntervals returns the average intervals between messages overall and in the chat, with bursts allowed
+// within the tolerances. Group chats have negative ids.
+func getTelegramIntervals(config *Config, chatId int64) (globalInterval, globalTolerance, chatInterval, chatTolerance time.Duration) {
+	limits := config.TelegramLimits
+
+	messagesPerSecond := limits.MessagesPerSecond
+	if messagesPerSecond <= 0 {
+		messagesPerSecond = 30
+	}
+
+	globalInterval = time.Duration(float64(time.Second) / messagesPerSecond)
+	// a second worth of messages can be sent at once
+	globalTolerance = time.Second - globalInterval
+
+	if chatId < 0 {
+		groupMessagesPerMinute := limits.GroupMessagesPerMinute
+		if groupMessagesPerMinute <= 0 {
+			groupMessagesPerMinute = 20
+		}
+
+		chatInterval = time.Duration(float64(time.Minute) / groupMessagesPerMinute)
+	} else {
+		chatMessagesPerSecond := limits.ChatMessagesPerSecond
+		if chatMessagesPerSecond <= 0 {
+			chatMessagesPerSecond = 1
+		}
+
+		chatInterval = time.Duration(float64(time.Second) / chatMessagesPerSecond)
+	}
+
+	chatTolerance = (telegramChatBurst - 1) * chatInterval
+
+	return
+}
+
+// reserveTelegramSend takes the next slot for a message to the chat, returns how long to wait for it
+func reserveTelegramSend(config *Config, chatId int64) time.Duration {
+	telegramLimiter.Lock()
+	defer telegramLimiter.Unlock()
+
+	now := time.Now()
+	globalInterval, globalTolerance, chatInterval, chatTolerance := getTelegramIntervals(config, chatId)
+
+	at := now
+	if slot := telegramLimiter.global.Add(-globalTolerance); slot.After(at) {
+		at = slot
+	}
+
+	if slot := telegramLimiter.chats[chatId].Add(-chatTolerance); slot.After(at) {
+		at = slot
+	}
+
+	// a message held by its chat limit is counted overall right away, so it doesn't hold messages to other chats
+	telegramLimiter.global = laterTime(telegramLimiter.global, now).Add(globalInterval)
+	telegramLimiter.chats[chatId] = laterTime(telegramLimiter.chats[chatId], at).Add(chatInterval)
+
+	if len(telegramLimiter.chats) > telegramLimiterPruneSize {
+		for id, next := range telegramLimiter.chats {
+			if next.Before(now) {
+				delete(telegramLimiter.chats, id)
+			}
+		}
+	}
+
+	return at.Sub(now)
+}
+
+// getTelegramSendDelay returns how long a message to the chat would wait, without taking the slot
+func getTelegramSendDelay(config *Config, chatId int64) time.Duration {
+	telegramLimiter.Lock()
+	defer telegramLimiter.Unlock()
+
+	now := time.Now()
+	_, globalTolerance, _, chatTolerance := getTelegramIntervals(config, chatId)
+
+	at := laterTime(now, laterTime(telegramLimiter.global.Add(-globalTolerance), telegramLimiter.chats[chatId].Add(-chatTolerance)))
+
+	return at.Sub(now)
+}
+
+// delayTelegramChat holds messages to the chat after Telegram asked to retry later
+func delayTelegramChat(config *Config, chatId int64, retryAfter time.Duration) {
+	telegramLimiter.Lock()
+	defer telegramLimiter.Unlock()
+
+	_, _, _, chatTolerance := getTelegramIntervals(config, chatId)
+
+	next := time.Now().Add(retryAfter + chatTolerance)
+	telegramLimiter.chats[chatId] = laterTime(telegramLimiter.chats[chatId], next)
+}
+
+func laterTime(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+
+	return b
+}
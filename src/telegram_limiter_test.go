@@ -0,0 +1,116 @@
+package src
+
+import (
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"testing"
+	"time"
+)
+
+func TestTelegramLimiterChatBurst(t *testing.T) {
+	h := newTestHarness(t, withTelegramLimits)
+
+	const groupId = -100
+
+	for i := 0; i < telegramChatBurst; i++ {
+		if delay := reserveTelegramSend(h.appContext.Config, groupId); delay != 0 {
+			t.Fatalf("expected message %d of a burst to be sent at once, got delay %s", i+1, delay)
+		}
+	}
+
+	// 20 messages per minute in groups
+	if delay := reserveTelegramSend(h.appContext.Config, groupId); delay < 2900*time.Millisecond || delay > 3*time.Second {
+		t.Errorf("expected the message after a burst to wait about 3s, got %s", delay)
+	}
+
+	if delay := reserveTelegramSend(h.appContext.Config, testChatId); delay != 0 {
+		t.Errorf("expected other chats not to wait, got %s", delay)
+	}
+}
+
+func TestTelegramLimiterGlobalRate(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		withTelegramLimits(config)
+		config.TelegramLimits.MessagesPerSecond = 10
+	})
+
+	for chatId := int64(1); chatId <= 10; chatId++ {
+		if delay := reserveTelegramSend(h.appContext.Config, chatId); delay != 0 {
+			t.Fatalf("expected a second worth of messages to be sent at once, got delay %s", delay)
+		}
+	}
+
+	if delay := getTelegramSendDelay(h.appContext.Config, 11); delay < 90*time.Millisecond || delay > 100*time.Millisecond {
+		t.Errorf("expected the next message to wait about 100ms, got %s", delay)
+	}
+}
+
+func TestTelegramLimiterRetryAfter(t *testing.T) {
+	h := newTestHarness(t, withTelegramLimits)
+
+	delayTelegramChat(h.appContext.Config, testChatId, 5*time.Second)
+
+	if delay := getTelegramSendDelay(h.appContext.Config, testChatId); delay < 4900*time.Millisecond || delay > 5*time.Second {
+		t.Errorf("expected the chat to wait for retry_after, got %s", delay)
+	}
+}
+
+func TestSentReplySkipsIdenticalEdits(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	keyboard := newStopKeyboard(h.appContext, "user:42")
+
+	reply := &sentReply{}
+	reply.sync(h.appContext, testChatId, 0, "Hello", &keyboard)
+	reply.sync(h.appContext, testChatId, 0, "Hello", &keyboard)
+
+	if got := len(h.telegram.callsTo("editMessageText")); got != 0 {
+		t.Errorf("expected the identical text not to be edited, got %d edits", got)
+	}
+
+	reply.sync(h.appContext, testChatId, 0, "Hello", nil)
+
+	if got := len(h.telegram.callsTo("editMessageText")); got != 1 {
+		t.Errorf("expected the keyboard to be removed with an edit, got %d edits", got)
+	}
+}
+
+func TestNotModifiedEditIsNotRetried(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	h.telegram.failNext("editMessageText", "Bad Request: message is not modified: specified new message content and reply markup are exactly the same")
+
+	updateMsg(h.appContext, testChatId, 1, "Hello")
+
+	if got := len(h.telegram.callsTo("editMessageText")); got != 1 {
+		t.Errorf("expected a single edit, got %d", got)
+	}
+}
+
+func TestAllTelegramRequestsAreLimited(t *testing.T) {
+	h := newTestHarness(t, withTelegramLimits)
+
+	// the wait is counted from the burst, as the chat limit is
+	started := time.Now()
+	for i := 0; i < telegramChatBurst; i++ {
+		reserveTelegramSend(h.appContext.Config, testChatId)
+	}
+
+	// the typing status is skipped rather than delaying messages
+	close(StartTypingStatus(h.appContext, testChatId))
+	time.Sleep(100 * time.Millisecond)
+
+	if got := len(h.telegram.callsTo("sendChatAction")); got != 0 {
+		t.Errorf("expected the typing status to be skipped in a busy chat, got %d", got)
+	}
+
+	deleteMessage(h.appContext, testChatId, 1)
+	answerCallbackQuery(h.appContext, &tgbotapi.CallbackQuery{ID: "query", Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: testChatId}}}, "")
+
+	if elapsed := time.Since(started); elapsed < 1900*time.Millisecond {
+		t.Errorf("expected requests to wait for the chat limit, took %s", elapsed)
+	}
+
+	if len(h.telegram.callsTo("deleteMessage")) != 1 || len(h.telegram.callsTo("answerCallbackQuery")) != 1 {
+		t.Errorf("expected the requests to be made")
+	}
+}
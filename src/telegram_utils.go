@@ -16,3 +16,23 @@ func GetFormattedUserName(userName string, userId int64) string {
 func GetFormattedSenderName(msg *tgbotapi.Message) string {
 	return GetFormattedUserName(msg.From.UserName, msg.From.ID)
 }
+
+// toMessageIds converts message ids to the type they are stored with in dialog messages
+func toMessageIds(messageIds []int) []int64 {
+	result := make([]int64, 0, len(messageIds))
+	for _, messageId := range messageIds {
+		result = append(result, int64(messageId))
+	}
+
+	return result
+}
+
+// GetFileURL returns a link to download the file, respecting a self-hosted Bot API server
+func GetFileURL(appContext *AppContext, file tgbotapi.File) string {
+	fileEndpoint := appContext.Config.TelegramFileEndpoint
+	if fileEndpoint == "" {
+		fileEndpoint = tgbotapi.FileEndpoint
+	}
+
+	return fmt.Sprintf(fileEndpoint, appContext.TelegramBot.Token, file.FilePath)
+}
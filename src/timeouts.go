@@ -0,0 +1,110 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultOpenAITimeout = 120 * time.Second
+const defaultTelegramTimeout = 15 * time.Second
+
+var errRequestTimeout = errors.New("request timed out")
+
+func getOpenAITimeout(config *Config) time.Duration {
+	if config.OpenAITimeout <= 0 {
+		return defaultOpenAITimeout
+	}
+
+	return time.Duration(config.OpenAITimeout) * time.Second
+}
+
+func getTelegramTimeout(config *Config) time.Duration {
+	if config.TelegramTimeout <= 0 {
+		return defaultTelegramTimeout
+	}
+
+	return time.Duration(config.TelegramTimeout) * time.Second
+}
+
+// requestTimeout cancels its context unless it is reset in time, so streams time out waiting for the next part,
+// not for the whole reply
+type requestTimeout struct {
+	ctx      context.Context
+	cancel   context.CancelCauseFunc
+	timer    *time.Timer
+	duration time.Duration
+}
+
+func newRequestTimeout(ctx context.Context, duration time.Duration) *requestTimeout {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	return &requestTimeout{
+		ctx:      ctx,
+		cancel:   cancel,
+		timer:    time.AfterFunc(duration, func() { cancel(errRequestTimeout) }),
+		duration: duration,
+	}
+}
+
+func (t *requestTimeout) reset() {
+	t.timer.Reset(t.duration)
+}
+
+func (t *requestTimeout) stop() {
+	t.timer.Stop()
+	t.cancel(nil)
+}
+
+// wrap replaces the error caused by the timeout with `errRequestTimeout`, so it is not taken for a cancellation
+func (t *requestTimeout) wrap(err error) error {
+	if err != nil && errors.Is(context.Cause(t.ctx), errRequestTimeout) {
+		return errRequestTimeout
+	}
+
+	return err
+}
+
+// telegramTimeoutTransport limits the time of Telegram requests, except long polling that waits for updates
+// on purpose. Successful polls are recorded for the readiness check.
+type telegramTimeoutTransport struct {
+	timeout time.Duration
+	base    http.RoundTripper
+}
+
+func (t *telegramTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.HasSuffix(req.URL.Path, "/getUpdates") {
+		resp, err := t.base.RoundTrip(req)
+		if err == nil && resp.StatusCode == http.StatusOK {
+			recordTelegramPoll()
+		}
+
+		return resp, err
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// the body is read after the request returns, so the timeout ends when it is closed
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
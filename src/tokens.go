@@ -0,0 +1,154 @@
+package src
+
+import (
+	"github.com/pkoukk/tiktoken-go"
+	"github.com/pkoukk/tiktoken-go-loader"
+	"github.com/rs/zerolog/log"
+	"openai-telegram-bot/src/protos"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// every message is wrapped into `<|start|>{role}\n{content}<|end|>\n`, and every reply is primed with
+// `<|start|>assistant<|message|>`
+const tokensPerMessage = 3
+const tokensPerReply = 3
+
+// encodings of chat models by a model name prefix, the longest matching prefix is used. Models that are not known,
+// e.g. deployments of OpenAI-compatible servers, are counted with `cl100k_base`.
+var modelEncodings = map[string]string{
+	"gpt-3.5-turbo": tiktoken.MODEL_CL100K_BASE,
+	"gpt-4":         tiktoken.MODEL_CL100K_BASE,
+	"gpt-4o":        tiktoken.MODEL_O200K_BASE,
+	"chatgpt-4o":    tiktoken.MODEL_O200K_BASE,
+	"gpt-4.1":       tiktoken.MODEL_O200K_BASE,
+	"gpt-4.5":       tiktoken.MODEL_O200K_BASE,
+	"gpt-5":         tiktoken.MODEL_O200K_BASE,
+	"o1":            tiktoken.MODEL_O200K_BASE,
+	"o3":            tiktoken.MODEL_O200K_BASE,
+	"o4":            tiktoken.MODEL_O200K_BASE,
+}
+
+// default context sizes by a model name prefix, the longest matching prefix is used
+var modelContextLimits = map[string]int{
+	"gpt-3.5-turbo":      16385,
+	"gpt-3.5-turbo-0301": 4096,
+	"gpt-3.5-turbo-0613": 4096,
+	"gpt-3.5-turbo-16k":  16385,
+	"gpt-4":              8192,
+	"gpt-4-32k":          32768,
+	"gpt-4-1106":         128000,
+	"gpt-4-0125":         128000,
+	"gpt-4-turbo":        128000,
+	"gpt-4-vision":       128000,
+	"gpt-4o":             128000,
+	"chatgpt-4o":         128000,
+	"gpt-4.1":            1047576,
+	"gpt-4.5":            128000,
+	"gpt-5":              400000,
+	"o1":                 200000,
+	"o1-mini":            128000,
+	"o1-preview":         128000,
+	"o3":                 200000,
+	"o4":                 200000,
+}
+
+const defaultContextLimit = 4096
+
+var (
+	// encoders are built from BPE ranks embedded into the binary, which takes a while, so they are built once
+	tokenEncoders = struct {
+		sync.Mutex
+		m map[string]*tiktoken.Tiktoken
+	}{m: make(map[string]*tiktoken.Tiktoken)}
+)
+
+func getTokenEncoder(model string) (*tiktoken.Tiktoken, error) {
+	encoding, ok := getByModelPrefix(modelEncodings, model)
+	if !ok {
+		encoding = tiktoken.MODEL_CL100K_BASE
+	}
+
+	tokenEncoders.Lock()
+	defer tokenEncoders.Unlock()
+
+	if encoder, ok := tokenEncoders.m[encoding]; ok {
+		return encoder, nil
+	}
+
+	// ranks are not downloaded, so the bot does not depend on network access to count tokens
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+
+	encoder, err := tiktoken.GetEncoding(encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenEncoders.m[encoding] = encoder
+
+	return encoder, nil
+}
+
+// CountTextTokens returns a number of tokens in the text, as the tokenizer of the model splits it
+func CountTextTokens(text string, model string) int {
+	encoder, err := getTokenEncoder(model)
+	if err != nil {
+		log.Error().Err(err).Str("model", model).Msg("Failed to get token encoder")
+		// a token is never shorter than a character, so the dialog is not sent if it may not fit
+		return utf8.RuneCountInString(text)
+	}
+
+	// special tokens in messages are counted as plain text, as that is how they are sent
+	return len(encoder.Encode(text, nil, nil))
+}
+
+// EstimateTokens returns a number of prompt tokens the messages take when sent to the model. Texts are counted
+// exactly, and the formatting around messages is estimated.
+func EstimateTokens(messages []*protos.DialogMessage, model string) int {
+	tokens := tokensPerReply
+	for _, msg := range messages {
+		tokens += estimateMessageTokens(msg, model)
+	}
+
+	return tokens
+}
+
+// estimateMessageTokens returns a number of tokens a single message adds to the prompt
+func estimateMessageTokens(msg *protos.DialogMessage, model string) int {
+	perMessage := tokensPerMessage
+	if strings.HasPrefix(model, "gpt-3.5-turbo-0301") {
+		// this snapshot uses an additional separator token for every message
+		perMessage++
+	}
+
+	return perMessage + CountTextTokens(msg.Role, model) + CountTextTokens(msg.Content, model)
+}
+
+// GetModelContextLimit returns the context size of the model, as specified in config or known by default
+func GetModelContextLimit(config *Config, model string) int {
+	if limit, ok := getByModelPrefix(config.ContextLimits, model); ok && limit > 0 {
+		return limit
+	}
+
+	if limit, ok := getByModelPrefix(modelContextLimits, model); ok {
+		return limit
+	}
+
+	return defaultContextLimit
+}
+
+// getByModelPrefix returns a value of the longest key the model name starts with, `false` if none matches
+func getByModelPrefix[T any](values map[string]T, model string) (T, bool) {
+	var value T
+	matchLength := -1
+
+	for prefix, prefixValue := range values {
+		if strings.HasPrefix(model, prefix) && len(prefix) > matchLength {
+			value = prefixValue
+			matchLength = len(prefix)
+		}
+	}
+
+	return value, matchLength >= 0
+}
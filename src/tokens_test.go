@@ -0,0 +1,80 @@
+package src
+
+import (
+	"github.com/sashabaranov/go-openai"
+	"openai-telegram-bot/src/protos"
+	"testing"
+)
+
+func TestCountTextTokens(t *testing.T) {
+	tests := []struct {
+		text     string
+		model    string
+		expected int
+	}{
+		{"hello world", "gpt-3.5-turbo", 2},
+		{"hello world", "gpt-4o-mini", 2},
+		{"", "gpt-4", 0},
+		{"tiktoken is great!", "gpt-4", 6},
+		// special tokens sent by users are plain text
+		{"<|endoftext|>", "gpt-4", 7},
+		// unknown models are counted with cl100k_base
+		{"tiktoken is great!", "my-llama", 6},
+	}
+
+	for _, test := range tests {
+		if got := CountTextTokens(test.text, test.model); got != test.expected {
+			t.Errorf("expected %q to take %d tokens of %s, got %d", test.text, test.expected, test.model, got)
+		}
+	}
+
+	// the encodings split non-latin text differently
+	text := "Привет, как дела? Расскажи что-нибудь интересное"
+	if CountTextTokens(text, "gpt-4o") >= CountTextTokens(text, "gpt-4") {
+		t.Errorf("expected o200k_base to be used for gpt-4o")
+	}
+}
+
+func TestEstimateTokens(t *testing.T) {
+	messages := []*protos.DialogMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: "You are a helpful assistant."},
+		{Role: openai.ChatMessageRoleUser, Content: "Hello!"},
+	}
+
+	// the count OpenAI reports for these messages
+	if got := EstimateTokens(messages, "gpt-3.5-turbo"); got != 19 {
+		t.Errorf("expected 19 prompt tokens, got %d", got)
+	}
+}
+
+func TestGetModelContextLimit(t *testing.T) {
+	config := &Config{ContextLimits: map[string]int{"gpt-4o-mini": 1000, "my-llama": 32000}}
+
+	tests := []struct {
+		model    string
+		expected int
+	}{
+		{"gpt-3.5-turbo", 16385},
+		{"gpt-3.5-turbo-0613", 4096},
+		{"gpt-4", 8192},
+		{"gpt-4-0613", 8192},
+		{"gpt-4-32k-0613", 32768},
+		{"gpt-4-1106-preview", 128000},
+		{"gpt-4-turbo-2024-04-09", 128000},
+		{"gpt-4o", 128000},
+		{"gpt-4o-2024-08-06", 128000},
+		{"gpt-4.1-mini", 1047576},
+		{"o1-mini", 128000},
+		{"o3-mini", 200000},
+		// config takes priority, also by prefix
+		{"gpt-4o-mini-2024-07-18", 1000},
+		{"my-llama-3-70b", 32000},
+		{"unknown", defaultContextLimit},
+	}
+
+	for _, test := range tests {
+		if got := GetModelContextLimit(config, test.model); got != test.expected {
+			t.Errorf("expected context limit of %s to be %d, got %d", test.model, test.expected, got)
+		}
+	}
+}
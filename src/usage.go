@@ -0,0 +1,209 @@
+package src
+
+import (
+	"fmt"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"openai-telegram-bot/src/protos"
+	"sort"
+	"strings"
+	"time"
+)
+
+const usageKeySeparator = "|"
+
+// usage is counted in UTC days and months, so counters reset at the same time for everyone
+const usageDayFormat = "2006-01-02"
+const usageMonthFormat = "2006-01"
+const usagePeriodAll = "all"
+
+// UsageOwner is who an OpenAI request is made for, the usage is accounted to both the user and the chat
+type UsageOwner struct {
+	UserId int64
+	ChatId int64
+}
+
+func NewUsageOwner(user *tgbotapi.User, chat *tgbotapi.Chat) UsageOwner {
+	owner := UsageOwner{}
+
+	if user != nil {
+		owner.UserId = user.ID
+	}
+
+	if chat != nil {
+		owner.ChatId = chat.ID
+	}
+
+	return owner
+}
+
+func getUserUsageScope(userId int64) string {
+	return fmt.Sprintf("user:%d", userId)
+}
+
+func getChatUsageScope(chatId int64) string {
+	return fmt.Sprintf("chat:%d", chatId)
+}
+
+func getUsagePeriods(now time.Time) []string {
+	now = now.UTC()
+	return []string{now.Format(usageDayFormat), now.Format(usageMonthFormat), usagePeriodAll}
+}
+
+// recordUsage adds the usage to counters of the owner. Failures are only logged, so they don't break answering.
+func recordUsage(appContext *AppContext, owner UsageOwner, model string, usage *protos.Usage) {
+	modelLabel := getModelLabel(appContext.Config, model)
+	tokensUsed.add(float64(usage.PromptTokens), modelLabel, "prompt")
+	tokensUsed.add(float64(usage.CompletionTokens), modelLabel, "completion")
+
+	var scopes []string
+	if owner.UserId != 0 {
+		scopes = append(scopes, getUserUsageScope(owner.UserId))
+	}
+
+	if owner.ChatId != 0 {
+		scopes = append(scopes, getChatUsageScope(owner.ChatId))
+	}
+
+	if len(scopes) == 0 {
+		log.Warn().Str("model", model).Msg("Usage without owner is not recorded")
+		return
+	}
+
+	err := appContext.Database.AddUsage(scopes, getUsagePeriods(time.Now()), model, usage)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to record usage")
+	}
+}
+
+// getUsageCost returns the cost of the usage, `false` if prices of some used models are not configured
+func getUsageCost(config *Config, usage map[string]*protos.Usage) (float64, bool) {
+	cost := 0.0
+	complete := true
+
+	for model, modelUsage := range usage {
+		price, ok := config.GetModelPrice(model)
+		if !ok {
+			complete = false
+			continue
+		}
+
+		cost += float64(modelUsage.PromptTokens) / 1000 * price.PromptPer1K
+		cost += float64(modelUsage.CompletionTokens) / 1000 * price.CompletionPer1K
+		cost += float64(modelUsage.Images) * price.PerImage
+		cost += float64(modelUsage.AudioSeconds) / 60 * price.PerAudioMinute
+	}
+
+	return cost, complete
+}
+
+func sumUsage(usage map[string]*protos.Usage) *protos.Usage {
+	total := &protos.Usage{}
+
+	for _, modelUsage := range usage {
+		total.Requests += modelUsage.Requests
+		total.PromptTokens += modelUsage.PromptTokens
+		total.CompletionTokens += modelUsage.CompletionTokens
+		total.Images += modelUsage.Images
+		total.AudioSeconds += modelUsage.AudioSeconds
+	}
+
+	return total
+}
+
+func formatUsage(config *Config, usage map[string]*protos.Usage) string {
+	total := sumUsage(usage)
+	if total.Requests == 0 {
+		return "nothing"
+	}
+
+	parts := []string{
+		fmt.Sprintf("%d requests", total.Requests),
+		fmt.Sprintf("%d tokens (%d prompt, %d completion)", total.PromptTokens+total.CompletionTokens,
+			total.PromptTokens, total.CompletionTokens),
+	}
+
+	if total.Images > 0 {
+		parts = append(parts, fmt.Sprintf("%d images", total.Images))
+	}
+
+	if total.AudioSeconds > 0 {
+		parts = append(parts, fmt.Sprintf("%.1f voice minutes", float64(total.AudioSeconds)/60))
+	}
+
+	if len(config.Prices) > 0 {
+		cost, complete := getUsageCost(config, usage)
+		if complete {
+			parts = append(parts, fmt.Sprintf("$%.4f", cost))
+		} else {
+			parts = append(parts, fmt.Sprintf("at least $%.4f", cost))
+		}
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+func formatScopeUsage(appContext *AppContext, scope string) (string, error) {
+	names := map[string]string{}
+	now := time.Now()
+	periods := getUsagePeriods(now)
+	names[periods[0]] = "Today"
+	names[periods[1]] = "This month"
+	names[periods[2]] = "All time"
+
+	var lines []string
+	for _, period := range periods {
+		usage, err := appContext.Database.GetUsage(scope, period)
+		if err != nil {
+			return "", err
+		}
+
+		lines = append(lines, fmt.Sprintf("%s: %s", names[period], formatUsage(appContext.Config, usage)))
+
+		if period == usagePeriodAll && len(usage) > 0 {
+			lines = append(lines, "By model: "+formatModels(usage))
+		}
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+func formatModels(usage map[string]*protos.Usage) string {
+	models := make([]string, 0, len(usage))
+	for model := range usage {
+		models = append(models, model)
+	}
+
+	sort.Strings(models)
+
+	for i, model := range models {
+		models[i] = fmt.Sprintf("%s (%d)", model, usage[model].Requests)
+	}
+
+	return strings.Join(models, ", ")
+}
+
+// sendUsage shows usage of the user, and of the chat if it is a group
+func sendUsage(appContext *AppContext, msg *tgbotapi.Message) {
+	text, err := formatScopeUsage(appContext, getUserUsageScope(msg.From.ID))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get usage")
+		sendError(appContext, "Failed to get usage", msg.Chat.ID)
+		return
+	}
+
+	text = fmt.Sprintf("📊 Usage of %s\n%s", GetFormattedSenderName(msg), text)
+
+	if isGroupChat(msg) {
+		chatText, err := formatScopeUsage(appContext, getChatUsageScope(msg.Chat.ID))
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to get chat usage")
+			sendError(appContext, "Failed to get usage", msg.Chat.ID)
+			return
+		}
+
+		text += "\n\n📊 Usage in this chat\n" + chatText
+	}
+
+	sendNotice(appContext, text, msg)
+}
@@ -0,0 +1,87 @@
+package src
+
+import (
+	"github.com/sashabaranov/go-openai"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsageRecorded(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	h.sendText("Hi")
+	h.sendText("/imagine A cat")
+	h.sendVoice("voice1", []byte("ogg"))
+
+	usage, err := h.appContext.Database.GetUsage(getUserUsageScope(testUserId), getUsagePeriods(time.Now())[0])
+	if err != nil {
+		t.Fatalf("failed to get usage: %s", err)
+	}
+
+	chatUsage := usage[openai.GPT3Dot5Turbo]
+	if chatUsage == nil || chatUsage.Requests != 2 || chatUsage.PromptTokens != 20 || chatUsage.CompletionTokens != 10 {
+		t.Errorf("expected usage of two chat completions, got %v", chatUsage)
+	}
+
+	if imageUsage := usage["dall-e-"+openai.CreateImageSize256x256]; imageUsage == nil || imageUsage.Images != 1 {
+		t.Errorf("expected an image to be counted, got %v", imageUsage)
+	}
+
+	if voiceUsage := usage[openai.Whisper1]; voiceUsage == nil || voiceUsage.AudioSeconds != 1 {
+		t.Errorf("expected a voice second to be counted, got %v", voiceUsage)
+	}
+
+	chatScopeUsage, err := h.appContext.Database.GetUsage(getChatUsageScope(testChatId), usagePeriodAll)
+	if err != nil {
+		t.Fatalf("failed to get usage: %s", err)
+	}
+
+	if len(chatScopeUsage) != 3 {
+		t.Errorf("expected the usage to be counted for the chat too, got %v", chatScopeUsage)
+	}
+}
+
+func TestStreamingUsageEstimated(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.StreamResponse = true
+	})
+
+	h.sendText("Hi")
+
+	usage, err := h.appContext.Database.GetUsage(getUserUsageScope(testUserId), usagePeriodAll)
+	if err != nil {
+		t.Fatalf("failed to get usage: %s", err)
+	}
+
+	chatUsage := usage[openai.GPT3Dot5Turbo]
+	if chatUsage == nil || chatUsage.Requests != 1 || chatUsage.PromptTokens == 0 || chatUsage.CompletionTokens == 0 {
+		t.Errorf("expected streamed usage to be estimated, got %v", chatUsage)
+	}
+}
+
+func TestUsageCommand(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.Prices = map[string]ModelPrice{
+			"gpt-3.5":       {PromptPer1K: 1, CompletionPer1K: 2},
+			"gpt-3.5-turbo": {PromptPer1K: 10, CompletionPer1K: 20},
+		}
+	})
+
+	h.sendText("/usage")
+
+	if got := h.telegram.lastCallTo("sendMessage").Params.Get("text"); !strings.Contains(got, "Today: nothing") {
+		t.Errorf("expected no usage, got %q", got)
+	}
+
+	h.sendText("Hi")
+	h.sendText("/usage")
+
+	got := h.telegram.lastCallTo("sendMessage").Params.Get("text")
+	for _, expected := range []string{"Today: 1 requests, 15 tokens (10 prompt, 5 completion), $0.2000", "All time: 1 requests",
+		"By model: gpt-3.5-turbo (1)"} {
+		if !strings.Contains(got, expected) {
+			t.Errorf("expected usage to contain %q, got %q", expected, got)
+		}
+	}
+}
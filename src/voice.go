@@ -6,12 +6,13 @@ import (
 	"github.com/sashabaranov/go-openai"
 	"io"
 	"net/http"
+	"openai-telegram-bot/src/protos"
 	"os"
 	"os/exec"
 	"path"
 )
 
-func DecodeVoice(appContext *AppContext, voice *tgbotapi.Voice) (string, error) {
+func DecodeVoice(appContext *AppContext, owner UsageOwner, voice *tgbotapi.Voice) (string, error) {
 	downloaded, err := DownloadVoice(appContext, voice)
 	if err != nil {
 		return "", err
@@ -22,11 +23,17 @@ func DecodeVoice(appContext *AppContext, voice *tgbotapi.Voice) (string, error)
 		FilePath: downloaded,
 	}
 
-	resp, err := appContext.OpenAI.CreateTranscription(context.Background(), req)
+	var resp openai.AudioResponse
+	err = retryOpenAI(appContext, "transcriptions", openai.Whisper1, func(ctx context.Context) error {
+		resp, err = appContext.Transcription.CreateTranscription(ctx, req)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
 
+	recordUsage(appContext, owner, openai.Whisper1, &protos.Usage{Requests: 1, AudioSeconds: int64(voice.Duration)})
+
 	return resp.Text, nil
 }
 
@@ -38,7 +45,7 @@ func DownloadVoice(appContext *AppContext, voice *tgbotapi.Voice) (string, error
 		return "", err
 	}
 
-	downloadUrl := file.Link(appContext.TelegramBot.Token)
+	downloadUrl := GetFileURL(appContext, file)
 
 	downloadedFilePath := path.Join(os.TempDir(), file.FileID+".ogg")
 	encodedFilePath := downloadedFilePath + ".mp3"
@@ -0,0 +1,185 @@
+package src
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const defaultWebhookListenAddress = ":8080"
+
+const webhookShutdownTimeout = 5 * time.Second
+
+const webhookSecretHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// updates are small, anything bigger is not from Telegram
+const maxWebhookBodySize = 1 << 20
+
+func getWebhookSecret(config *Config) string {
+	if config.Webhook.SecretToken != "" {
+		return config.Webhook.SecretToken
+	}
+
+	// the secret token can only contain letters, digits, `_` and `-`, so a hex digest of the bot token is used
+	key := sha256.Sum256([]byte("webhook:" + config.TelegramToken))
+	return hex.EncodeToString(key[:])
+}
+
+// ListenForWebhook registers the webhook and starts the HTTP server receiving updates into the returned channel.
+// The returned function stops the server.
+func ListenForWebhook(appContext *AppContext) (tgbotapi.UpdatesChannel, func(), error) {
+	webhookConfig := appContext.Config.Webhook
+
+	publicURL, err := url.Parse(webhookConfig.PublicURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid webhook public URL: %s", err)
+	}
+
+	err = registerWebhook(appContext)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to register webhook: %s", err)
+	}
+
+	updates := make(chan tgbotapi.Update, appContext.TelegramBot.Buffer)
+	stopped := make(chan struct{})
+
+	path := publicURL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, newWebhookHandler(appContext, updates, stopped))
+
+	listenAddress := webhookConfig.ListenAddress
+	if listenAddress == "" {
+		listenAddress = defaultWebhookListenAddress
+	}
+
+	server := &http.Server{Addr: listenAddress, Handler: mux}
+
+	go func() {
+		var err error
+		if webhookConfig.TLSCertFile != "" {
+			err = server.ListenAndServeTLS(webhookConfig.TLSCertFile, webhookConfig.TLSKeyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
+
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal().Err(err).Msg("Failed to serve webhook")
+		}
+	}()
+
+	log.Info().Str("address", listenAddress).Str("path", path).Msg("Listening for webhook updates")
+
+	stop := func() {
+		close(stopped)
+
+		ctx, cancel := context.WithTimeout(context.Background(), webhookShutdownTimeout)
+		defer cancel()
+
+		err := server.Shutdown(ctx)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to stop webhook server")
+		}
+	}
+
+	return updates, stop, nil
+}
+
+// registerWebhook sets the webhook with the secret token. `tgbotapi.WebhookConfig` has no secret token,
+// so the request is made directly.
+func registerWebhook(appContext *AppContext) error {
+	webhookConfig := appContext.Config.Webhook
+
+	params := tgbotapi.Params{
+		"url":          webhookConfig.PublicURL,
+		"secret_token": getWebhookSecret(appContext.Config),
+	}
+
+	var err error
+	if webhookConfig.UploadCertificate && webhookConfig.TLSCertFile != "" {
+		_, err = appContext.TelegramBot.UploadFiles("setWebhook", params, []tgbotapi.RequestFile{{
+			Name: "certificate",
+			Data: tgbotapi.FilePath(webhookConfig.TLSCertFile),
+		}})
+	} else {
+		_, err = appContext.TelegramBot.MakeRequest("setWebhook", params)
+	}
+
+	return err
+}
+
+// newWebhookHandler accepts updates sent by Telegram with the secret token and passes them to the channel.
+// Once stopped, updates are refused, so Telegram delivers them again after restart.
+func newWebhookHandler(appContext *AppContext, updates chan<- tgbotapi.Update, stopped <-chan struct{}) http.Handler {
+	secret := []byte(getWebhookSecret(appContext.Config))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(webhookSecretHeader)), secret) != 1 {
+			log.Warn().Str("remote", r.RemoteAddr).Msg("Webhook request with invalid secret token")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBodySize))
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+
+		var update tgbotapi.Update
+		err = json.Unmarshal(body, &update)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to parse webhook update")
+			http.Error(w, "invalid update", http.StatusBadRequest)
+			return
+		}
+
+		// a select picks a ready case at random, so the stop is checked first to refuse updates once stopped
+		select {
+		case <-stopped:
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		default:
+		}
+
+		select {
+		case updates <- update:
+			w.WriteHeader(http.StatusOK)
+		case <-stopped:
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// pollUpdates receives updates with long polling. An earlier registered webhook is removed, as Telegram doesn't
+// allow polling while it is set. The returned function stops polling.
+func pollUpdates(appContext *AppContext) (tgbotapi.UpdatesChannel, func()) {
+	_, err := appContext.TelegramBot.Request(tgbotapi.DeleteWebhookConfig{})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to delete webhook")
+	}
+
+	startPollHealth()
+
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = 60
+
+	return appContext.TelegramBot.GetUpdatesChan(u), appContext.TelegramBot.StopReceivingUpdates
+}
@@ -0,0 +1,103 @@
+package src
+
+import (
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testWebhookUpdate = `{"update_id": 1, "message": {"message_id": 5, "text": "Hi", "chat": {"id": 42, "type": "private"}, "from": {"id": 42}}}`
+
+func TestWebhookHandler(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.Webhook.SecretToken = "secret"
+	})
+
+	updates := make(chan tgbotapi.Update, 1)
+	handler := newWebhookHandler(h.appContext, updates, make(chan struct{}))
+
+	cases := []struct {
+		method string
+		secret string
+		body   string
+		status int
+	}{
+		{http.MethodGet, "secret", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "", testWebhookUpdate, http.StatusUnauthorized},
+		{http.MethodPost, "wrong", testWebhookUpdate, http.StatusUnauthorized},
+		{http.MethodPost, "secret", "not json", http.StatusBadRequest},
+		{http.MethodPost, "secret", testWebhookUpdate, http.StatusOK},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, "/telegram", strings.NewReader(c.body))
+		if c.secret != "" {
+			req.Header.Set(webhookSecretHeader, c.secret)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != c.status {
+			t.Errorf("expected status %d for %s with secret %q, got %d", c.status, c.method, c.secret, recorder.Code)
+		}
+	}
+
+	if len(updates) != 1 {
+		t.Fatalf("expected a single update to be accepted, got %d", len(updates))
+	}
+
+	update := <-updates
+	if update.Message == nil || update.Message.Text != "Hi" {
+		t.Errorf("expected the update to be parsed, got %v", update)
+	}
+}
+
+func TestRegisterWebhook(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.Webhook.PublicURL = "https://bot.example.com/telegram"
+	})
+
+	err := registerWebhook(h.appContext)
+	if err != nil {
+		t.Fatalf("failed to register webhook: %s", err)
+	}
+
+	params := h.telegram.lastCallTo("setWebhook").Params
+	if params.Get("url") != "https://bot.example.com/telegram" {
+		t.Errorf("expected the public URL to be registered, got %q", params.Get("url"))
+	}
+
+	if secret := params.Get("secret_token"); secret == "" || secret != getWebhookSecret(h.appContext.Config) {
+		t.Errorf("expected the derived secret token to be registered, got %q", secret)
+	}
+}
+
+func TestWebhookHandlerRefusesUpdatesWhenStopped(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.Webhook.SecretToken = "secret"
+	})
+
+	updates := make(chan tgbotapi.Update, 10)
+	stopped := make(chan struct{})
+	close(stopped)
+	handler := newWebhookHandler(h.appContext, updates, stopped)
+
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/telegram", strings.NewReader(testWebhookUpdate))
+		req.Header.Set(webhookSecretHeader, "secret")
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != http.StatusServiceUnavailable {
+			t.Fatalf("expected updates to be refused after stop, got status %d", recorder.Code)
+		}
+	}
+
+	if len(updates) != 0 {
+		t.Errorf("expected no updates to be accepted, got %d", len(updates))
+	}
+}